@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/zni/fslib/pkg/fat"
+)
+
+// Exit codes, the generic ones fsck(8) defines rather than the 0, 1 and 2 of
+// fsck.fat.
+const (
+	exit_clean           int = 0
+	exit_corrected       int = 1
+	exit_uncorrected     int = 4
+	exit_operational_err int = 8
+	exit_usage           int = 16
+)
+
+type problemOutput struct {
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+type problemGroup struct {
+	Kind     string          `json:"kind"`
+	Problems []problemOutput `json:"problems"`
+}
+
+type repairOutput struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+type fsckOutput struct {
+	Disk         string         `json:"disk"`
+	Type         string         `json:"type"`
+	Directories  int            `json:"directories"`
+	Files        int            `json:"files"`
+	Clusters     uint32         `json:"clusters"`
+	UsedClusters uint32         `json:"used_clusters"`
+	FreeClusters uint32         `json:"free_clusters"`
+	LostClusters uint32         `json:"lost_clusters"`
+	BadClusters  uint32         `json:"bad_clusters"`
+	Problems     []problemGroup `json:"problems"`
+	Repairs      []repairOutput `json:"repairs,omitempty"`
+	Uncorrected  []problemGroup `json:"uncorrected,omitempty"`
+	ExitCode     int            `json:"exit_code"`
+	Status       string         `json:"status"`
+}
+
+func main() {
+	flagset := flag.NewFlagSet("fs.fat32.fsck", flag.ContinueOnError)
+	disk := flagset.String("disk", "", "the disk to check")
+	repair := flagset.Bool("repair", false, "repair the problems found")
+	as_json := flagset.Bool("json", false, "print the results as JSON")
+	if err := flagset.Parse(os.Args[1:]); errors.Is(err, flag.ErrHelp) {
+		os.Exit(exit_clean)
+	} else if err != nil {
+		os.Exit(exit_usage)
+	}
+
+	if *disk == "" {
+		flagset.Usage()
+		os.Exit(exit_usage)
+	}
+
+	// Only a repair writes to the disk, so a check can be run on an image or
+	// device that can't be written.
+	open_device := fat.OpenFileDeviceReadOnly
+	if *repair {
+		open_device = fat.OpenFileDevice
+	}
+	dev, err := open_device(*disk)
+	if err != nil {
+		handleError(err)
+	}
+
+	vol, err := fat.OpenDevice(dev)
+	if err != nil {
+		dev.Close()
+		handleError(err)
+	}
+
+	output := &fsckOutput{Disk: *disk, Type: vol.Type().String()}
+	var check *fat.CheckReport
+	if *repair {
+		report, err := vol.Repair()
+		if err != nil {
+			vol.Close()
+			handleError(err)
+		}
+		check = report.Before
+		for _, action := range report.Actions {
+			output.Repairs = append(output.Repairs, repairOutput{action.Kind.String(), action.Path, action.Message})
+		}
+		output.Uncorrected = groupProblems(report.After.Problems)
+	} else {
+		check, err = vol.Check()
+		if err != nil {
+			vol.Close()
+			handleError(err)
+		}
+		output.Uncorrected = groupProblems(check.Problems)
+	}
+
+	if err := vol.Close(); err != nil {
+		handleError(err)
+	}
+
+	output.Directories = check.Directories
+	output.Files = check.Files
+	output.Clusters = check.Clusters
+	output.UsedClusters = check.UsedClusters
+	output.FreeClusters = check.FreeClusters
+	output.LostClusters = check.LostClusters
+	output.BadClusters = check.BadClusters
+	output.Problems = groupProblems(check.Problems)
+
+	switch {
+	case len(output.Uncorrected) > 0 && !*repair:
+		output.ExitCode = exit_uncorrected
+		output.Status = "errors found"
+	case len(output.Uncorrected) > 0:
+		output.ExitCode = exit_uncorrected
+		output.Status = "errors left uncorrected"
+	case len(output.Problems) > 0:
+		output.ExitCode = exit_corrected
+		output.Status = "errors corrected"
+	default:
+		output.ExitCode = exit_clean
+		output.Status = "clean"
+	}
+
+	if *as_json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(output); err != nil {
+			handleError(err)
+		}
+	} else {
+		printOutput(output, *repair)
+	}
+
+	os.Exit(output.ExitCode)
+}
+
+/*
+Group problems by their kind, in the order the kinds are declared.
+*/
+func groupProblems(problems []*fat.Problem) []problemGroup {
+	grouped := make(map[fat.ProblemKind][]problemOutput)
+	for _, problem := range problems {
+		grouped[problem.Kind] = append(grouped[problem.Kind], problemOutput{problem.Path, problem.Message})
+	}
+
+	groups := []problemGroup{}
+	for _, kind := range slices.Sorted(maps.Keys(grouped)) {
+		groups = append(groups, problemGroup{kind.String(), grouped[kind]})
+	}
+
+	return groups
+}
+
+func printGroups(groups []problemGroup) {
+	for _, group := range groups {
+		fmt.Printf("%s (%d):\n", group.Kind, len(group.Problems))
+		for _, problem := range group.Problems {
+			if problem.Path == "" {
+				fmt.Printf("  %s\n", problem.Message)
+			} else {
+				fmt.Printf("  %s: %s\n", problem.Path, problem.Message)
+			}
+		}
+	}
+}
+
+func printOutput(output *fsckOutput, repaired bool) {
+	fmt.Printf("%s: %s, %d directories, %d files, %d/%d clusters used\n",
+		output.Disk, output.Type, output.Directories, output.Files, output.UsedClusters, output.Clusters)
+
+	printGroups(output.Problems)
+
+	if repaired {
+		if len(output.Repairs) > 0 {
+			fmt.Printf("repairs (%d):\n", len(output.Repairs))
+		}
+		for _, action := range output.Repairs {
+			if action.Path == "" {
+				fmt.Printf("  %s\n", action.Message)
+			} else {
+				fmt.Printf("  %s: %s\n", action.Path, action.Message)
+			}
+		}
+		if len(output.Uncorrected) > 0 {
+			fmt.Println("left uncorrected:")
+			printGroups(output.Uncorrected)
+		}
+	}
+
+	fmt.Println(output.Status)
+}
+
+/*
+Display error text and exit with the code for an operational error.
+*/
+func handleError(err error) {
+	os.Stderr.WriteString(fmt.Sprintf("error: %v\n", err))
+	os.Exit(exit_operational_err)
+}
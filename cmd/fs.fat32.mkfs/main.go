@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zni/fslib/internal/utilities"
+	"github.com/zni/fslib/pkg/fat"
+)
+
+func main() {
+	flagset := flag.NewFlagSet("fs.fat32.mkfs", flag.ExitOnError)
+	disk := flagset.String("disk", "", "the image file to create or format")
+	size := flagset.String("size", "", "the size of the volume, such as 1440K, 64M or 2G (defaults to the size of an existing image)")
+	fat_type := flagset.String("type", "", "the FAT type, one of 12, 16 or 32 (picked from the size when unset)")
+	cluster_size := flagset.String("cluster-size", "", "the bytes per cluster, such as 4096 or 4K")
+	label := flagset.String("label", "", "the volume label")
+	sector_size := flagset.Uint("sector-size", 512, "the bytes per sector")
+	force := flagset.Bool("force", false, "format an existing non-empty image")
+	if err := flagset.Parse(os.Args[1:]); err != nil {
+		os.Exit(1)
+	}
+
+	if *disk == "" {
+		utilities.DisplayUsage(flagset)
+	}
+
+	opts := fat.FormatOptions{Label: *label}
+
+	switch strings.TrimPrefix(strings.ToUpper(*fat_type), "FAT") {
+	case "":
+	case "12":
+		opts.Type = fat.FAT_TYPE_12
+	case "16":
+		opts.Type = fat.FAT_TYPE_16
+	case "32":
+		opts.Type = fat.FAT_TYPE_32
+	default:
+		utilities.HandleError(fmt.Errorf("invalid FAT type %q", *fat_type))
+	}
+
+	if *sector_size > 0xFFFF {
+		utilities.HandleError(fmt.Errorf("invalid sector size %d", *sector_size))
+	}
+	opts.SectorSize = uint16(*sector_size)
+
+	if *cluster_size != "" {
+		bytes_per_cluster, err := utilities.ParseSize(*cluster_size)
+		if err != nil {
+			utilities.HandleError(err)
+		}
+		if bytes_per_cluster > 0xFFFFFFFF {
+			utilities.HandleError(fmt.Errorf("invalid cluster size %q", *cluster_size))
+		}
+		opts.ClusterSize = uint32(bytes_per_cluster)
+	}
+
+	// Never clobber an existing volume unless asked to.
+	existing_size, err := utilities.ExistingSize(*disk)
+	if err != nil {
+		utilities.HandleError(err)
+	}
+	if existing_size > 0 && !*force {
+		utilities.HandleError(fmt.Errorf("%s is not empty, use -force to format it anyway", *disk))
+	}
+
+	volume_size := existing_size
+	if *size != "" {
+		volume_size, err = utilities.ParseSize(*size)
+		if err != nil {
+			utilities.HandleError(err)
+		}
+	}
+	if volume_size == 0 {
+		utilities.DisplayUsage(flagset)
+	}
+
+	image, err := utilities.OpenImage(*disk)
+	if err != nil {
+		utilities.HandleError(err)
+	}
+
+	// Size the image to match the volume.
+	if err := image.Resize(volume_size); err != nil {
+		image.Abandon(err)
+	}
+
+	geometry, err := fat.Format(image, volume_size, &opts)
+	if err != nil {
+		image.Abandon(err)
+	}
+
+	if err := image.Close(); err != nil {
+		utilities.HandleError(err)
+	}
+
+	geometry.PrintInfo()
+}
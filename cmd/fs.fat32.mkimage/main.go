@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zni/fslib/internal/utilities"
+	"github.com/zni/fslib/pkg/fat"
+	"github.com/zni/fslib/pkg/gpt"
+)
+
+const partition_usage string = `a partition to create, given as comma separated key=value options and
+repeated for each partition in order:
+  size=64M           size of the partition (the rest of the disk when unset)
+  fat=12|16|32|none  FAT type to format with (picked from the size when unset)
+  label=NAME         volume label
+  cluster-size=4K    bytes per cluster
+  type=TYPE          MBR type in hex such as 0c, or GPT type GUID or one of
+                     efi, data or linux
+  name=NAME          GPT partition name
+  bootable           mark the MBR partition as the one to boot from`
+
+// GPT partition types that may be given by name.
+var gpt_types = map[string]gpt.GUID{
+	"efi":   gpt.TYPE_EFI_SYSTEM,
+	"data":  gpt.TYPE_BASIC_DATA,
+	"linux": gpt.TYPE_LINUX_FS,
+}
+
+func main() {
+	var partitions []string
+
+	flagset := flag.NewFlagSet("fs.fat32.mkimage", flag.ExitOnError)
+	disk := flagset.String("disk", "", "the image file to create")
+	size := flagset.String("size", "", "the size of the disk, such as 64M or 2G (defaults to the size of an existing image)")
+	scheme := flagset.String("scheme", "mbr", "the partition table to create, mbr or gpt")
+	alignment := flagset.String("align", "1M", "the boundary each partition starts on")
+	force := flagset.Bool("force", false, "overwrite an existing non-empty image")
+	flagset.Func("part", partition_usage, func(s string) error {
+		partitions = append(partitions, s)
+		return nil
+	})
+	if err := flagset.Parse(os.Args[1:]); err != nil {
+		os.Exit(1)
+	}
+
+	if *disk == "" || len(partitions) == 0 {
+		utilities.DisplayUsage(flagset)
+	}
+
+	opts := fat.DiskOptions{}
+	switch strings.ToLower(*scheme) {
+	case "mbr":
+		opts.Scheme = fat.PARTITION_SCHEME_MBR
+	case "gpt":
+		opts.Scheme = fat.PARTITION_SCHEME_GPT
+	default:
+		utilities.HandleError(fmt.Errorf("invalid partition scheme %q", *scheme))
+	}
+
+	var err error
+	opts.Alignment, err = utilities.ParseSize(*alignment)
+	if err != nil {
+		utilities.HandleError(err)
+	}
+
+	for _, s := range partitions {
+		partition_opts, err := parsePartition(s, opts.Scheme)
+		if err != nil {
+			utilities.HandleError(err)
+		}
+		opts.Partitions = append(opts.Partitions, partition_opts)
+	}
+
+	// Never clobber an existing image unless asked to.
+	existing_size, err := utilities.ExistingSize(*disk)
+	if err != nil {
+		utilities.HandleError(err)
+	}
+	if existing_size > 0 && !*force {
+		utilities.HandleError(fmt.Errorf("%s is not empty, use -force to overwrite it anyway", *disk))
+	}
+
+	disk_size := existing_size
+	if *size != "" {
+		disk_size, err = utilities.ParseSize(*size)
+		if err != nil {
+			utilities.HandleError(err)
+		}
+	}
+	if disk_size == 0 {
+		utilities.DisplayUsage(flagset)
+	}
+
+	image, err := utilities.OpenImage(*disk)
+	if err != nil {
+		utilities.HandleError(err)
+	}
+
+	// Size the image to match the disk.
+	if err := image.Resize(disk_size); err != nil {
+		image.Abandon(err)
+	}
+
+	dev, err := fat.NewFileDevice(image.File)
+	if err != nil {
+		image.Abandon(err)
+	}
+
+	laid_out, err := fat.FormatDisk(dev, &opts)
+	if err != nil {
+		dev.Close()
+		image.Abandon(err)
+	}
+
+	if err := dev.Close(); err != nil {
+		utilities.HandleError(err)
+	}
+
+	fmt.Printf("%s: %s, %d bytes\n", *disk, opts.Scheme, disk_size)
+	for _, partition := range laid_out {
+		fmt.Printf("partition %d: %d bytes at %d", partition.Number, partition.Size, partition.Offset)
+		if partition.Geometry == nil {
+			fmt.Println(", unformatted")
+			continue
+		}
+		fmt.Printf(", %s\n", partition.Geometry.Type)
+		partition.Geometry.PrintInfo()
+	}
+}
+
+/*
+Parse the options of a partition given with -part.
+*/
+func parsePartition(s string, scheme fat.PartitionScheme) (fat.PartitionOptions, error) {
+	partition_opts := fat.PartitionOptions{}
+	format_opts := &fat.FormatOptions{}
+	unformatted := false
+	volume_option := ""
+
+	for _, field := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "size":
+			size, err := utilities.ParseSize(value)
+			if err != nil {
+				return partition_opts, err
+			}
+			partition_opts.Size = size
+		case "fat":
+			switch strings.TrimPrefix(strings.ToUpper(value), "FAT") {
+			case "12":
+				format_opts.Type = fat.FAT_TYPE_12
+			case "16":
+				format_opts.Type = fat.FAT_TYPE_16
+			case "32":
+				format_opts.Type = fat.FAT_TYPE_32
+			case "NONE":
+				unformatted = true
+			default:
+				return partition_opts, fmt.Errorf("invalid FAT type %q", value)
+			}
+		case "label":
+			format_opts.Label = value
+			volume_option = key
+		case "cluster-size":
+			cluster_size, err := utilities.ParseSize(value)
+			if err != nil {
+				return partition_opts, err
+			}
+			if cluster_size > 0xFFFFFFFF {
+				return partition_opts, fmt.Errorf("invalid cluster size %q", value)
+			}
+			format_opts.ClusterSize = uint32(cluster_size)
+			volume_option = key
+		case "type":
+			if err := parseType(value, scheme, &partition_opts); err != nil {
+				return partition_opts, err
+			}
+		case "name":
+			partition_opts.Name = value
+		case "bootable":
+			partition_opts.Bootable = true
+		default:
+			return partition_opts, fmt.Errorf("invalid partition option %q", field)
+		}
+	}
+
+	if unformatted && volume_option != "" {
+		return partition_opts, fmt.Errorf("%s given for a partition with fat=none", volume_option)
+	}
+	if !unformatted {
+		partition_opts.Format = format_opts
+	}
+
+	return partition_opts, nil
+}
+
+/*
+Parse a partition type, which is a hex byte for an MBR, and a GUID or the name
+of a common type for a GPT.
+*/
+func parseType(value string, scheme fat.PartitionScheme, partition_opts *fat.PartitionOptions) error {
+	if scheme == fat.PARTITION_SCHEME_GPT {
+		if guid, ok := gpt_types[strings.ToLower(value)]; ok {
+			partition_opts.GPTType = guid
+			return nil
+		}
+
+		guid, err := gpt.ParseGUID(value)
+		if err != nil {
+			return err
+		}
+		partition_opts.GPTType = guid
+		return nil
+	}
+
+	partition_type, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 8)
+	if err != nil || partition_type == 0 {
+		return fmt.Errorf("invalid MBR partition type %q", value)
+	}
+	partition_opts.MBRType = uint8(partition_type)
+
+	return nil
+}
@@ -1,9 +1,14 @@
 package utilities
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 )
 
 /*
@@ -21,3 +26,119 @@ func DisplayUsage(flagset *flag.FlagSet) {
 	flagset.Usage()
 	os.Exit(1)
 }
+
+/*
+Parse a size in bytes, optionally followed by a K, M, G or T suffix for
+kibibytes, mebibytes, gibibytes or tebibytes.
+*/
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	number := s
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		number = s[:len(s)-1]
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 || size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return size * multiplier, nil
+}
+
+/*
+Get the size of an existing image file or device node, or 0 when there's
+nothing at the path yet. The size is found by seeking to the end, as device
+nodes stat as empty.
+*/
+func ExistingSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return file.Seek(0, io.SeekEnd)
+}
+
+/*
+Image is an image file or device node opened to be written by a command. It
+remembers how it was found, so it can be put back when the command fails.
+*/
+type Image struct {
+	*os.File
+	path     string
+	created  bool
+	old_size int64
+}
+
+/*
+Open an image file or device node to be written, creating an image file when
+there's nothing at the path yet.
+*/
+func OpenImage(path string) (*Image, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		return &Image{File: file, path: path, created: true}, nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+
+	file, err = os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	old_size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Image{File: file, path: path, old_size: old_size}, nil
+}
+
+/*
+Resize an image file to the given size. Device nodes are left as they are.
+*/
+func (image *Image) Resize(size int64) error {
+	info, err := image.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == size {
+		return err
+	}
+
+	return image.Truncate(size)
+}
+
+/*
+Give up on an image after a failure, removing the image file if it was created
+or putting it back to its old size otherwise, then display the error and exit.
+The image may already have been closed.
+*/
+func (image *Image) Abandon(err error) {
+	image.Close()
+	if image.created {
+		os.Remove(image.path)
+	} else if info, stat_err := os.Stat(image.path); stat_err == nil && info.Mode().IsRegular() {
+		os.Truncate(image.path, image.old_size)
+	}
+
+	HandleError(err)
+}
@@ -29,3 +29,7 @@ func DirClusterToUint(cluster_lo uint, cluster_hi uint) uint32 {
 func YearToFATYear(year int) int {
 	return year - 1980
 }
+
+func FATYearToYear(year int) int {
+	return year + 1980
+}
@@ -0,0 +1,308 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+BlockDevice is the storage a volume lives on. Every read and write of a volume
+goes through ReadAt and WriteAt, so a device never has to keep track of a
+position of its own.
+*/
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// The size of the device in bytes.
+	Size() int64
+	// Flush any writes to the underlying storage.
+	Sync() error
+	// The size of the device's sectors in bytes.
+	SectorSize() int
+}
+
+/*
+FileDevice is a BlockDevice backed by an image file or a device node.
+*/
+type FileDevice struct {
+	file        *os.File
+	size        int64
+	sector_size int
+	read_only   bool
+}
+
+/*
+Open an image file or device node for reading and writing as a BlockDevice.
+*/
+func OpenFileDevice(path string) (*FileDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := NewFileDevice(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+/*
+Open an image file or device node for reading only as a BlockDevice, so it can
+be looked at without permission to write it. Writes to the device fail, and
+syncing it does nothing.
+*/
+func OpenFileDeviceReadOnly(path string) (*FileDevice, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := NewFileDevice(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	dev.read_only = true
+
+	return dev, nil
+}
+
+/*
+Wrap an open file as a BlockDevice with 512 byte sectors. Closing the device
+closes the file.
+*/
+func NewFileDevice(file *os.File) (*FileDevice, error) {
+	// Seeking to the end also works for device nodes, which stat as empty.
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDevice{file: file, size: size, sector_size: int(default_sector_size)}, nil
+}
+
+func (dev *FileDevice) ReadAt(b []byte, off int64) (int, error) {
+	return dev.file.ReadAt(b, off)
+}
+
+func (dev *FileDevice) WriteAt(b []byte, off int64) (int, error) {
+	if dev.read_only {
+		return 0, fmt.Errorf("%s opened read only", dev.file.Name())
+	}
+
+	n, err := dev.file.WriteAt(b, off)
+	dev.size = max(dev.size, off+int64(n))
+
+	return n, err
+}
+
+func (dev *FileDevice) Size() int64 {
+	return dev.size
+}
+
+func (dev *FileDevice) Sync() error {
+	if dev.read_only {
+		return nil
+	}
+
+	return dev.file.Sync()
+}
+
+func (dev *FileDevice) SectorSize() int {
+	return dev.sector_size
+}
+
+/*
+The path of the underlying file.
+*/
+func (dev *FileDevice) Name() string {
+	return dev.file.Name()
+}
+
+func (dev *FileDevice) Close() error {
+	return dev.file.Close()
+}
+
+/*
+MemDevice is a BlockDevice held entirely in memory.
+*/
+type MemDevice struct {
+	data []byte
+}
+
+/*
+Use a byte slice as a BlockDevice. Reads and writes go straight to the slice,
+which never grows.
+*/
+func NewMemDevice(data []byte) *MemDevice {
+	return &MemDevice{data: data}
+}
+
+func (dev *MemDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(dev.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(b, dev.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (dev *MemDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(dev.data)) {
+		return 0, io.ErrShortWrite
+	}
+
+	n := copy(dev.data[off:], b)
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+func (dev *MemDevice) Size() int64 {
+	return int64(len(dev.data))
+}
+
+func (dev *MemDevice) Sync() error {
+	return nil
+}
+
+func (dev *MemDevice) SectorSize() int {
+	return int(default_sector_size)
+}
+
+/*
+A name for the device to show in messages.
+*/
+func (dev *MemDevice) Name() string {
+	return "memory"
+}
+
+/*
+The contents of the device. The slice is shared with the device, not copied.
+*/
+func (dev *MemDevice) Bytes() []byte {
+	return dev.data
+}
+
+/*
+SectionDevice is a BlockDevice covering part of another device, such as a
+partition inside a whole disk image.
+*/
+type SectionDevice struct {
+	dev    BlockDevice
+	offset int64
+	size   int64
+}
+
+/*
+Create a BlockDevice for the given number of bytes of a device, starting at the
+given offset. Closing the section leaves the device open.
+*/
+func NewSectionDevice(dev BlockDevice, offset int64, size int64) (*SectionDevice, error) {
+	if offset < 0 || size < 0 || offset+size > dev.Size() {
+		return nil, fmt.Errorf("section of %d bytes at %d is outside the device of %d bytes", size, offset, dev.Size())
+	}
+
+	return &SectionDevice{dev: dev, offset: offset, size: size}, nil
+}
+
+func (section *SectionDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= section.size {
+		return 0, io.EOF
+	}
+
+	if remaining := section.size - off; int64(len(b)) > remaining {
+		n, err := section.dev.ReadAt(b[:remaining], section.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	return section.dev.ReadAt(b, section.offset+off)
+}
+
+func (section *SectionDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= section.size {
+		return 0, io.ErrShortWrite
+	}
+
+	if remaining := section.size - off; int64(len(b)) > remaining {
+		n, err := section.dev.WriteAt(b[:remaining], section.offset+off)
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, err
+	}
+
+	return section.dev.WriteAt(b, section.offset+off)
+}
+
+func (section *SectionDevice) Size() int64 {
+	return section.size
+}
+
+func (section *SectionDevice) Sync() error {
+	return section.dev.Sync()
+}
+
+func (section *SectionDevice) SectorSize() int {
+	return section.dev.SectorSize()
+}
+
+/*
+The offset of the section within its device, in bytes.
+*/
+func (section *SectionDevice) Offset() int64 {
+	return section.offset
+}
+
+/*
+Get a name for the device to show in messages, if it has one.
+*/
+func deviceName(dev BlockDevice) string {
+	if named, ok := dev.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+
+	return fmt.Sprintf("%T", dev)
+}
+
+/*
+Flush the device, then close it if it can be closed.
+*/
+func closeDevice(dev BlockDevice) error {
+	if err := dev.Sync(); err != nil {
+		return err
+	}
+
+	if closer, ok := dev.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package fat
 
 import (
 	"io"
-	"os"
 
 	"github.com/zni/fslib/internal/utilities"
 )
@@ -30,7 +29,7 @@ type CommonBPB struct {
 	BPB_totsec32   uint32
 }
 
-func ReadCommonBPB(f *os.File) (*CommonBPB, error) {
+func ReadCommonBPB(f io.Reader) (*CommonBPB, error) {
 	var bpb CommonBPB = CommonBPB{}
 	short_ := make([]byte, 2)
 	byte_ := make([]byte, 1)
@@ -120,3 +119,23 @@ func ReadCommonBPB(f *os.File) (*CommonBPB, error) {
 
 	return &bpb, nil
 }
+
+/*
+Encode the common BPB into the first 36 bytes of a boot sector.
+*/
+func (bpb *CommonBPB) encode(sector []byte) {
+	copy(sector[0:3], bpb.BS_jmpboot[:])
+	copy(sector[3:11], bpb.BS_oemname[:])
+	copy(sector[11:13], utilities.ShortToBytes(bpb.BPB_bytspersec))
+	sector[13] = bpb.BPB_secperclus
+	copy(sector[14:16], utilities.ShortToBytes(bpb.BPB_rsvdseccnt))
+	sector[16] = bpb.BPB_numfats
+	copy(sector[17:19], utilities.ShortToBytes(bpb.BPB_rootentcnt))
+	copy(sector[19:21], utilities.ShortToBytes(bpb.BPB_totsec16))
+	sector[21] = bpb.BPB_media
+	copy(sector[22:24], utilities.ShortToBytes(bpb.BPB_fatsz16))
+	copy(sector[24:26], utilities.ShortToBytes(bpb.BPB_secpertrk))
+	copy(sector[26:28], utilities.ShortToBytes(bpb.BPB_numheads))
+	copy(sector[28:32], utilities.IntToBytes(bpb.BPB_hiddsec))
+	copy(sector[32:36], utilities.IntToBytes(bpb.BPB_totsec32))
+}
@@ -0,0 +1,708 @@
+package fat
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/zni/fslib/internal/utilities"
+)
+
+/*
+The kinds of damage the consistency checker looks for.
+*/
+type ProblemKind int
+
+const (
+	PROBLEM_LOST_CLUSTERS ProblemKind = iota + 1
+	PROBLEM_CROSS_LINKED
+	PROBLEM_BAD_CHAIN
+	PROBLEM_CHAIN_TOO_SHORT
+	PROBLEM_CHAIN_TOO_LONG
+	PROBLEM_BAD_DOT_ENTRY
+	PROBLEM_ORPHANED_LDIR
+	PROBLEM_FSINFO_FREE_COUNT
+	PROBLEM_FSINFO_NEXT_FREE
+	PROBLEM_FAT_MISMATCH
+)
+
+var problem_kind_names = map[ProblemKind]string{
+	PROBLEM_LOST_CLUSTERS:     "lost clusters",
+	PROBLEM_CROSS_LINKED:      "cross-linked chains",
+	PROBLEM_BAD_CHAIN:         "bad chains",
+	PROBLEM_CHAIN_TOO_SHORT:   "chains shorter than file size",
+	PROBLEM_CHAIN_TOO_LONG:    "chains longer than file size",
+	PROBLEM_BAD_DOT_ENTRY:     "bad '.' and '..' entries",
+	PROBLEM_ORPHANED_LDIR:     "orphaned long name entries",
+	PROBLEM_FSINFO_FREE_COUNT: "FSInfo free count",
+	PROBLEM_FSINFO_NEXT_FREE:  "FSInfo next free cluster",
+	PROBLEM_FAT_MISMATCH:      "FAT copies differ",
+}
+
+func (kind ProblemKind) String() string {
+	if name, ok := problem_kind_names[kind]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("problem %d", int(kind))
+}
+
+/*
+Problem is a single piece of damage found on a volume.
+*/
+type Problem struct {
+	Kind ProblemKind
+
+	// The file or directory the problem belongs to, empty for problems with the
+	// volume as a whole.
+	Path string
+
+	// Location in bytes of the DIR entry involved, if there is one.
+	Loc uint32
+
+	// The cluster the problem was found at, such as the first cluster of a
+	// file or lost chain, or the cluster two chains share.
+	Cluster uint32
+
+	// The number of clusters, entries or FAT copies the problem covers.
+	Count uint32
+
+	// Location in bytes of each slot of a run of orphaned LDIR entries.
+	Slots []uint32
+
+	Message string
+}
+
+func (problem *Problem) String() string {
+	if problem.Path == "" {
+		return problem.Message
+	}
+
+	return fmt.Sprintf("%s: %s", problem.Path, problem.Message)
+}
+
+/*
+CheckReport holds everything found by a consistency check of a volume.
+*/
+type CheckReport struct {
+	Problems []*Problem
+
+	Directories  int
+	Files        int
+	Clusters     uint32
+	UsedClusters uint32
+	FreeClusters uint32
+	LostClusters uint32
+	BadClusters  uint32
+}
+
+/*
+Did the check come back without any problems?
+*/
+func (report *CheckReport) Clean() bool {
+	return len(report.Problems) == 0
+}
+
+/*
+Get the problems of the given kind.
+*/
+func (report *CheckReport) ProblemsOfKind(kind ProblemKind) []*Problem {
+	var problems []*Problem
+	for _, problem := range report.Problems {
+		if problem.Kind == kind {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+func (report *CheckReport) add(problem *Problem) {
+	report.Problems = append(report.Problems, problem)
+}
+
+/*
+Check the consistency of a volume without changing it. Every directory is
+walked from the root, every chain in the FAT is followed, and what's found is
+compared against the DIR entries, the FSInfo and the other copies of the FAT.
+An error is only returned when the volume can't be read.
+*/
+func Check[T FATSystem](vol T) (*CheckReport, error) {
+	checker := newChecker(vol)
+	if err := checker.run(); err != nil {
+		return nil, err
+	}
+
+	return checker.report, nil
+}
+
+type checker[T FATSystem] struct {
+	vol          T
+	report       *CheckReport
+	max_clusters uint32
+
+	// The index into paths of the file or directory that claimed each
+	// cluster, 0 for clusters nothing has claimed.
+	owners []int
+	paths  []string
+
+	// First clusters of directories that have already been walked.
+	visited map[uint32]bool
+}
+
+type pendingDir struct {
+	path           string
+	cluster        uint32
+	parent_cluster uint32
+}
+
+type ldirSlot struct {
+	loc  uint32
+	ldir *LDIR
+}
+
+func newChecker[T FATSystem](vol T) *checker[T] {
+	max_clusters := CountOfClusters(vol) + 2
+
+	return &checker[T]{
+		vol:          vol,
+		report:       &CheckReport{Clusters: max_clusters - 2},
+		max_clusters: max_clusters,
+		owners:       make([]int, max_clusters),
+		paths:        []string{""},
+		visited:      make(map[uint32]bool),
+	}
+}
+
+func (c *checker[T]) run() error {
+	root_cluster := RootCluster(c.vol)
+	if root_cluster != 0 {
+		c.claimChain("/", 0, root_cluster)
+	}
+
+	// Walk the directory tree breadth first, so a deep tree can't run out of stack.
+	c.visited[root_cluster] = true
+	queue := []pendingDir{{"/", root_cluster, 0}}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		subdirs, err := c.checkDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %w", dir.path, err)
+		}
+		queue = append(queue, subdirs...)
+	}
+
+	c.checkClusters()
+	c.checkFSInfo()
+	if err := c.checkFATCopies(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Read every slot of a directory, checking its '.' and '..' entries and LDIR
+entries, and claiming the chains of the files and directories in it. Returns
+the subdirectories still to be walked.
+*/
+func (c *checker[T]) checkDir(dir pendingDir) ([]pendingDir, error) {
+	is_root := dir.path == "/"
+	reader := NewDirReader(c.vol, dir.cluster)
+
+	// The '..' entries of subdirectories refer to the root directory as cluster 0.
+	parent_cluster := dir.cluster
+	if is_root {
+		parent_cluster = 0
+	}
+
+	var subdirs []pendingDir
+	var run []ldirSlot
+	orphan := func() {
+		if len(run) == 0 {
+			return
+		}
+
+		problem := &Problem{
+			Kind:    PROBLEM_ORPHANED_LDIR,
+			Path:    dir.path,
+			Loc:     run[0].loc,
+			Count:   uint32(len(run)),
+			Message: fmt.Sprintf("%d long name entries at %08x don't belong to any file", len(run), run[0].loc),
+		}
+		for _, slot := range run {
+			problem.Slots = append(problem.Slots, slot.loc)
+		}
+		c.report.add(problem)
+		run = nil
+	}
+
+	for index := 0; index < max_dir_entries; index++ {
+		slot_loc, err := reader.nextSlot()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		loc := uint32(slot_loc)
+
+		ldir, dir_entry, err := c.readSlot(loc)
+		if err != nil {
+			return nil, err
+		}
+
+		if !is_root && index < 2 {
+			c.checkDotEntry(dir, index, loc, dir_entry, ldir)
+		}
+
+		if dir_entry.DIR_name[0] == free_entry {
+			break
+		}
+		if dir_entry.DIR_name[0] == deleted_entry {
+			orphan()
+			continue
+		}
+
+		// Gather up a run of LDIR entries until the DIR entry they belong to.
+		if ldir != nil {
+			if (ldir.ordinal & last_long_entry) != 0 {
+				orphan()
+			}
+			run = append(run, ldirSlot{loc, ldir})
+			continue
+		}
+
+		name := ShortName(dir_entry)
+		if len(run) > 0 {
+			if ldirsMatch(run, dir_entry) {
+				ldirs := make([]*LDIR, len(run))
+				for i, slot := range run {
+					ldirs[i] = slot.ldir
+				}
+				if long_name := joinLDIRs(ldirs); long_name != "" {
+					name = long_name
+				}
+				run = nil
+			} else {
+				orphan()
+			}
+		}
+
+		if IsVolumeLabel(dir_entry) {
+			continue
+		}
+		if IsSystemDIR(dir_entry) {
+			if is_root || index >= 2 {
+				c.report.add(&Problem{
+					Kind:    PROBLEM_BAD_DOT_ENTRY,
+					Path:    dir.path,
+					Loc:     loc,
+					Message: fmt.Sprintf("unexpected '%s' entry at %08x", name, loc),
+				})
+			}
+			continue
+		}
+
+		entry_path := path.Join(dir.path, name)
+		cluster := utilities.DirClusterToUint(
+			uint(dir_entry.DIR_cluster_lo),
+			uint(dir_entry.DIR_cluster_hi),
+		)
+
+		if IsDirectory(dir_entry) {
+			c.report.Directories++
+			if cluster == 0 {
+				c.report.add(&Problem{
+					Kind:    PROBLEM_BAD_CHAIN,
+					Path:    entry_path,
+					Loc:     loc,
+					Message: "directory has no clusters",
+				})
+				continue
+			}
+
+			c.claimChain(entry_path, loc, cluster)
+			if !c.visited[cluster] {
+				c.visited[cluster] = true
+				subdirs = append(subdirs, pendingDir{entry_path, cluster, parent_cluster})
+			}
+			continue
+		}
+
+		c.report.Files++
+		c.checkFile(entry_path, loc, dir_entry, cluster)
+	}
+	orphan()
+
+	return subdirs, nil
+}
+
+/*
+Read the 32 byte slot at loc, which holds either an LDIR entry or a DIR entry.
+The DIR entry is always returned, so its first byte can be checked for free and
+deleted slots.
+*/
+func (c *checker[T]) readSlot(loc uint32) (*LDIR, *DIR, error) {
+	disk_ref := c.vol.GetDiskRef()
+	dir_entry, err := ReadDIR(disk_ref, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if (dir_entry.DIR_attr&long_entry) != long_entry || dir_entry.DIR_name[0] == free_entry || dir_entry.DIR_name[0] == deleted_entry {
+		return nil, dir_entry, nil
+	}
+
+	ldir, err := ReadLDIR(disk_ref, int64(loc))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ldir, dir_entry, nil
+}
+
+/*
+Do the LDIR entries in the run make up a complete long name for the DIR entry?
+*/
+func ldirsMatch(run []ldirSlot, dir_entry *DIR) bool {
+	count := int(run[0].ldir.ordinal &^ last_long_entry)
+	if (run[0].ldir.ordinal&last_long_entry) == 0 || count != len(run) {
+		return false
+	}
+
+	chksum := computeShortChecksum(dir_entry)
+	for i, slot := range run {
+		if int(slot.ldir.ordinal&^last_long_entry) != count-i || slot.ldir.chksum != chksum {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+Check that the first two slots of a directory hold its '.' and '..' entries,
+pointing at the directory itself and its parent.
+*/
+func (c *checker[T]) checkDotEntry(dir pendingDir, index int, loc uint32, dir_entry *DIR, ldir *LDIR) {
+	expected_name := ".          "
+	expected_cluster := dir.cluster
+	if index == 1 {
+		expected_name = "..         "
+		expected_cluster = dir.parent_cluster
+	}
+
+	if ldir != nil || string(dir_entry.DIR_name) != expected_name || !IsDirectory(dir_entry) {
+		c.report.add(&Problem{
+			Kind:    PROBLEM_BAD_DOT_ENTRY,
+			Path:    dir.path,
+			Loc:     loc,
+			Cluster: expected_cluster,
+			Message: fmt.Sprintf("missing '%s' entry", expected_name[:index+1]),
+		})
+		return
+	}
+
+	cluster := utilities.DirClusterToUint(
+		uint(dir_entry.DIR_cluster_lo),
+		uint(dir_entry.DIR_cluster_hi),
+	)
+
+	// A '..' entry may refer to a FAT32 root directory by its cluster as well as by 0.
+	if cluster == expected_cluster || (index == 1 && expected_cluster == 0 && cluster == RootCluster(c.vol)) {
+		return
+	}
+
+	c.report.add(&Problem{
+		Kind:    PROBLEM_BAD_DOT_ENTRY,
+		Path:    dir.path,
+		Loc:     loc,
+		Cluster: expected_cluster,
+		Message: fmt.Sprintf("'%s' entry points at cluster %d instead of %d", expected_name[:index+1], cluster, expected_cluster),
+	})
+}
+
+/*
+Claim the chain of a regular file and check it's long enough for the file's size.
+*/
+func (c *checker[T]) checkFile(file_path string, loc uint32, dir_entry *DIR, cluster uint32) {
+	var count uint32
+	if cluster != 0 {
+		var ok bool
+		count, ok = c.claimChain(file_path, loc, cluster)
+		if !ok {
+			return
+		}
+	}
+
+	cluster_size := uint64(ClusterSize(c.vol))
+	needed := uint32((uint64(dir_entry.DIR_filesize) + cluster_size - 1) / cluster_size)
+	if count < needed {
+		c.report.add(&Problem{
+			Kind:    PROBLEM_CHAIN_TOO_SHORT,
+			Path:    file_path,
+			Loc:     loc,
+			Cluster: cluster,
+			Count:   count,
+			Message: fmt.Sprintf("file size is %d bytes but its chain only has %d clusters", dir_entry.DIR_filesize, count),
+		})
+	} else if count > needed {
+		c.report.add(&Problem{
+			Kind:    PROBLEM_CHAIN_TOO_LONG,
+			Path:    file_path,
+			Loc:     loc,
+			Cluster: cluster,
+			Count:   count,
+			Message: fmt.Sprintf("file size is %d bytes but its chain has %d clusters", dir_entry.DIR_filesize, count),
+		})
+	}
+}
+
+/*
+Follow the chain starting at the given cluster, claiming each cluster for the
+file or directory at the path. Returns the number of clusters claimed, and
+whether the chain was intact all the way to its end of chain marker.
+*/
+func (c *checker[T]) claimChain(file_path string, loc uint32, start uint32) (uint32, bool) {
+	c.paths = append(c.paths, file_path)
+	owner := len(c.paths) - 1
+
+	var count uint32
+	cluster := start
+	for {
+		if !c.validCluster(cluster) {
+			c.report.add(&Problem{
+				Kind:    PROBLEM_BAD_CHAIN,
+				Path:    file_path,
+				Loc:     loc,
+				Cluster: cluster,
+				Count:   count,
+				Message: fmt.Sprintf("chain points at invalid cluster %d after %d clusters", cluster, count),
+			})
+			return count, false
+		}
+
+		if c.owners[cluster] == owner {
+			c.report.add(&Problem{
+				Kind:    PROBLEM_BAD_CHAIN,
+				Path:    file_path,
+				Loc:     loc,
+				Cluster: cluster,
+				Count:   count,
+				Message: fmt.Sprintf("chain loops back to cluster %d after %d clusters", cluster, count),
+			})
+			return count, false
+		}
+		if c.owners[cluster] != 0 {
+			c.report.add(&Problem{
+				Kind:    PROBLEM_CROSS_LINKED,
+				Path:    file_path,
+				Loc:     loc,
+				Cluster: cluster,
+				Count:   count,
+				Message: fmt.Sprintf("cluster %d is also used by %s", cluster, c.paths[c.owners[cluster]]),
+			})
+			return count, false
+		}
+
+		c.owners[cluster] = owner
+		c.report.UsedClusters++
+		count++
+
+		next_cluster := c.entry(cluster)
+		if c.isEOC(next_cluster) {
+			return count, true
+		}
+		if next_cluster == 0 || c.isBad(next_cluster) {
+			c.report.add(&Problem{
+				Kind:    PROBLEM_BAD_CHAIN,
+				Path:    file_path,
+				Loc:     loc,
+				Cluster: cluster,
+				Count:   count,
+				Message: fmt.Sprintf("cluster %d in the chain is marked free or bad", cluster),
+			})
+			return count, false
+		}
+
+		cluster = next_cluster
+	}
+}
+
+/*
+Count up the free and bad clusters, and gather clusters in use that no file or
+directory claimed into lost chains.
+*/
+func (c *checker[T]) checkClusters() {
+	lost := make(map[uint32]bool)
+	for cluster := uint32(2); cluster < c.max_clusters; cluster++ {
+		value := c.entry(cluster)
+		switch {
+		case value == 0:
+			c.report.FreeClusters++
+		case c.isBad(value):
+			c.report.BadClusters++
+		case c.owners[cluster] == 0:
+			lost[cluster] = true
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+	c.report.LostClusters = uint32(len(lost))
+
+	// The head of a lost chain is a lost cluster no other lost cluster points at.
+	pointed_at := make(map[uint32]bool)
+	for cluster := range lost {
+		pointed_at[c.entry(cluster)] = true
+	}
+
+	report_chain := func(head uint32) {
+		var count uint32
+		for cluster := head; lost[cluster]; cluster = c.entry(cluster) {
+			delete(lost, cluster)
+			count++
+			if c.isEOC(c.entry(cluster)) {
+				break
+			}
+		}
+
+		c.report.add(&Problem{
+			Kind:    PROBLEM_LOST_CLUSTERS,
+			Cluster: head,
+			Count:   count,
+			Message: fmt.Sprintf("%d lost clusters starting at cluster %d", count, head),
+		})
+	}
+
+	for cluster := uint32(2); cluster < c.max_clusters; cluster++ {
+		if lost[cluster] && !pointed_at[cluster] {
+			report_chain(cluster)
+		}
+	}
+
+	// Whatever is left is made up of chains that loop back on themselves.
+	for cluster := uint32(2); cluster < c.max_clusters; cluster++ {
+		if lost[cluster] {
+			report_chain(cluster)
+		}
+	}
+}
+
+/*
+Check the FSInfo, if the volume has one, agrees with the FAT.
+*/
+func (c *checker[T]) checkFSInfo() {
+	fsinfo := c.vol.GetFSInfo()
+	if fsinfo == nil {
+		return
+	}
+
+	if fsinfo.free_count != unknown_fsinfo_value && fsinfo.free_count != c.report.FreeClusters {
+		c.report.add(&Problem{
+			Kind:    PROBLEM_FSINFO_FREE_COUNT,
+			Count:   c.report.FreeClusters,
+			Message: fmt.Sprintf("FSInfo free count is %d but %d clusters are free", fsinfo.free_count, c.report.FreeClusters),
+		})
+	}
+
+	// The next free cluster is only a hint of where to start looking, so it
+	// may well point at a cluster in use, as long as it's on the volume.
+	next_free := fsinfo.next_free
+	if next_free != unknown_fsinfo_value && !c.validCluster(next_free) {
+		c.report.add(&Problem{
+			Kind:    PROBLEM_FSINFO_NEXT_FREE,
+			Cluster: next_free,
+			Message: fmt.Sprintf("FSInfo next free cluster %d isn't on the volume", next_free),
+		})
+	}
+}
+
+/*
+Check each copy of the FAT on the volume matches the FAT.
+*/
+func (c *checker[T]) checkFATCopies() error {
+	disk_ref := c.vol.GetDiskRef()
+	for n := 1; n < int(c.vol.GetCommonBPB().BPB_numfats); n++ {
+		var differences uint32
+		fat_short := c.vol.GetFATShort()
+		if fat_short != nil {
+			copy_fat := &FAT[uint16]{table: make([]uint16, c.max_clusters), packed: fat_short.packed}
+			if err := copy_fat.ReadFAT(disk_ref, LookupFATBytes(c.vol, n), c.max_clusters); err != nil {
+				return fmt.Errorf("failed to read FAT copy %d: %w", n, err)
+			}
+			differences = countDifferences(fat_short.table[:c.max_clusters], copy_fat.table)
+		} else {
+			fat_int := c.vol.GetFATInt()
+			copy_fat := MakeFAT32(c.max_clusters)
+			if err := copy_fat.ReadFAT(disk_ref, LookupFATBytes(c.vol, n), c.max_clusters); err != nil {
+				return fmt.Errorf("failed to read FAT copy %d: %w", n, err)
+			}
+			differences = countDifferences(fat_int.table[:c.max_clusters], copy_fat.table)
+		}
+
+		if differences > 0 {
+			c.report.add(&Problem{
+				Kind:    PROBLEM_FAT_MISMATCH,
+				Count:   differences,
+				Message: fmt.Sprintf("FAT copy %d differs from the FAT in %d entries", n, differences),
+			})
+		}
+	}
+
+	return nil
+}
+
+func countDifferences[F FATSize](a []F, b []F) uint32 {
+	var differences uint32
+	for i := range a {
+		if a[i] != b[i] {
+			differences++
+		}
+	}
+
+	return differences
+}
+
+/*
+Get the FAT entry for the cluster, ignoring the reserved high bits of a FAT32 entry.
+*/
+func (c *checker[T]) entry(cluster uint32) uint32 {
+	fat_short := c.vol.GetFATShort()
+	if fat_short != nil {
+		return uint32(fat_short.GetCluster(uint(cluster)))
+	}
+
+	return c.vol.GetFATInt().GetCluster(uint(cluster)) & 0x0FFFFFFF
+}
+
+func (c *checker[T]) isEOC(value uint32) bool {
+	fat_short := c.vol.GetFATShort()
+	if fat_short != nil {
+		return fat_short.IsEOC(uint16(value))
+	}
+
+	return c.vol.GetFATInt().IsEOC(value)
+}
+
+/*
+Is the FAT entry the marker for a bad cluster?
+*/
+func (c *checker[T]) isBad(value uint32) bool {
+	fat_short := c.vol.GetFATShort()
+	if fat_short != nil {
+		if fat_short.packed {
+			return value == 0x0FF7
+		}
+		return value == 0xFFF7
+	}
+
+	return value == 0x0FFFFFF7
+}
+
+func (c *checker[T]) validCluster(cluster uint32) bool {
+	return cluster >= 2 && cluster < c.max_clusters
+}
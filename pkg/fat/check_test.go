@@ -0,0 +1,25 @@
+package fat
+
+import "testing"
+
+func TestCheckFSInfoNextFree(t *testing.T) {
+	vol := newFixtureFAT32(t)
+	fsinfo := vol.GetFSInfo()
+
+	// Any cluster on the volume is fine as a hint, even one in use.
+	for _, next_free := range []uint32{unknown_fsinfo_value, 2, vol.GetExtendedBPBFull().BPB_rootclus} {
+		fsinfo.next_free = next_free
+		assertClean(t, vol)
+	}
+
+	for _, next_free := range []uint32{0, 1, 0x0FFFFFFF} {
+		fsinfo.next_free = next_free
+		report, err := vol.Check()
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if problems := report.ProblemsOfKind(PROBLEM_FSINFO_NEXT_FREE); len(problems) != 1 {
+			t.Errorf("next free cluster %d gave %d problems, not 1", next_free, len(problems))
+		}
+	}
+}
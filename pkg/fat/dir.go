@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"slices"
 	"strings"
 	"time"
@@ -19,6 +18,17 @@ const DIR_ATTR_VOLUME_ID uint8 = 0x08
 const DIR_ATTR_DIRECTORY uint8 = 0x10
 const DIR_ATTR_ARCHIVE uint8 = 0x20
 
+const free_entry uint8 = 0x00
+const deleted_entry uint8 = 0xE5
+
+// Flags in DIR_ntres marking the primary part or extension of a short name
+// as lowercase.
+const ntres_lower_base uint8 = 0x08
+const ntres_lower_ext uint8 = 0x10
+
+// A directory may hold at most 65536 32 byte entries.
+const max_dir_entries int = 65536
+
 type DIR struct {
 	DIR_name           []uint8
 	DIR_attr           uint8
@@ -35,7 +45,7 @@ type DIR struct {
 }
 
 /*
-Does the rune c satisfy what FAT32 considers a valid character in a file name?
+Does the rune c satisfy what FAT32 considers a valid character in a short name?
 */
 func validCharacter(c rune) bool {
 	var forbidden_characters []rune = []rune{
@@ -56,38 +66,206 @@ func validCharacter(c rune) bool {
 }
 
 /*
-Create the truncated DOS-style name for a given file.
+Does the rune c satisfy what FAT32 considers a valid character in a long name?
+Long names additionally allow '.', '+', ',', ';', '=', '[' and ']'.
+*/
+func validLongCharacter(c rune) bool {
+	var forbidden_characters []rune = []rune{
+		0x22, 0x2A, 0x2F, 0x3A, 0x3C, 0x3E, 0x3F,
+		0x5C, 0x7C,
+	}
+
+	if c < 0x20 {
+		return false
+	}
+
+	if slices.Index(forbidden_characters, c) != -1 {
+		return false
+	}
+
+	return true
+}
+
+/*
+Check a long name can be used for a new file. Windows ignores leading and
+trailing spaces and trailing periods, and so can't open a file whose name has
+them, and treats a name starting with ".." as a path.
+*/
+func validLongName(name string) error {
+	if strings.Trim(name, ". ") == "" {
+		return errors.New("name has no characters besides periods and spaces")
+	}
+	if strings.HasPrefix(name, " ") || strings.HasSuffix(name, " ") || strings.HasSuffix(name, ".") || strings.HasPrefix(name, "..") {
+		return errors.New("name starts with a space or '..', or ends with a space or period")
+	}
+	for _, c := range name {
+		if !validLongCharacter(c) {
+			return errors.New("name contains invalid characters")
+		}
+	}
+
+	return nil
+}
+
+/*
+Create the DOS-style name for a given file. System names such as '.' and '..'
+are copied as is, anything else gets the basis name from CreateBasisName.
 */
 func CreateDIRName(name string, system bool) ([]uint8, error) {
+	if !system {
+		dir_format_name, _, err := CreateBasisName(name)
+		return dir_format_name, err
+	}
+
+	dir_format_name := make([]uint8, 11)
+	for i := 0; i < len(dir_format_name); i++ {
+		dir_format_name[i] = 0x20
+	}
+	for i := 0; i < len(name) && i < len(dir_format_name); i++ {
+		dir_format_name[i] = name[i]
+	}
+
+	return dir_format_name, nil
+}
+
+/*
+Create the basis name for a long name, following the Microsoft basis-name
+generation algorithm. The name is uppercased, spaces and leading periods are
+stripped, and characters that can't appear in a short name are replaced with
+'_'. The primary part is taken from the start of the name up to the first
+period, the extension from after the last period, and they're placed in bytes
+0-7 and 8-10 respectively.
+
+The returned flag is set when the long name can't be represented by the basis
+name alone, in which case a numeric tail must be added to it.
+*/
+func CreateBasisName(name string) ([]uint8, bool, error) {
+	if name == "" {
+		return nil, false, errors.New("name is empty")
+	}
+	for _, c := range name {
+		if !validLongCharacter(c) {
+			return nil, false, errors.New("name contains invalid characters")
+		}
+	}
+
+	lossy := false
 	uppercase_name := strings.ToUpper(name)
-	uppercase_name = strings.ReplaceAll(uppercase_name, " ", "")
-	if len(uppercase_name) > 11 {
-		uppercase_name = uppercase_name[:11]
+
+	// Strip all spaces and any leading periods.
+	stripped_name := strings.ReplaceAll(uppercase_name, " ", "")
+	stripped_name = strings.TrimLeft(stripped_name, ".")
+	if stripped_name != uppercase_name {
+		lossy = true
+	}
+	if strings.Trim(stripped_name, ".") == "" {
+		return nil, false, errors.New("name has no valid short name")
+	}
+
+	primary := stripped_name
+	extension := ""
+	if i := strings.LastIndexByte(stripped_name, '.'); i >= 0 {
+		primary = stripped_name[:i]
+		extension = stripped_name[i+1:]
+	}
+	if i := strings.IndexByte(primary, '.'); i >= 0 {
+		primary = primary[:i]
+		lossy = true
 	}
 
 	dir_format_name := make([]uint8, 11)
 	for i := 0; i < len(dir_format_name); i++ {
 		dir_format_name[i] = 0x20
 	}
-	for i, s := range uppercase_name {
-		if system {
-			dir_format_name[i] = uint8(s)
-		} else {
-			if validCharacter(s) {
-				dir_format_name[i] = uint8(s)
+
+	copyPart := func(part string, offset int, length int) {
+		count := 0
+		for _, c := range part {
+			if count == length {
+				lossy = true
+				return
+			}
+
+			if c > 0x7F || !validCharacter(c) {
+				dir_format_name[offset+count] = '_'
+				lossy = true
 			} else {
-				return nil, errors.New("name contains invalid characters")
+				dir_format_name[offset+count] = uint8(c)
 			}
+			count++
 		}
 	}
+	copyPart(primary, 0, 8)
+	copyPart(extension, 8, 3)
 
-	return dir_format_name, nil
+	return dir_format_name, lossy, nil
 }
 
 /*
-Read a single DIR entry from the volume.
+Add the numeric tail n to a basis name, e.g. "REPORT  TXT" becomes "REPORT~1TXT",
+truncating the primary part to make room for the tail.
 */
-func ReadDIR(fs *os.File) (*DIR, error) {
+func addNumericTail(basis []uint8, n int) []uint8 {
+	tail := fmt.Sprintf("~%d", n)
+
+	primary_length := 0
+	for primary_length < 8 && basis[primary_length] != 0x20 {
+		primary_length++
+	}
+	if primary_length > 8-len(tail) {
+		primary_length = 8 - len(tail)
+	}
+
+	dir_format_name := make([]uint8, 11)
+	for i := 0; i < len(dir_format_name); i++ {
+		dir_format_name[i] = 0x20
+	}
+	copy(dir_format_name, basis[:primary_length])
+	copy(dir_format_name[primary_length:], tail)
+	copy(dir_format_name[8:], basis[8:11])
+
+	return dir_format_name
+}
+
+/*
+Get the displayable 8.3 name of a DIR entry, e.g. "README.TXT". The lowercase
+flags in DIR_ntres are honoured, as written by Windows NT and Linux.
+*/
+func ShortName(d *DIR) string {
+	var primary []rune
+	var extension []rune
+	for i, c := range d.DIR_name {
+		if i == 0 && c == 0x05 {
+			c = deleted_entry
+		}
+
+		if i < 8 {
+			primary = append(primary, rune(c))
+		} else {
+			extension = append(extension, rune(c))
+		}
+	}
+
+	primary_name := strings.TrimRight(string(primary), " ")
+	extension_name := strings.TrimRight(string(extension), " ")
+	if (d.DIR_ntres & ntres_lower_base) == ntres_lower_base {
+		primary_name = strings.ToLower(primary_name)
+	}
+	if (d.DIR_ntres & ntres_lower_ext) == ntres_lower_ext {
+		extension_name = strings.ToLower(extension_name)
+	}
+
+	if extension_name == "" {
+		return primary_name
+	}
+	return primary_name + "." + extension_name
+}
+
+/*
+Read the DIR entry at the location loc on disk.
+*/
+func ReadDIR(dev BlockDevice, loc uint32) (*DIR, error) {
+	fs := io.NewSectionReader(dev, int64(loc), 32)
 	var byte_ []uint8 = make([]uint8, 1)
 	var short_ []uint8 = make([]uint8, 2)
 	var int_ []uint8 = make([]uint8, 4)
@@ -106,10 +284,35 @@ func ReadDIR(fs *os.File) (*DIR, error) {
 	}
 	dir_entry.DIR_attr = byte_[0]
 
-	_, err = fs.Seek(8, io.SeekCurrent)
+	_, err = fs.Read(byte_)
+	if err != nil {
+		return nil, err
+	}
+	dir_entry.DIR_ntres = byte_[0]
+
+	_, err = fs.Read(byte_)
+	if err != nil {
+		return nil, err
+	}
+	dir_entry.DIR_crt_time_tenth = byte_[0]
+
+	_, err = fs.Read(short_)
+	if err != nil {
+		return nil, err
+	}
+	dir_entry.DIR_crt_time = utilities.BytesToShort(short_)
+
+	_, err = fs.Read(short_)
+	if err != nil {
+		return nil, err
+	}
+	dir_entry.DIR_crt_date = utilities.BytesToShort(short_)
+
+	_, err = fs.Read(short_)
 	if err != nil {
 		return nil, err
 	}
+	dir_entry.DIR_lst_acc_date = utilities.BytesToShort(short_)
 
 	_, err = fs.Read(short_)
 	if err != nil {
@@ -117,10 +320,17 @@ func ReadDIR(fs *os.File) (*DIR, error) {
 	}
 	dir_entry.DIR_cluster_hi = utilities.BytesToShort(short_)
 
-	_, err = fs.Seek(4, io.SeekCurrent)
+	_, err = fs.Read(short_)
+	if err != nil {
+		return nil, err
+	}
+	dir_entry.DIR_wrt_time = utilities.BytesToShort(short_)
+
+	_, err = fs.Read(short_)
 	if err != nil {
 		return nil, err
 	}
+	dir_entry.DIR_wrt_date = utilities.BytesToShort(short_)
 
 	_, err = fs.Read(short_)
 	if err != nil {
@@ -149,7 +359,7 @@ func CreateWriteTime() (uint16, uint16) {
 	month := int(current_time.Month())
 	year := utilities.YearToFATYear(current_time.Year())
 
-	var write_time uint16 = uint16((hours << 9) | (minutes << 5) | seconds)
+	var write_time uint16 = uint16((hours << 11) | (minutes << 5) | seconds)
 	var write_date uint16 = uint16((year << 9) | (month << 5) | day)
 
 	return write_time, write_date
@@ -182,54 +392,43 @@ func CreateSystemDIR(name string) (*DIR, error) {
 /*
 Write out a DIR entry dir to the location loc on disk.
 */
-func WriteDIR(fs *os.File, dir *DIR, loc uint32) (uint32, error) {
-	if _, err := fs.Seek(int64(loc), io.SeekStart); err != nil {
+func WriteDIR(dev BlockDevice, dir *DIR, loc uint32) (uint32, error) {
+	slot := make([]byte, 32)
+	dir.encode(slot)
+	if _, err := dev.WriteAt(slot, int64(loc)); err != nil {
 		return 0, err
 	}
 
-	if _, err := fs.Write(dir.DIR_name); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write([]uint8{dir.DIR_attr}); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write([]uint8{dir.DIR_ntres}); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write([]uint8{dir.DIR_crt_time_tenth}); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_crt_time)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_crt_date)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_lst_acc_date)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_cluster_hi)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_wrt_time)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_wrt_date)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.ShortToBytes(dir.DIR_cluster_lo)); err != nil {
-		return 0, err
-	}
-	if _, err := fs.Write(utilities.IntToBytes(dir.DIR_filesize)); err != nil {
-		return 0, err
-	}
+	return loc + 32, nil
+}
 
-	end_loc, err := fs.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, err
+/*
+Encode a DIR entry into a 32 byte directory slot.
+*/
+func (dir *DIR) encode(slot []byte) {
+	copy(slot[0:11], dir.DIR_name)
+	slot[11] = dir.DIR_attr
+	slot[12] = dir.DIR_ntres
+	slot[13] = dir.DIR_crt_time_tenth
+	copy(slot[14:16], utilities.ShortToBytes(dir.DIR_crt_time))
+	copy(slot[16:18], utilities.ShortToBytes(dir.DIR_crt_date))
+	copy(slot[18:20], utilities.ShortToBytes(dir.DIR_lst_acc_date))
+	copy(slot[20:22], utilities.ShortToBytes(dir.DIR_cluster_hi))
+	copy(slot[22:24], utilities.ShortToBytes(dir.DIR_wrt_time))
+	copy(slot[24:26], utilities.ShortToBytes(dir.DIR_wrt_date))
+	copy(slot[26:28], utilities.ShortToBytes(dir.DIR_cluster_lo))
+	copy(slot[28:32], utilities.IntToBytes(dir.DIR_filesize))
+}
+
+/*
+Mark the DIR or LDIR entry at the location loc on disk as deleted.
+*/
+func MarkDIRDeleted(dev BlockDevice, loc uint32) error {
+	if _, err := dev.WriteAt([]uint8{deleted_entry}, int64(loc)); err != nil {
+		return err
 	}
 
-	return uint32(end_loc), nil
+	return nil
 }
 
 func IsDirectory(d *DIR) bool {
@@ -237,31 +436,129 @@ func IsDirectory(d *DIR) bool {
 }
 
 /*
-Get the location for the next free DIR entry in a cluster.
+Is the DIR entry the volume label rather than a file?
+*/
+func IsVolumeLabel(d *DIR) bool {
+	return (d.DIR_attr & long_entry) == DIR_ATTR_VOLUME_ID
+}
+
+/*
+Is the DIR entry one of the '.' or '..' entries of a directory?
+*/
+func IsSystemDIR(d *DIR) bool {
+	return d.DIR_name[0] == '.'
+}
+
+/*
+Convert the write date and time of a DIR entry into a time.Time.
+*/
+func ModTime(d *DIR) time.Time {
+	if d.DIR_wrt_date == 0 {
+		return time.Time{}
+	}
+
+	year := utilities.FATYearToYear(int(d.DIR_wrt_date >> 9))
+	month := time.Month((d.DIR_wrt_date >> 5) & 0x0F)
+	day := int(d.DIR_wrt_date & 0x1F)
+	hours := int(d.DIR_wrt_time >> 11)
+	minutes := int((d.DIR_wrt_time >> 5) & 0x3F)
+	seconds := int(d.DIR_wrt_time&0x1F) * 2
+
+	return time.Date(year, month, day, hours, minutes, seconds, 0, time.UTC)
+}
+
+/*
+Get the location for the next free DIR entry in the directory starting at the
+given cluster, growing the directory if it is full.
 */
 func GetNextFreeDIR[T FATSystem](fs T, cluster uint32) (int64, error) {
-	disk_ref := fs.GetDiskRef()
-	current_location, err := disk_ref.Seek(0, io.SeekCurrent)
+	slots, err := GetFreeDIRSlots(fs, cluster, 1)
 	if err != nil {
 		return -1, err
 	}
 
-	cluster_boundary := LookupClusterBytes(fs, (cluster + 1))
-	for current_location < int64(cluster_boundary) {
-		dir, err := ReadDIR(disk_ref)
+	return slots[0], nil
+}
+
+/*
+Get the locations of count consecutive free slots in the directory starting at
+the given cluster, following the directory's cluster chain. A run of deleted
+slots is reused when it's long enough, otherwise the slots come from after the
+end of directory marker, growing the directory by a cluster at a time whenever
+its chain runs out.
+*/
+func GetFreeDIRSlots[T FATSystem](fs T, cluster uint32, count int) ([]int64, error) {
+	disk_ref := fs.GetDiskRef()
+
+	var slots []int64
+	past_end := false
+	reader := NewDirReader(fs, cluster)
+	for index := 0; len(slots) < count; index++ {
+		if index >= max_dir_entries {
+			return nil, errors.New("directory is full")
+		}
+
+		current_location, err := reader.nextSlot()
+		if err == io.EOF {
+			if err := reader.grow(); err != nil {
+				return nil, fmt.Errorf("failed to grow directory: %w", err)
+			}
+			current_location, err = reader.nextSlot()
+		}
 		if err != nil {
-			return -1, nil
+			return nil, err
 		}
 
-		if dir.DIR_name[0] == 0x00 {
-			return current_location, nil
+		// Everything after the end of directory marker is free, so only
+		// look at slots until we've found it.
+		if !past_end {
+			dir, err := ReadDIR(disk_ref, uint32(current_location))
+			if err != nil {
+				return nil, err
+			}
+
+			switch dir.DIR_name[0] {
+			case free_entry:
+				past_end = true
+			case deleted_entry:
+			default:
+				// A live entry breaks up the run of free slots.
+				slots = slots[:0]
+				continue
+			}
 		}
 
-		current_location, err = disk_ref.Seek(0, io.SeekCurrent)
+		slots = append(slots, current_location)
+	}
+
+	return slots, nil
+}
+
+/*
+Pick a short name for a new entry in the directory starting at the given
+cluster. The basis name is used as is when the long name didn't need a numeric
+tail and nothing else in the directory has it, otherwise the first free "~n"
+tail is added, e.g. "REPORT~1TXT", "REPORT~2TXT" and so on.
+*/
+func UniqueShortName[T FATSystem](fs T, cluster uint32, basis []uint8, lossy bool) ([]uint8, error) {
+	existing_names := make(map[string]bool)
+	for file, err := range dirEntries(fs, cluster, true) {
 		if err != nil {
-			return -1, err
+			return nil, err
+		}
+		existing_names[string(file.FSSpecificData.DIREntry.DIR_name)] = true
+	}
+
+	if !lossy && !existing_names[string(basis)] {
+		return basis, nil
+	}
+
+	for n := 1; n <= 999999; n++ {
+		dir_format_name := addNumericTail(basis, n)
+		if !existing_names[string(dir_format_name)] {
+			return dir_format_name, nil
 		}
 	}
 
-	return -1, errors.New("no free space in cluster")
+	return nil, errors.New("no unique short name available")
 }
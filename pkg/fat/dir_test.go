@@ -0,0 +1,340 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+/*
+Format a volume in memory over a device full of junk, as a reused disk would
+be, so anything read from a cluster that was never written shows up.
+*/
+func newJunkVolume(t *testing.T, fat_type FATType) *MemVolume {
+	t.Helper()
+
+	size := test_image_sizes[fat_type]
+	dev := NewMemDevice(bytes.Repeat([]byte{0xAA}, int(size)))
+	if _, err := Format(dev, size, &FormatOptions{Type: fat_type}); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	vol, err := openMemVolume(dev)
+	if err != nil {
+		t.Fatalf("openMemVolume: %v", err)
+	}
+
+	return vol
+}
+
+/*
+Collect the chain starting at the given cluster, along with the bytes per cluster.
+*/
+func collectClusters[T FATSystem](vol T, start uint32) (uint32, []uint32) {
+	var chain []uint32
+	for _, cluster := range ClusterChain(vol, start) {
+		chain = append(chain, cluster)
+	}
+
+	return ClusterSize(vol), chain
+}
+
+/*
+Get the bytes per cluster of a volume of any FAT type, and the cluster chain
+starting at the given cluster.
+*/
+func volumeChain(t *testing.T, vol Volume, start uint32) (uint32, []uint32) {
+	t.Helper()
+
+	switch v := vol.(type) {
+	case *MemVolume:
+		return volumeChain(t, v.Volume, start)
+	case *FAT12:
+		return collectClusters(v, start)
+	case *FAT16:
+		return collectClusters(v, start)
+	case *FAT32:
+		return collectClusters(v, start)
+	}
+
+	t.Fatalf("volume is %T", vol)
+	return 0, nil
+}
+
+func TestDirectoryGrowsWhenFull(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			vol := newJunkVolume(t, fat_type)
+			dir, err := vol.CreateDir("/grow")
+			if err != nil {
+				t.Fatalf("CreateDir: %v", err)
+			}
+
+			// Each name takes 3 slots, which doesn't divide a cluster evenly, so
+			// some runs of LDIR and DIR entries cross from one cluster to the next.
+			cluster_size, _ := volumeChain(t, vol, firstCluster(dir))
+			var names []string
+			for i := 0; i < int(cluster_size)/32; i++ {
+				name := fmt.Sprintf("Entry number %03d", i)
+				if _, err := vol.CreateFile("/grow/"+name, []byte(name)); err != nil {
+					t.Fatalf("CreateFile(%q): %v", name, err)
+				}
+				names = append(names, name)
+			}
+
+			if _, chain := volumeChain(t, vol, firstCluster(dir)); len(chain) < 3 {
+				t.Errorf("directory of %d entries spans %d clusters", len(names), len(chain))
+			}
+
+			// Junk in a new cluster would show up as extra entries.
+			listed, err := vol.ReadDir("/grow")
+			if err != nil {
+				t.Fatalf("ReadDir: %v", err)
+			}
+			if !slices.Equal(entryNames(listed), names) {
+				t.Errorf("grown directory lists %q", entryNames(listed))
+			}
+			for _, name := range names {
+				file, err := vol.ReadFile("/grow/" + name)
+				if err != nil {
+					t.Fatalf("ReadFile(%q): %v", name, err)
+				}
+				if _, err := vol.ReadAll(file); err != nil || string(file.Content) != name {
+					t.Errorf("%s holds %q, %v", name, file.Content, err)
+				}
+			}
+			assertClean(t, vol)
+		})
+	}
+}
+
+func TestDeletedSlotsAreReused(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			vol := newFixture(t, fat_type)
+
+			// Names of the same length take the same number of slots.
+			removed, err := vol.CreateFile("/docs/A long name number one.txt", nil)
+			if err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+			if _, err := vol.CreateFile("/docs/after.txt", []byte("after")); err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+			if err := vol.Remove("/docs/A long name number one.txt"); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+
+			// A name needing more slots than were freed goes elsewhere.
+			bigger, err := vol.CreateFile("/docs/A much longer name that needs more slots than that.txt", nil)
+			if err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+			if bigger.FSSpecificData.LDIR_loc == removed.FSSpecificData.LDIR_loc {
+				t.Errorf("a longer entry went into a shorter gap")
+			}
+
+			reused, err := vol.CreateFile("/docs/A long name number two.txt", nil)
+			if err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+			if reused.FSSpecificData.LDIR_loc != removed.FSSpecificData.LDIR_loc ||
+				reused.FSSpecificData.DIR_loc != removed.FSSpecificData.DIR_loc {
+				t.Errorf("new entry went at %#x-%#x, not into the gap at %#x-%#x",
+					reused.FSSpecificData.LDIR_loc, reused.FSSpecificData.DIR_loc,
+					removed.FSSpecificData.LDIR_loc, removed.FSSpecificData.DIR_loc)
+			}
+
+			file, err := vol.ReadFile("/docs/after.txt")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if _, err := vol.ReadAll(file); err != nil || string(file.Content) != "after" {
+				t.Errorf("after.txt holds %q, %v", file.Content, err)
+			}
+			assertClean(t, vol)
+		})
+	}
+}
+
+func TestCompactDirReleasesClusters(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			vol := newFixture(t, fat_type)
+			dir, err := vol.CreateDir("/packed")
+			if err != nil {
+				t.Fatalf("CreateDir: %v", err)
+			}
+
+			cluster_size, _ := volumeChain(t, vol, firstCluster(dir))
+			var kept []string
+			for i := 0; i < int(cluster_size)/32; i++ {
+				name := fmt.Sprintf("Entry number %03d", i)
+				if _, err := vol.CreateFile("/packed/"+name, []byte(name)); err != nil {
+					t.Fatalf("CreateFile(%q): %v", name, err)
+				}
+				if i%5 == 0 {
+					kept = append(kept, name)
+				}
+			}
+			for i := 0; i < int(cluster_size)/32; i++ {
+				if i%5 != 0 {
+					if err := vol.Remove(fmt.Sprintf("/packed/Entry number %03d", i)); err != nil {
+						t.Fatalf("Remove: %v", err)
+					}
+				}
+			}
+
+			_, before := volumeChain(t, vol, firstCluster(dir))
+			report, err := vol.Check()
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			free_before := report.FreeClusters
+
+			if err := vol.CompactDir("/packed"); err != nil {
+				t.Fatalf("CompactDir: %v", err)
+			}
+
+			// Two dots and the kept entries fit in a single cluster.
+			_, after := volumeChain(t, vol, firstCluster(dir))
+			if len(after) != 1 || after[0] != before[0] {
+				t.Errorf("directory chain went from %v to %v", before, after)
+			}
+			report, err = vol.Check()
+			if err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			if freed := int(report.FreeClusters) - int(free_before); freed != len(before)-1 {
+				t.Errorf("CompactDir freed %d clusters, not %d", freed, len(before)-1)
+			}
+
+			listed, err := vol.ReadDir("/packed")
+			if err != nil {
+				t.Fatalf("ReadDir: %v", err)
+			}
+			if !slices.Equal(entryNames(listed), kept) {
+				t.Errorf("compacted directory lists %q", entryNames(listed))
+			}
+			for _, name := range kept {
+				file, err := vol.ReadFile("/packed/" + name)
+				if err != nil {
+					t.Fatalf("ReadFile(%q): %v", name, err)
+				}
+				if _, err := vol.ReadAll(file); err != nil || string(file.Content) != name {
+					t.Errorf("%s holds %q, %v", name, file.Content, err)
+				}
+			}
+			assertDotDot(t, vol, "/packed", "/")
+			assertClean(t, vol)
+
+			// The root directory compacts in place too.
+			if err := vol.CompactDir("/"); err != nil {
+				t.Errorf("CompactDir of the root directory: %v", err)
+			}
+			assertClean(t, vol)
+		})
+	}
+}
+
+func TestCreateBasisName(t *testing.T) {
+	tests := []struct {
+		name  string
+		basis string
+		lossy bool
+	}{
+		{"README.TXT", "README  TXT", false},
+		{"readme.txt", "README  TXT", false},
+		{"Report.final.txt", "REPORT  TXT", true},
+		{"verylongname.text", "VERYLONGTEX", true},
+		{"a+b.txt", "A_B     TXT", true},
+		{" a b.c", "AB      C  ", true},
+		{".hidden", "HIDDEN     ", true},
+		{"Ünïcode.txt", "_N_CODE TXT", true},
+	}
+	for _, test := range tests {
+		basis, lossy, err := CreateBasisName(test.name)
+		if err != nil {
+			t.Errorf("CreateBasisName(%q): %v", test.name, err)
+			continue
+		}
+		if string(basis) != test.basis || lossy != test.lossy {
+			t.Errorf("CreateBasisName(%q) is %q, %v, not %q, %v", test.name, basis, lossy, test.basis, test.lossy)
+		}
+	}
+
+	for _, name := range []string{"", "...", "a*b"} {
+		if _, _, err := CreateBasisName(name); err == nil {
+			t.Errorf("CreateBasisName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestAddNumericTail(t *testing.T) {
+	tests := []struct {
+		basis string
+		n     int
+		want  string
+	}{
+		{"REPORT  TXT", 1, "REPORT~1TXT"},
+		{"VERYLONGTEX", 1, "VERYLO~1TEX"},
+		{"VERYLONGTEX", 12, "VERYL~12TEX"},
+		{"AB      C  ", 999999, "A~999999C  "},
+	}
+	for _, test := range tests {
+		if tailed := addNumericTail([]uint8(test.basis), test.n); string(tailed) != test.want {
+			t.Errorf("addNumericTail(%q, %d) is %q, not %q", test.basis, test.n, tailed, test.want)
+		}
+	}
+}
+
+func TestShortNamesGetNumericTails(t *testing.T) {
+	vol := newFixture(t, FAT_TYPE_16)
+
+	tests := []struct {
+		name       string
+		short_name string
+	}{
+		{"/docs/Report.final.txt", "REPORT~1.TXT"},
+		{"/docs/Report.final2.txt", "REPORT~2.TXT"},
+		{"/docs/report.txt", "REPORT.TXT"},
+		{"/docs/REPORT.DOC", "REPORT.DOC"},
+		{"/docs/Report.doc.old", "REPORT~1.OLD"},
+	}
+	for _, test := range tests {
+		file, err := vol.CreateFile(test.name, []byte(test.name))
+		if err != nil {
+			t.Fatalf("CreateFile(%q): %v", test.name, err)
+		}
+		if short_name := ShortName(file.FSSpecificData.DIREntry); short_name != test.short_name {
+			t.Errorf("%s has short name %q, not %q", test.name, short_name, test.short_name)
+		}
+	}
+
+	// A valid 8.3 name needs no LDIR entries.
+	file, err := vol.ReadFile("/docs/REPORT.DOC")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if count := len(file.FSSpecificData.LDIREntry); count != 0 {
+		t.Errorf("REPORT.DOC has %d LDIR entries", count)
+	}
+
+	// Files can be found by their short names, and a freed tail is handed out
+	// again.
+	file, err = vol.ReadFile("/docs/REPORT~2.TXT")
+	if err != nil || file.Name != "Report.final2.txt" {
+		t.Fatalf("ReadFile by short name found %v, %v", file, err)
+	}
+	if err := vol.Remove("/docs/Report.final.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	file, err = vol.CreateFile("/docs/Report.final3.txt", nil)
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if short_name := ShortName(file.FSSpecificData.DIREntry); short_name != "REPORT~1.TXT" {
+		t.Errorf("Report.final3.txt has short name %q, not REPORT~1.TXT", short_name)
+	}
+	assertClean(t, vol)
+}
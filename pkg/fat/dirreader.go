@@ -0,0 +1,123 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+DirReader reads the entries of a directory one at a time, following the
+directory's cluster chain until the end of directory marker. The fixed root
+directory of a FAT12 or FAT16 volume has no chain, and ends with its region.
+*/
+type DirReader[T FATSystem] struct {
+	fs       T
+	cluster  uint32
+	loc      int64
+	boundary int64
+	fixed    bool
+	done     bool
+}
+
+/*
+Create a DirReader for the directory starting at the given cluster.
+*/
+func NewDirReader[T FATSystem](fs T, cluster uint32) *DirReader[T] {
+	loc := int64(LookupClusterBytes(fs, cluster))
+	fixed := cluster == 0 && fs.GetExtendedBPBFull() == nil
+
+	size := int64(ClusterSize(fs))
+	if fixed {
+		size = int64(fs.GetCommonBPB().BPB_rootentcnt) * 32
+	}
+
+	return &DirReader[T]{
+		fs:       fs,
+		cluster:  cluster,
+		loc:      loc,
+		boundary: loc + size,
+		fixed:    fixed,
+	}
+}
+
+/*
+Read the next entry in the directory, including deleted entries, the volume
+label and the '.' and '..' entries. Returns io.EOF once the end of the
+directory is reached.
+*/
+func (r *DirReader[T]) Next() (*FATFile, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	file, err := readEntry(r.fs, r.nextSlot)
+	if err != nil {
+		if err == io.EOF {
+			r.done = true
+		}
+		return nil, err
+	}
+
+	if file.FSSpecificData.DIREntry.DIR_name[0] == free_entry {
+		r.done = true
+		return nil, io.EOF
+	}
+
+	return file, nil
+}
+
+/*
+Get the location of the next 32 byte slot in the directory, moving on to the
+next cluster in the chain when the current one is used up.
+*/
+func (r *DirReader[T]) nextSlot() (int64, error) {
+	if r.loc >= r.boundary {
+		if r.fixed {
+			return 0, io.EOF
+		}
+
+		next_cluster, end := NextCluster(r.fs, r.cluster)
+		if end {
+			return 0, io.EOF
+		}
+
+		r.cluster = next_cluster
+		r.loc = int64(LookupClusterBytes(r.fs, next_cluster))
+		r.boundary = r.loc + int64(ClusterSize(r.fs))
+	}
+
+	loc := r.loc
+	r.loc += 32
+
+	return loc, nil
+}
+
+/*
+Extend the directory by a freshly zeroed cluster on the end of its chain, once
+every slot of the current last cluster has been handed out.
+*/
+func (r *DirReader[T]) grow() error {
+	if r.fixed {
+		return errors.New("root directory is full")
+	}
+
+	cluster, err := AllocateCluster(r.fs, r.cluster+1)
+	if err != nil {
+		return err
+	}
+
+	cluster_loc := LookupClusterBytes(r.fs, cluster)
+	if err := ZeroCluster(r.fs, cluster_loc); err != nil {
+		FreeChain(r.fs, cluster)
+		return fmt.Errorf("failed to zero cluster: %w", err)
+	}
+	LinkCluster(r.fs, r.cluster, cluster)
+	UpdateFSInfo(r.fs, 1)
+
+	r.cluster = cluster
+	r.loc = int64(cluster_loc)
+	r.boundary = r.loc + int64(ClusterSize(r.fs))
+
+	return nil
+}
@@ -0,0 +1,323 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	fs "github.com/zni/fslib/pkg/fs/common"
+	"github.com/zni/fslib/pkg/gpt"
+	"github.com/zni/fslib/pkg/mbr"
+)
+
+// Partitions start on 1MiB boundaries unless asked otherwise, as most
+// partitioning tools do.
+const default_partition_alignment int64 = 1024 * 1024
+
+type PartitionScheme int
+
+const (
+	PARTITION_SCHEME_MBR PartitionScheme = iota
+	PARTITION_SCHEME_GPT
+)
+
+func (scheme PartitionScheme) String() string {
+	switch scheme {
+	case PARTITION_SCHEME_MBR:
+		return "MBR"
+	case PARTITION_SCHEME_GPT:
+		return "GPT"
+	}
+
+	return fmt.Sprintf("PartitionScheme(%d)", int(scheme))
+}
+
+/*
+Options describing a partition created by FormatDisk. Any option left at its
+zero value is given a sensible default.
+*/
+type PartitionOptions struct {
+	// Size of the partition in bytes, a multiple of the disk's sector size.
+	// When unset the partition takes up the rest of the disk, which only the
+	// last partition may do.
+	Size int64
+
+	// Options to format the partition with as a FAT volume, or nil to leave
+	// the partition unformatted. The hidden sectors are always set from where
+	// the partition starts.
+	Format *FormatOptions
+
+	// Type of an MBR partition, picked from the FAT type when unset, or Linux
+	// for an unformatted partition.
+	MBRType uint8
+
+	// Marks an MBR partition as the one to boot from.
+	Bootable bool
+
+	// Type of a GPT partition, basic data when unset, or Linux filesystem for
+	// an unformatted partition.
+	GPTType gpt.GUID
+
+	// GUID of a GPT partition, generated when unset.
+	GUID gpt.GUID
+
+	// Name of a GPT partition.
+	Name string
+}
+
+/*
+Options describing a disk laid out by FormatDisk.
+*/
+type DiskOptions struct {
+	Scheme     PartitionScheme
+	Partitions []PartitionOptions
+
+	// Bytes each partition's start is aligned to, a multiple of the disk's
+	// sector size. 1MiB when unset.
+	Alignment int64
+
+	// Disk signature of an MBR.
+	DiskSignature uint32
+
+	// GUID of a GPT disk, generated when unset.
+	DiskGUID gpt.GUID
+}
+
+/*
+DiskPartition describes a partition laid out by FormatDisk.
+*/
+type DiskPartition struct {
+	// Number of an MBR partition, or index of a GPT partition, counting from 1.
+	Number int
+	Offset int64
+	Size   int64
+
+	// Geometry of the FAT volume in the partition, or nil when the partition
+	// was left unformatted.
+	Geometry *Geometry
+}
+
+/*
+Lay out a partition table across a whole disk, then format each partition with
+format options as a FAT volume in place, with BPB_hiddsec holding the first
+sector of its partition. The device has to already be the full size of the
+disk. Partitions are laid out in order, each starting at the next aligned
+sector after the last. An MBR is limited to 4 primary partitions.
+*/
+func FormatDisk(dev BlockDevice, opts *DiskOptions) ([]*DiskPartition, error) {
+	name := deviceName(dev)
+	if opts == nil {
+		opts = &DiskOptions{}
+	}
+
+	partitions, err := planPartitions(dev, opts)
+	if err != nil {
+		return nil, &fs.FSError{Op: "FormatDisk", Path: name, Err: err}
+	}
+
+	sector_size := int64(dev.SectorSize())
+	for i, partition := range partitions {
+		format_opts := opts.Partitions[i].Format
+		if format_opts == nil {
+			continue
+		}
+
+		// Work on a copy, so the caller's options are left alone.
+		volume_opts := *format_opts
+		if volume_opts.SectorSize == 0 {
+			volume_opts.SectorSize = uint16(sector_size)
+		}
+		if partition.Offset%int64(volume_opts.SectorSize) != 0 {
+			return nil, &fs.FSError{
+				Op:   "FormatDisk",
+				Path: name,
+				Err:  fmt.Errorf("partition %d isn't aligned to the volume's %d byte sectors", partition.Number, volume_opts.SectorSize),
+			}
+		}
+
+		// BPB_hiddsec can't count the sectors in front of a partition past the
+		// first 2TiB or so of a GPT disk, so it's left at 0 there.
+		volume_opts.HiddenSectors = 0
+		if hidden_sectors := partition.Offset / int64(volume_opts.SectorSize); hidden_sectors <= math.MaxUint32 {
+			volume_opts.HiddenSectors = uint32(hidden_sectors)
+		}
+
+		section, err := NewSectionDevice(dev, partition.Offset, partition.Size)
+		if err != nil {
+			return nil, &fs.FSError{Op: "FormatDisk", Path: name, Err: err}
+		}
+		partition.Geometry, err = Format(section, partition.Size, &volume_opts)
+		if err != nil {
+			return nil, &fs.FSError{
+				Op:   "FormatDisk",
+				Path: name,
+				Err:  fmt.Errorf("failed to format partition %d: %w", partition.Number, err),
+			}
+		}
+	}
+
+	switch opts.Scheme {
+	case PARTITION_SCHEME_MBR:
+		err = writeMBR(dev, opts, partitions)
+	case PARTITION_SCHEME_GPT:
+		err = writeGPT(dev, opts, partitions)
+	}
+	if err != nil {
+		return nil, &fs.FSError{Op: "FormatDisk", Path: name, Err: err}
+	}
+
+	if err := dev.Sync(); err != nil {
+		return nil, &fs.FSError{Op: "FormatDisk", Path: name, Err: err}
+	}
+
+	return partitions, nil
+}
+
+/*
+Work out where each partition goes on the disk.
+*/
+func planPartitions(dev BlockDevice, opts *DiskOptions) ([]*DiskPartition, error) {
+	sector_size := int64(dev.SectorSize())
+
+	alignment := opts.Alignment
+	if alignment == 0 {
+		alignment = default_partition_alignment
+	}
+	if alignment < 0 || alignment%sector_size != 0 {
+		return nil, fmt.Errorf("alignment of %d bytes isn't a multiple of the %d byte sectors", alignment, sector_size)
+	}
+
+	// The first sector holds the MBR, and a GPT needs room at both ends of the
+	// disk for its headers and partition entry arrays.
+	var start, end int64
+	switch opts.Scheme {
+	case PARTITION_SCHEME_MBR:
+		if len(opts.Partitions) > 4 {
+			return nil, fmt.Errorf("an MBR holds at most 4 partitions, not %d", len(opts.Partitions))
+		}
+		start, end = sector_size, dev.Size()/sector_size*sector_size
+	case PARTITION_SCHEME_GPT:
+		first_usable, last_usable := gpt.UsableLBAs(int(sector_size), dev.Size())
+		if first_usable > last_usable {
+			return nil, errors.New("disk too small for a GPT")
+		}
+		start, end = int64(first_usable)*sector_size, int64(last_usable+1)*sector_size
+	default:
+		return nil, fmt.Errorf("invalid partition scheme %v", opts.Scheme)
+	}
+
+	if len(opts.Partitions) == 0 {
+		return nil, errors.New("no partitions")
+	}
+
+	var partitions []*DiskPartition
+	for i, partition_opts := range opts.Partitions {
+		number := i + 1
+		offset := (start + alignment - 1) / alignment * alignment
+
+		size := partition_opts.Size
+		switch {
+		case size == 0 && i != len(opts.Partitions)-1:
+			return nil, fmt.Errorf("only the last partition may take up the rest of the disk")
+		case size == 0:
+			size = end - offset
+		case size < 0 || size%sector_size != 0:
+			return nil, fmt.Errorf("size of partition %d isn't a multiple of the %d byte sectors", number, sector_size)
+		}
+		if size <= 0 || offset+size > end {
+			return nil, fmt.Errorf("partition %d doesn't fit on the disk", number)
+		}
+		if opts.Scheme == PARTITION_SCHEME_MBR && (offset+size)/sector_size > math.MaxUint32 {
+			return nil, fmt.Errorf("partition %d lies past the last sector an MBR can reach", number)
+		}
+
+		partitions = append(partitions, &DiskPartition{Number: number, Offset: offset, Size: size})
+		start = offset + size
+	}
+
+	return partitions, nil
+}
+
+/*
+Write an MBR holding the partitions, picking each partition's type from the FAT
+type it was formatted with when it wasn't given one.
+*/
+func writeMBR(dev BlockDevice, opts *DiskOptions, partitions []*DiskPartition) error {
+	sector_size := int64(dev.SectorSize())
+
+	table := &mbr.Table{DiskSignature: opts.DiskSignature}
+	for i, partition := range partitions {
+		partition_type := opts.Partitions[i].MBRType
+		if partition_type == mbr.TYPE_EMPTY {
+			partition_type = mbr.TYPE_LINUX
+			if partition.Geometry != nil {
+				switch partition.Geometry.Type {
+				case FAT_TYPE_12:
+					partition_type = mbr.TYPE_FAT12
+				case FAT_TYPE_16:
+					partition_type = mbr.TYPE_FAT16_LBA
+				case FAT_TYPE_32:
+					partition_type = mbr.TYPE_FAT32_LBA
+				}
+			}
+		}
+
+		table.Partitions = append(table.Partitions, &mbr.Partition{
+			Number:   partition.Number,
+			Bootable: opts.Partitions[i].Bootable,
+			Type:     partition_type,
+			FirstLBA: uint32(partition.Offset / sector_size),
+			Sectors:  uint32(partition.Size / sector_size),
+		})
+	}
+
+	return mbr.Write(dev, table)
+}
+
+/*
+Write a GPT holding the partitions, generating any GUIDs that weren't given.
+*/
+func writeGPT(dev BlockDevice, opts *DiskOptions, partitions []*DiskPartition) error {
+	sector_size := int64(dev.SectorSize())
+
+	disk_guid := opts.DiskGUID
+	if disk_guid == (gpt.GUID{}) {
+		guid, err := gpt.NewGUID()
+		if err != nil {
+			return err
+		}
+		disk_guid = guid
+	}
+
+	var entries []*gpt.Partition
+	for i, partition := range partitions {
+		partition_opts := opts.Partitions[i]
+
+		partition_type := partition_opts.GPTType
+		if partition_type == gpt.TYPE_UNUSED {
+			partition_type = gpt.TYPE_LINUX_FS
+			if partition.Geometry != nil {
+				partition_type = gpt.TYPE_BASIC_DATA
+			}
+		}
+
+		guid := partition_opts.GUID
+		if guid == (gpt.GUID{}) {
+			var err error
+			if guid, err = gpt.NewGUID(); err != nil {
+				return err
+			}
+		}
+
+		entries = append(entries, &gpt.Partition{
+			Index:    partition.Number,
+			Type:     partition_type,
+			GUID:     guid,
+			FirstLBA: uint64(partition.Offset / sector_size),
+			LastLBA:  uint64((partition.Offset+partition.Size)/sector_size - 1),
+			Name:     partition_opts.Name,
+		})
+	}
+
+	return gpt.Write(dev, int(sector_size), dev.Size(), disk_guid, entries)
+}
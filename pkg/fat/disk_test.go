@@ -0,0 +1,183 @@
+package fat
+
+import (
+	"io"
+	"testing"
+
+	"github.com/zni/fslib/pkg/gpt"
+	"github.com/zni/fslib/pkg/mbr"
+)
+
+const test_disk_size int64 = 72 * 1024 * 1024
+
+/*
+Open the volume formatted in a partition by hand, checking its BPB_hiddsec
+counts the sectors in front of the partition.
+*/
+func openPartitionVolume(t *testing.T, dev BlockDevice, offset int64, size int64) Volume {
+	t.Helper()
+
+	section, err := NewSectionDevice(dev, offset, size)
+	if err != nil {
+		t.Fatalf("NewSectionDevice: %v", err)
+	}
+	bpb, err := ReadCommonBPB(io.NewSectionReader(section, 0, section.Size()))
+	if err != nil {
+		t.Fatalf("ReadCommonBPB: %v", err)
+	}
+	if int64(bpb.BPB_hiddsec) != offset/512 {
+		t.Errorf("BPB_hiddsec is %d, not %d", bpb.BPB_hiddsec, offset/512)
+	}
+
+	vol, err := OpenDevice(section)
+	if err != nil {
+		t.Fatalf("OpenDevice: %v", err)
+	}
+
+	return vol
+}
+
+func TestFormatDiskMBR(t *testing.T) {
+	dev := NewMemDevice(make([]byte, test_disk_size))
+	partitions, err := FormatDisk(dev, &DiskOptions{
+		Scheme:        PARTITION_SCHEME_MBR,
+		DiskSignature: 0xCAFEF00D,
+		Partitions: []PartitionOptions{
+			{Size: 20 * 1024 * 1024, Format: &FormatOptions{Type: FAT_TYPE_16, Label: "first"}, Bootable: true},
+			{Size: 4 * 1024 * 1024},
+			{Format: &FormatOptions{Type: FAT_TYPE_32, Label: "last"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("FormatDisk: %v", err)
+	}
+	if len(partitions) != 3 {
+		t.Fatalf("FormatDisk laid out %d partitions, not 3", len(partitions))
+	}
+
+	table, err := mbr.Read(dev, 512)
+	if err != nil {
+		t.Fatalf("mbr.Read: %v", err)
+	}
+	if table.DiskSignature != 0xCAFEF00D {
+		t.Errorf("disk signature is %#x", table.DiskSignature)
+	}
+
+	want_types := []uint8{mbr.TYPE_FAT16_LBA, mbr.TYPE_LINUX, mbr.TYPE_FAT32_LBA}
+	for i, partition := range partitions {
+		entry, err := table.Partition(partition.Number)
+		if err != nil {
+			t.Fatalf("partition %d: %v", partition.Number, err)
+		}
+		if entry.Type != want_types[i] {
+			t.Errorf("partition %d has type %#x, not %#x", partition.Number, entry.Type, want_types[i])
+		}
+		if entry.Offset(512) != partition.Offset || entry.Size(512) != partition.Size {
+			t.Errorf("partition %d lies at %d+%d, not %d+%d", partition.Number,
+				entry.Offset(512), entry.Size(512), partition.Offset, partition.Size)
+		}
+		if partition.Offset%default_partition_alignment != 0 {
+			t.Errorf("partition %d at %d isn't aligned", partition.Number, partition.Offset)
+		}
+		if entry.Bootable != (i == 0) {
+			t.Errorf("partition %d bootable is %v", partition.Number, entry.Bootable)
+		}
+	}
+	if partitions[1].Geometry != nil {
+		t.Errorf("unformatted partition has a geometry")
+	}
+
+	for _, partition := range []*DiskPartition{partitions[0], partitions[2]} {
+		vol := openPartitionVolume(t, dev, partition.Offset, partition.Size)
+		if vol.Type() != partition.Geometry.Type {
+			t.Errorf("partition %d opens as %s, not %s", partition.Number, vol.Type(), partition.Geometry.Type)
+		}
+		if _, err := vol.CreateFile("/a.txt", []byte("a")); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+		assertClean(t, vol)
+
+		opened, err := OpenMBRPartition(dev, partition.Number)
+		if err != nil {
+			t.Fatalf("OpenMBRPartition: %v", err)
+		}
+		if _, err := opened.ReadFile("/a.txt"); err != nil {
+			t.Errorf("ReadFile: %v", err)
+		}
+	}
+}
+
+func TestFormatDiskGPT(t *testing.T) {
+	disk_guid := gpt.MustParseGUID("0D4BC1A3-7E52-4C2B-9A56-3F0E51B7D2C8")
+	dev := NewMemDevice(make([]byte, test_disk_size))
+	partitions, err := FormatDisk(dev, &DiskOptions{
+		Scheme:   PARTITION_SCHEME_GPT,
+		DiskGUID: disk_guid,
+		Partitions: []PartitionOptions{
+			{Size: 40 * 1024 * 1024, Format: &FormatOptions{Type: FAT_TYPE_32}, GPTType: gpt.TYPE_EFI_SYSTEM, Name: "EFI"},
+			{Format: &FormatOptions{Type: FAT_TYPE_16}, Name: "data"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("FormatDisk: %v", err)
+	}
+
+	table, err := gpt.Read(dev, 512, dev.Size())
+	if err != nil {
+		t.Fatalf("gpt.Read: %v", err)
+	}
+	if table.Primary.DiskGUID != disk_guid || len(table.Problems) != 0 {
+		t.Errorf("GPT has disk GUID %s and problems %v", table.Primary.DiskGUID, table.Problems)
+	}
+
+	want_types := []gpt.GUID{gpt.TYPE_EFI_SYSTEM, gpt.TYPE_BASIC_DATA}
+	for i, partition := range partitions {
+		entry, err := table.Partition(partition.Number)
+		if err != nil {
+			t.Fatalf("partition %d: %v", partition.Number, err)
+		}
+		if entry.Type != want_types[i] {
+			t.Errorf("partition %d has type %s, not %s", partition.Number, entry.Type, want_types[i])
+		}
+		if entry.Offset(512) != partition.Offset || entry.Size(512) != partition.Size {
+			t.Errorf("partition %d lies at %d+%d, not %d+%d", partition.Number,
+				entry.Offset(512), entry.Size(512), partition.Offset, partition.Size)
+		}
+
+		vol := openPartitionVolume(t, dev, partition.Offset, partition.Size)
+		if vol.Type() != partition.Geometry.Type {
+			t.Errorf("partition %d opens as %s, not %s", partition.Number, vol.Type(), partition.Geometry.Type)
+		}
+		assertClean(t, vol)
+
+		opened, err := OpenGPTPartition(dev, gpt.Selector{Name: entry.Name})
+		if err != nil {
+			t.Fatalf("OpenGPTPartition: %v", err)
+		}
+		if opened.Type() != partition.Geometry.Type {
+			t.Errorf("partition %q opens as %s", entry.Name, opened.Type())
+		}
+	}
+}
+
+func TestFormatDiskRejectsBadLayouts(t *testing.T) {
+	tests := map[string]*DiskOptions{
+		"no partitions":       {Scheme: PARTITION_SCHEME_MBR},
+		"five MBR partitions": {Scheme: PARTITION_SCHEME_MBR, Partitions: make([]PartitionOptions, 5)},
+		"rest not last":       {Scheme: PARTITION_SCHEME_GPT, Partitions: make([]PartitionOptions, 2)},
+		"odd size":            {Scheme: PARTITION_SCHEME_MBR, Partitions: []PartitionOptions{{Size: 1000}}},
+		"too big":             {Scheme: PARTITION_SCHEME_MBR, Partitions: []PartitionOptions{{Size: test_disk_size}}},
+		"odd alignment":       {Scheme: PARTITION_SCHEME_MBR, Alignment: 1000, Partitions: []PartitionOptions{{}}},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			dev := NewMemDevice(make([]byte, test_disk_size))
+			if _, err := FormatDisk(dev, opts); err == nil {
+				t.Errorf("FormatDisk succeeded")
+			}
+			if _, err := mbr.Read(dev, 512); err == nil {
+				t.Errorf("failed FormatDisk left a partition table behind")
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package fat
 import (
 	"errors"
 	"io"
-	"os"
 
 	"github.com/zni/fslib/internal/utilities"
 )
@@ -50,7 +49,7 @@ type ExtBPBFull struct {
 	signature_word [2]byte
 }
 
-func ReadBPB32(f *os.File) (*BPB32, error) {
+func ReadBPB32(f io.ReadSeeker) (*BPB32, error) {
 	var bpb, err = ReadCommonBPB(f)
 	if err != nil {
 		return nil, err
@@ -151,3 +150,125 @@ func ReadBPB32(f *os.File) (*BPB32, error) {
 
 	return &BPB32{bpb, &extbpb}, nil
 }
+
+func ReadBPB16(f io.ReadSeeker) (*BPB16, error) {
+	bpb, err := ReadCommonBPB(f)
+	if err != nil {
+		return nil, err
+	}
+
+	extbpb, err := readExtBPBMinimal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BPB16{bpb, extbpb}, nil
+}
+
+func ReadBPB12(f io.ReadSeeker) (*BPB12, error) {
+	bpb, err := ReadCommonBPB(f)
+	if err != nil {
+		return nil, err
+	}
+
+	extbpb, err := readExtBPBMinimal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BPB12{bpb, extbpb}, nil
+}
+
+/*
+Read the minimal extended BPB that follows the common BPB on FAT12 and FAT16
+volumes.
+*/
+func readExtBPBMinimal(f io.ReadSeeker) (*ExtBPBMinimal, error) {
+	byte_ := make([]byte, 1)
+	int_ := make([]byte, 4)
+
+	var extbpb ExtBPBMinimal = ExtBPBMinimal{}
+	_, err := f.Read(byte_)
+	if err != nil {
+		return nil, err
+	}
+	extbpb.bs_drvnum = byte_[0]
+
+	_, err = f.Read(byte_)
+	if err != nil {
+		return nil, err
+	}
+	extbpb.bs_reserved1 = byte_[0]
+
+	_, err = f.Read(byte_)
+	if err != nil {
+		return nil, err
+	}
+	extbpb.bs_bootsig = byte_[0]
+
+	_, err = f.Read(int_)
+	if err != nil {
+		return nil, err
+	}
+	extbpb.bs_volid = utilities.BytesToInt(int_)
+
+	_, err = f.Read(extbpb.bs_vollab[:])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Read(extbpb.bs_filsystype[:])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(448, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Read(extbpb.signature_word[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if extbpb.signature_word[0] != 0x55 || extbpb.signature_word[1] != 0xAA {
+		return nil, errors.New("invalid BPB signature")
+	}
+
+	return &extbpb, nil
+}
+
+/*
+Encode the FAT32 extended BPB into a boot sector, following the common BPB.
+*/
+func (extbpb *ExtBPBFull) encode(sector []byte) {
+	copy(sector[36:40], utilities.IntToBytes(extbpb.BPB_fatsz32))
+	copy(sector[40:42], utilities.ShortToBytes(extbpb.BPB_extflags))
+	copy(sector[42:44], utilities.ShortToBytes(extbpb.BPB_fsver))
+	copy(sector[44:48], utilities.IntToBytes(extbpb.BPB_rootclus))
+	copy(sector[48:50], utilities.ShortToBytes(extbpb.BPB_fsinfo))
+	copy(sector[50:52], utilities.ShortToBytes(extbpb.BPB_bkbootsec))
+	copy(sector[52:64], extbpb.BPB_reserved[:])
+	sector[64] = extbpb.BS_drvnum
+	sector[65] = extbpb.BS_reserved1
+	sector[66] = extbpb.BS_bootsig
+	copy(sector[67:71], utilities.IntToBytes(extbpb.BS_volid))
+	copy(sector[71:82], extbpb.BS_vollab[:])
+	copy(sector[82:90], extbpb.BS_filsystype[:])
+	copy(sector[510:512], extbpb.signature_word[:])
+}
+
+/*
+Encode the FAT12 or FAT16 extended BPB into a boot sector, following the common
+BPB.
+*/
+func (extbpb *ExtBPBMinimal) encode(sector []byte) {
+	sector[36] = extbpb.bs_drvnum
+	sector[37] = extbpb.bs_reserved1
+	sector[38] = extbpb.bs_bootsig
+	copy(sector[39:43], utilities.IntToBytes(extbpb.bs_volid))
+	copy(sector[43:54], extbpb.bs_vollab[:])
+	copy(sector[54:62], extbpb.bs_filsystype[:])
+	copy(sector[510:512], extbpb.signature_word[:])
+}
@@ -1,9 +1,10 @@
 package fat
 
 import (
+	"bufio"
 	"errors"
 	"io"
-	"os"
+	"iter"
 
 	"github.com/zni/fslib/internal/utilities"
 )
@@ -14,22 +15,41 @@ type FATSize interface {
 
 type FAT[T FATSize] struct {
 	table []T
+
+	// FAT12 entries are 12 bits wide, packed two to every three bytes on disk.
+	packed bool
+}
+
+/*
+Make a FAT12 table, which is held in memory as 16 bit entries.
+*/
+func MakeFAT12(max_clusters uint32) *FAT[uint16] {
+	fat := make([]uint16, max_clusters)
+
+	return &FAT[uint16]{table: fat, packed: true}
 }
 
 func MakeFAT16(max_clusters uint32) *FAT[uint16] {
 	fat := make([]uint16, max_clusters)
 
-	return &FAT[uint16]{fat}
+	return &FAT[uint16]{table: fat}
 }
 
 func MakeFAT32(max_clusters uint32) *FAT[uint32] {
 	fat := make([]uint32, max_clusters)
 
-	return &FAT[uint32]{fat}
+	return &FAT[uint32]{table: fat}
 }
 
-func (fat *FAT[T]) ReadFAT(fs *os.File, max_clusters uint32) error {
+/*
+Read the copy of the FAT at the location loc on disk.
+*/
+func (fat *FAT[T]) ReadFAT(dev BlockDevice, loc int64, max_clusters uint32) error {
+	fs := bufio.NewReader(io.NewSectionReader(dev, loc, dev.Size()-loc))
 	if table, ok := any(fat.table).([]uint16); ok {
+		if fat.packed {
+			return readFAT12(fs, max_clusters, table)
+		}
 		return readFAT16(fs, max_clusters, table)
 	} else if table, ok := any(fat.table).([]uint32); ok {
 		return readFAT32(fs, max_clusters, table)
@@ -37,12 +57,36 @@ func (fat *FAT[T]) ReadFAT(fs *os.File, max_clusters uint32) error {
 	return nil
 }
 
-func readFAT16(f *os.File, max_clusters uint32, table []uint16) error {
+/*
+Read a FAT12 table, where each pair of entries shares three bytes: the first
+entry takes the low 12 bits and the second entry the high 12 bits.
+*/
+func readFAT12(f io.Reader, max_clusters uint32, table []uint16) error {
+	packed_table := make([]uint8, (3*max_clusters+1)/2)
+	if _, err := io.ReadFull(f, packed_table); err != nil {
+		return errors.New("failed to read cluster entry")
+	}
+
+	var n uint32
+	for n = 0; n < max_clusters; n++ {
+		offset := n + n/2
+		entry := uint16(packed_table[offset]) | uint16(packed_table[offset+1])<<8
+		if n%2 == 0 {
+			table[n] = entry & 0x0FFF
+		} else {
+			table[n] = entry >> 4
+		}
+	}
+
+	return nil
+}
+
+func readFAT16(f io.Reader, max_clusters uint32, table []uint16) error {
 	short_ := make([]uint8, 2)
 
 	var n uint32
 	for n = 0; n < max_clusters; n++ {
-		_, err := f.Read(short_)
+		_, err := io.ReadFull(f, short_)
 		if err != nil {
 			return errors.New("failed to read cluster entry")
 		}
@@ -52,12 +96,12 @@ func readFAT16(f *os.File, max_clusters uint32, table []uint16) error {
 	return nil
 }
 
-func readFAT32(f *os.File, max_clusters uint32, table []uint32) error {
+func readFAT32(f io.Reader, max_clusters uint32, table []uint32) error {
 	int_ := make([]uint8, 4)
 
 	var n uint32
 	for n = 0; n < max_clusters; n++ {
-		_, err := f.Read(int_)
+		_, err := io.ReadFull(f, int_)
 		if err != nil {
 			return errors.New("failed to read cluster entry")
 		}
@@ -67,62 +111,80 @@ func readFAT32(f *os.File, max_clusters uint32, table []uint32) error {
 	return nil
 }
 
-func (fat *FAT[T]) WriteFAT(fs *os.File) error {
-	if table, ok := any(fat.table).([]uint16); ok {
-		return writeFAT16(fs, table)
-	} else if table, ok := any(fat.table).([]uint32); ok {
-		return writeFAT32(fs, table)
+/*
+Write the FAT out to the copy at the location loc on disk.
+*/
+func (fat *FAT[T]) WriteFAT(dev BlockDevice, loc int64) error {
+	if _, err := dev.WriteAt(fat.encode(), loc); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func writeFAT16(fs *os.File, table []uint16) error {
-	for _, v := range table {
-		if _, err := fs.Write(utilities.ShortToBytes(v)); err != nil {
-			return err
-		}
-	}
-
-	for _, v := range table {
-		if _, err := fs.Write(utilities.ShortToBytes(v)); err != nil {
-			return err
+/*
+Encode the FAT as it's laid out on disk.
+*/
+func (fat *FAT[T]) encode() []byte {
+	if table, ok := any(fat.table).([]uint16); ok {
+		if fat.packed {
+			return encodeFAT12(table)
 		}
+		return encodeFAT16(table)
+	} else if table, ok := any(fat.table).([]uint32); ok {
+		return encodeFAT32(table)
 	}
 
 	return nil
 }
 
-func writeFAT32(fs *os.File, table []uint32) error {
-	for _, v := range table {
-		if _, err := fs.Write(utilities.IntToBytes(v)); err != nil {
-			return err
+func encodeFAT12(table []uint16) []byte {
+	buffer := make([]byte, (3*len(table)+1)/2)
+	for n, v := range table {
+		offset := n + n/2
+		v &= 0x0FFF
+		if n%2 == 0 {
+			buffer[offset] = uint8(v)
+			buffer[offset+1] = (buffer[offset+1] & 0xF0) | uint8(v>>8)
+		} else {
+			buffer[offset] = (buffer[offset] & 0x0F) | uint8(v<<4)
+			buffer[offset+1] = uint8(v >> 4)
 		}
 	}
 
+	return buffer
+}
+
+func encodeFAT16(table []uint16) []byte {
+	buffer := make([]byte, 0, 2*len(table))
 	for _, v := range table {
-		if _, err := fs.Write(utilities.IntToBytes(v)); err != nil {
-			return err
-		}
+		buffer = append(buffer, utilities.ShortToBytes(v)...)
 	}
 
-	return nil
+	return buffer
 }
 
-func SeekToFAT(fs *os.File, bpb *CommonBPB) error {
-	var fat_loc int64 = int64(bpb.BPB_rsvdseccnt) * int64(bpb.BPB_bytspersec)
-	if _, err := fs.Seek(fat_loc, io.SeekStart); err != nil {
-		return err
+func encodeFAT32(table []uint32) []byte {
+	buffer := make([]byte, 0, 4*len(table))
+	for _, v := range table {
+		buffer = append(buffer, utilities.IntToBytes(v)...)
 	}
 
-	return nil
+	return buffer
 }
 
 /*
 Get the next free cluster from the FAT not marked EOC.
 */
 func (fat *FAT[T]) GetNextFreeCluster() (T, error) {
-	for i := 2; i < len(fat.table); i++ {
+	return fat.getNextFreeClusterAfter(2)
+}
+
+/*
+Get the next free cluster from the FAT, starting the search at the given cluster.
+*/
+func (fat *FAT[T]) getNextFreeClusterAfter(start T) (T, error) {
+	for i := int(start); i < len(fat.table); i++ {
 		if fat.table[i] == 0 {
 			return T(i), nil
 		}
@@ -151,3 +213,77 @@ Get the cluster at the specified location.
 func (fat *FAT[T]) GetCluster(loc uint) T {
 	return fat.table[loc]
 }
+
+/*
+Set the cluster at the specified location.
+*/
+func (fat *FAT[T]) SetCluster(loc uint, value T) {
+	fat.table[loc] = value
+}
+
+/*
+Free every cluster in the chain starting at the given cluster, returning the
+number of clusters freed.
+*/
+func (fat *FAT[T]) FreeChain(start T) int {
+	freed := 0
+	cluster := start
+	for fat.isValidCluster(cluster) {
+		next_cluster := fat.table[cluster]
+		fat.table[cluster] = 0
+		freed++
+
+		if fat.IsEOC(next_cluster) {
+			break
+		}
+		cluster = next_cluster
+	}
+
+	return freed
+}
+
+/*
+Iterate over the clusters in the chain starting at the given cluster, along
+with each cluster's position in the chain, until the end of chain marker.
+*/
+func (fat *FAT[T]) Chain(start T) iter.Seq2[int, T] {
+	return func(yield func(int, T) bool) {
+		cluster := start
+		// A chain can't be longer than the FAT, which also keeps a looping
+		// chain from going on forever.
+		for i := 0; i < len(fat.table) && fat.isValidCluster(cluster); i++ {
+			if !yield(i, cluster) {
+				return
+			}
+
+			cluster = fat.GetCluster(uint(cluster))
+			if fat.IsEOC(cluster) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Is the cluster value an end of chain marker?
+*/
+func (fat *FAT[T]) IsEOC(value T) bool {
+	switch any(value).(type) {
+	case uint16:
+		if fat.packed {
+			return (uint16(value) & 0x0FFF) >= 0x0FF8
+		}
+		return uint16(value) >= 0xFFF8
+	case uint32:
+		return (uint32(value) & 0x0FFFFFFF) >= 0x0FFFFFF8
+	}
+
+	return value == fat.GetEOC()
+}
+
+/*
+Does the cluster value point at a cluster inside the FAT?
+*/
+func (fat *FAT[T]) isValidCluster(value T) bool {
+	return value >= 2 && int(value) < len(fat.table)
+}
@@ -0,0 +1,242 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"iter"
+	"path"
+
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+// Volumes with fewer clusters than these are FAT12 and FAT16 respectively.
+const max_fat12_clusters uint32 = 4085
+const max_fat16_clusters uint32 = 65525
+
+/*
+Load a FAT16 volume's information into memory.
+*/
+func LoadFAT16(path string) (*FAT16, error) {
+	dev, err := OpenFileDevice(path)
+	if err != nil {
+		return nil, &fs.FSError{Op: "LoadFAT16", Path: path, Err: err}
+	}
+
+	vol, err := LoadFAT16Device(dev)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+/*
+Load the information of the FAT16 volume on a device into memory. Closing the
+volume closes the device, if it can be closed.
+*/
+func LoadFAT16Device(dev BlockDevice) (*FAT16, error) {
+	name := deviceName(dev)
+	bpb, err := ReadBPB16(io.NewSectionReader(dev, 0, dev.Size()))
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "LoadFAT16",
+			Path: name,
+			Err:  fmt.Errorf("failed to read BPB: %w", err),
+		}
+	}
+
+	vol := &FAT16{BPB: bpb, DiskRef: dev}
+	if err := checkBPB(vol, 16); err != nil {
+		return nil, &fs.FSError{Op: "LoadFAT16", Path: name, Err: err}
+	}
+
+	count_of_clusters := CountOfClusters(vol)
+	if bpb.Common.BPB_rootentcnt == 0 || count_of_clusters < max_fat12_clusters || count_of_clusters >= max_fat16_clusters {
+		return nil, &fs.FSError{
+			Op:   "LoadFAT16",
+			Path: name,
+			Err:  fmt.Errorf("volume is not FAT16"),
+		}
+	}
+
+	vol.FAT, vol.BackupFAT, err = readFATCopies(vol, MakeFAT16)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "LoadFAT16",
+			Path: name,
+			Err:  err,
+		}
+	}
+
+	return vol, nil
+}
+
+/*
+Read the FAT and, when the volume has more than one, the backup FAT of a FAT12
+or FAT16 volume.
+*/
+func readFATCopies[T FATSystem](vol T, make_fat func(uint32) *FAT[uint16]) (*FAT[uint16], *FAT[uint16], error) {
+	disk_ref := vol.GetDiskRef()
+	max_clusters := CountOfClusters(vol) + 2
+
+	fat := make_fat(max_clusters)
+	if err := fat.ReadFAT(disk_ref, LookupFATBytes(vol, 0), max_clusters); err != nil {
+		return nil, nil, fmt.Errorf("failed to read FAT: %w", err)
+	}
+
+	if vol.GetCommonBPB().BPB_numfats < 2 {
+		return fat, nil, nil
+	}
+
+	backup_fat := make_fat(max_clusters)
+	if err := backup_fat.ReadFAT(disk_ref, LookupFATBytes(vol, 1), max_clusters); err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup FAT: %w", err)
+	}
+
+	return fat, backup_fat, nil
+}
+
+/*
+Read a file from the volume given by the path.
+*/
+func (vol *FAT16) ReadFile(file_path string) (*FATFile, error) {
+	return readFile(vol, file_path)
+}
+
+/*
+Read the entries of the directory represented by the path, skipping the '.'
+and '..' entries.
+*/
+func (vol *FAT16) ReadDir(dir_path string) ([]*FATFile, error) {
+	return readDir(vol, "ReadDir", dir_path, false)
+}
+
+/*
+Read the entries of the directory represented by the path, including the '.'
+and '..' entries.
+*/
+func (vol *FAT16) ReadDirWithDots(dir_path string) ([]*FATFile, error) {
+	return readDir(vol, "ReadDirWithDots", dir_path, true)
+}
+
+/*
+Iterate over the entries of the directory represented by the path, skipping the
+'.' and '..' entries.
+*/
+func (vol *FAT16) Entries(dir_path string) iter.Seq2[*FATFile, error] {
+	return entries(vol, dir_path)
+}
+
+/*
+Read a file's complete contents from the volume into the File.Content struct member.
+*/
+func (vol *FAT16) ReadAll(file *FATFile) (int, error) {
+	return ReadAll(file, vol)
+}
+
+/*
+Read a portion of a file's contents from the volume into the buffer provided.
+*/
+func (vol *FAT16) Read(b []byte, file *FATFile) (int, error) {
+	return Read(b, vol, file)
+}
+
+/*
+Create a directory represented by the path.
+*/
+func (vol *FAT16) CreateDir(dir_path string) (*FATFile, error) {
+	return createDir(vol, dir_path)
+}
+
+/*
+Create a regular file represented by the path, holding the given contents.
+*/
+func (vol *FAT16) CreateFile(file_path string, data []byte) (*FATFile, error) {
+	return createFile(vol, "CreateFile", file_path, bytes.NewReader(data))
+}
+
+/*
+Create a regular file represented by the path, holding everything read from r.
+*/
+func (vol *FAT16) CreateFileFrom(file_path string, r io.Reader) (*FATFile, error) {
+	return createFile(vol, "CreateFileFrom", file_path, r)
+}
+
+/*
+Remove the file or empty directory represented by the path.
+*/
+func (vol *FAT16) Remove(file_path string) error {
+	return remove(vol, file_path)
+}
+
+/*
+Rename the file or directory at old_path to new_path, moving it to a new
+containing directory if needed.
+*/
+func (vol *FAT16) Rename(old_path string, new_path string) error {
+	return rename(vol, old_path, new_path)
+}
+
+/*
+Rewrite the directory represented by the path so its live entries sit back to
+back, squeezing out deleted entries. The fixed root directory can't shrink, but
+its freed slots are cleared all the same.
+*/
+func (vol *FAT16) CompactDir(dir_path string) error {
+	return compactDir(vol, dir_path)
+}
+
+/*
+Check the consistency of the volume without changing it.
+*/
+func (vol *FAT16) Check() (*CheckReport, error) {
+	return Check(vol)
+}
+
+/*
+Check the consistency of the volume and repair the problems found.
+*/
+func (vol *FAT16) Repair() (*RepairReport, error) {
+	return Repair(vol)
+}
+
+/*
+Get the FAT type of the volume.
+*/
+func (vol *FAT16) Type() FATType {
+	return FAT_TYPE_16
+}
+
+/*
+Close the file that represents the FAT16 volume.
+*/
+func (vol *FAT16) Close() error {
+	if err := closeDevice(vol.DiskRef); err != nil {
+		return &fs.FSError{
+			Op:   "Close",
+			Path: deviceName(vol.DiskRef),
+			Err:  fmt.Errorf("failed to close volume: %w", err),
+		}
+	} else {
+		return nil
+	}
+}
+
+/*
+Print volume debug information.
+*/
+func (vol *FAT16) PrintInfo() {
+	fmt.Printf("+---------------------+\n")
+	fmt.Printf("|  VOLUME DEBUG INFO  |\n")
+	fmt.Printf("+---------------------+\n")
+	fmt.Printf("\\ volume_filename: %s\n", path.Base(deviceName(vol.DiskRef)))
+	fmt.Printf("\\ bytes_per_sector: %d\n", vol.BPB.Common.BPB_bytspersec)
+	fmt.Printf("\\ sectors_per_cluster: %d\n", vol.BPB.Common.BPB_secperclus)
+	fmt.Printf("\\ root_entries: %d\n", vol.BPB.Common.BPB_rootentcnt)
+	fmt.Printf("\\ volume_label: %v\n", string(vol.BPB.Extended.bs_vollab[:]))
+	fmt.Printf("\\ file_sys_type: %v\n", string(vol.BPB.Extended.bs_filsystype[:]))
+	fmt.Printf("\\ clusters: %v\n", CountOfClusters(vol))
+	fmt.Println("")
+}
@@ -1,13 +1,12 @@
 package fat
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"os"
+	"iter"
 	"path"
-	"strings"
 
-	"github.com/zni/fslib/internal/utilities"
 	fs "github.com/zni/fslib/pkg/fs/common"
 )
 
@@ -17,93 +16,98 @@ const backup_bpb_sector uint16 = 6
 Load a volume's information into memory.
 */
 func Load(path string) (*FAT32, error) {
-	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	dev, err := OpenFileDevice(path)
 	if err != nil {
 		return nil, &fs.FSError{Op: "Load", Path: path, Err: err}
 	}
 
-	bpb, err := ReadBPB32(file)
+	vol, err := LoadDevice(dev)
 	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "Load",
-			Path: path,
-			Err:  fmt.Errorf("failed to read BPB: %w", err),
-		}
+		dev.Close()
+		return nil, err
 	}
 
-	var fsinfo FSInfo
-	err = fsinfo.Read(file)
+	return vol, nil
+}
+
+/*
+Load the information of the volume on a device into memory. Closing the volume
+closes the device, if it can be closed.
+*/
+func LoadDevice(dev BlockDevice) (*FAT32, error) {
+	name := deviceName(dev)
+	bpb, err := ReadBPB32(io.NewSectionReader(dev, 0, dev.Size()))
 	if err != nil {
 		return nil, &fs.FSError{
 			Op:   "Load",
-			Path: path,
-			Err:  fmt.Errorf("failed to read FSInfo: %w", err),
+			Path: name,
+			Err:  fmt.Errorf("failed to read BPB: %w", err),
 		}
 	}
 
-	backup_bpb_seek := int64(bpb.Common.BPB_bytspersec * backup_bpb_sector)
-	_, err = file.Seek(backup_bpb_seek, io.SeekStart)
+	if err := checkBPB(&FAT32{BPB: bpb}, 32); err != nil {
+		return nil, &fs.FSError{Op: "Load", Path: name, Err: err}
+	}
+
+	// The FSInfo follows in the next sector, which may be larger than the BPB.
+	var fsinfo FSInfo
+	err = fsinfo.Read(dev, fsinfoLoc(bpb.Common))
 	if err != nil {
 		return nil, &fs.FSError{
 			Op:   "Load",
-			Path: path,
-			Err:  fmt.Errorf("failed to read backup BPB: %w", err),
+			Path: name,
+			Err:  fmt.Errorf("failed to read FSInfo: %w", err),
 		}
 	}
 
-	backup_bpb, err := ReadBPB32(file)
+	backup_bpb_seek := int64(bpb.Common.BPB_bytspersec) * int64(backup_bpb_sector)
+	backup_bpb, err := ReadBPB32(io.NewSectionReader(dev, backup_bpb_seek, dev.Size()-backup_bpb_seek))
 	if err != nil {
 		return nil, &fs.FSError{
 			Op:   "Load",
-			Path: path,
+			Path: name,
 			Err:  fmt.Errorf("failed to read backup BPB: %w", err),
 		}
 	}
 
 	var backup_fsinfo FSInfo
-	err = backup_fsinfo.Read(file)
+	err = backup_fsinfo.Read(dev, backup_bpb_seek+int64(bpb.Common.BPB_bytspersec))
 	if err != nil {
 		return nil, &fs.FSError{
 			Op:   "Load",
-			Path: path,
+			Path: name,
 			Err:  fmt.Errorf("failed to read backup FSInfo: %w", err),
 		}
 	}
 
 	fat_seek := int64(bpb.Common.BPB_rsvdseccnt) * int64(bpb.Common.BPB_bytspersec)
-	_, err = file.Seek(fat_seek, io.SeekStart)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "Load",
-			Path: path,
-			Err:  fmt.Errorf("failed to read FAT: %w", err),
-		}
-	}
-
 	data_sectors := bpb.Common.BPB_totsec32 - (uint32(bpb.Common.BPB_rsvdseccnt) + uint32(bpb.Common.BPB_numfats)*bpb.Extended.BPB_fatsz32)
-	max_clusters := (data_sectors / uint32(bpb.Common.BPB_secperclus)) + 1
+	max_clusters := (data_sectors / uint32(bpb.Common.BPB_secperclus)) + 2
 	fat := MakeFAT32(max_clusters)
 	err = fat.ReadFAT(
-		file,
+		dev,
+		fat_seek,
 		max_clusters,
 	)
 	if err != nil {
 		return nil, &fs.FSError{
 			Op:   "Load",
-			Path: path,
+			Path: name,
 			Err:  fmt.Errorf("failed to read FAT: %w", err),
 		}
 	}
 
+	backup_fat_seek := fat_seek + int64(bpb.Extended.BPB_fatsz32)*int64(bpb.Common.BPB_bytspersec)
 	backup_fat := MakeFAT32(max_clusters)
 	err = backup_fat.ReadFAT(
-		file,
+		dev,
+		backup_fat_seek,
 		max_clusters,
 	)
 	if err != nil {
 		return nil, &fs.FSError{
 			Op:   "Load",
-			Path: path,
+			Path: name,
 			Err:  fmt.Errorf("failed to read backup FAT: %w", err),
 		}
 	}
@@ -115,7 +119,7 @@ func Load(path string) (*FAT32, error) {
 		BackupFSInfo: &backup_fsinfo,
 		FAT:          fat,
 		BackupFAT:    backup_fat,
-		DiskRef:      file,
+		DiskRef:      dev,
 	}, nil
 }
 
@@ -123,289 +127,123 @@ func Load(path string) (*FAT32, error) {
 Read a file from the volume given by the path.
 */
 func (vol *FAT32) ReadFile(file_path string) (*FATFile, error) {
-	// Start in the root cluster and calculate the cluster boundary.
-	current_cluster := vol.BPB.Extended.BPB_rootclus
-	_, err := vol.DiskRef.Seek(int64(LookupClusterBytes(vol, current_cluster)), io.SeekStart)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "ReadFile",
-			Path: file_path,
-			Err:  fmt.Errorf("failed to seek to cluster: %w", err),
-		}
-	}
-	cluster_boundary := LookupClusterBytes(vol, current_cluster+1)
-
-	// Split the path on forward slashes.
-	// If we only have one element '/', which becomes "", then return.
-	segmented_path := strings.Split(file_path, "/")
-	if segmented_path[0] == "" && len(segmented_path) == 1 {
-		return nil, &fs.FSError{
-			Op:   "ReadFile",
-			Path: file_path,
-			Err:  fmt.Errorf("no file specified"),
-		}
-	}
-
-	var file *FATFile
-	segmented_path_len := len(segmented_path)
-	for i, s := range segmented_path {
-		// If we have a leftover from the slash split, just continue.
-		if s == "" {
-			continue
-		}
-
-		// Get our current position again for the for loop below.
-		current_location, err := vol.DiskRef.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return nil, &fs.FSError{
-				Op:   "ReadFile",
-				Path: file_path,
-				Err:  fmt.Errorf("failed to get cursor location: %w", err),
-			}
-		}
-
-		// While we're not at the cluster boundary and we haven't found
-		// the file yet, keep looking.
-		for current_location < int64(cluster_boundary) {
-			file, err = GetFile(vol)
-			if err != nil {
-				return nil, &fs.FSError{
-					Op:   "ReadFile",
-					Path: file_path,
-					Err:  fmt.Errorf("failed to get file: %w", err),
-				}
-			}
-
-			// If we have a match, break out so we can analyze it.
-			if file.Name == s {
-				break
-			}
-
-			current_location, err = vol.DiskRef.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return nil, &fs.FSError{
-					Op:   "ReadFile",
-					Path: file_path,
-					Err:  fmt.Errorf("failed to get cursor location: %w", err),
-				}
-			}
-		}
+	return readFile(vol, file_path)
+}
 
-		// If the file matches part of the path and it's a directory, get ready to descend.
-		if file.Name == s && IsDirectory(file.FSSpecificData.DIREntry) {
-			cluster := utilities.DirClusterToUint(
-				uint(file.FSSpecificData.DIREntry.DIR_cluster_lo),
-				uint(file.FSSpecificData.DIREntry.DIR_cluster_hi),
-			)
-			_, err = vol.DiskRef.Seek(int64(LookupClusterBytes(vol, cluster)), io.SeekStart)
-			if err != nil {
-				return nil, &fs.FSError{
-					Op:   "ReadFile",
-					Path: file_path,
-					Err:  fmt.Errorf("failed to seek to cluster: %w", err),
-				}
-			}
-			cluster_boundary = LookupClusterBytes(vol, cluster+1)
-		}
+/*
+Read the entries of the directory represented by the path, skipping the '.'
+and '..' entries.
+*/
+func (vol *FAT32) ReadDir(dir_path string) ([]*FATFile, error) {
+	return readDir(vol, "ReadDir", dir_path, false)
+}
 
-		// If we're at the last part of the path, we found the file.
-		if (file.Name == s) && ((i + 1) == segmented_path_len) {
-			return file, nil
-		}
-	}
+/*
+Read the entries of the directory represented by the path, including the '.'
+and '..' entries.
+*/
+func (vol *FAT32) ReadDirWithDots(dir_path string) ([]*FATFile, error) {
+	return readDir(vol, "ReadDirWithDots", dir_path, true)
+}
 
-	return nil, &fs.FSError{
-		Op:   "ReadFile",
-		Path: file_path,
-		Err:  fmt.Errorf("file not found"),
-	}
+/*
+Iterate over the entries of the directory represented by the path, skipping the
+'.' and '..' entries. Entries are read from the volume one at a time as the
+iteration asks for them, and iteration stops after the first error.
+*/
+func (vol *FAT32) Entries(dir_path string) iter.Seq2[*FATFile, error] {
+	return entries(vol, dir_path)
 }
 
 /*
 Create a directory represented by the path.
 */
 func (vol *FAT32) CreateDir(dir_path string) (*FATFile, error) {
-	// Get the base path before our new directory.
-	dir_name := path.Base(dir_path)
-	if (dir_name == "/") || (dir_name == ".") {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("invalid directory path"),
-		}
-	}
-
-	// Check if this filename already exists.
-	if _, err := vol.ReadFile(dir_path); err == nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("file name already exists"),
-		}
-	}
-
-	// Read in the information for the containing directory.
-	base_dir, err := vol.ReadFile(path.Dir(dir_path))
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to read parent directory: %w", err),
-		}
-	}
+	return createDir(vol, dir_path)
+}
 
-	// Create our DIR and LDIR entries.
-	dir_entry, err := CreateDIR(dir_name, DIR_ATTR_DIRECTORY)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to create DIR: %w", err),
-		}
-	}
-	chksum := computeShortChecksum(dir_entry)
-	ldirs, err := CreateLDIRs(dir_name, chksum)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to create LDIRs: %w", err),
-		}
-	}
+/*
+Create a regular file represented by the path, holding the given contents.
+*/
+func (vol *FAT32) CreateFile(file_path string, data []byte) (*FATFile, error) {
+	return createFile(vol, "CreateFile", file_path, bytes.NewReader(data))
+}
 
-	// Compute the next free cluster and free space for our
-	// DIR and LDIR entries.
-	base_dir_cluster := utilities.DirClusterToUint(
-		uint(base_dir.FSSpecificData.DIREntry.DIR_cluster_lo),
-		uint(base_dir.FSSpecificData.DIREntry.DIR_cluster_hi),
-	)
-	cluster_bytes := LookupClusterBytes(vol, base_dir_cluster)
-	free_cluster, err := vol.FAT.GetNextFreeCluster()
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to get cluster: %w", err),
-		}
-	}
-	free_cluster_bytes := LookupClusterBytes(vol, free_cluster)
-	next_free_bytes, err := GetNextFreeDIR(vol, cluster_bytes)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to get next free DIR: %w", err),
-		}
-	}
-	dir_entry.DIR_cluster_lo = uint16(free_cluster & 0x0000FFFF)
-	dir_entry.DIR_cluster_hi = uint16((free_cluster & 0xFFFF0000) >> 16)
+/*
+Create a regular file represented by the path, holding everything read from r.
+*/
+func (vol *FAT32) CreateFileFrom(file_path string, r io.Reader) (*FATFile, error) {
+	return createFile(vol, "CreateFileFrom", file_path, r)
+}
 
-	// Write out the LDIR and DIR entries for the directory.
-	ldir_end_location, err := WriteLDIRs(vol.DiskRef, ldirs, next_free_bytes)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to write LDIR entries: %w", err),
-		}
-	}
-	_, err = WriteDIR(vol.DiskRef, dir_entry, ldir_end_location)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to write DIR entry: %w", err),
-		}
-	}
+/*
+Remove the file or empty directory represented by the path.
+*/
+func (vol *FAT32) Remove(file_path string) error {
+	return remove(vol, file_path)
+}
 
-	// Zero the cluster where we'll store the contents of the new directory.
-	if err := ZeroCluster(vol, free_cluster_bytes); err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to zero cluster: %w", err),
-		}
-	}
+/*
+Rename the file or directory at old_path to new_path, moving it to a new
+containing directory if needed.
+*/
+func (vol *FAT32) Rename(old_path string, new_path string) error {
+	return rename(vol, old_path, new_path)
+}
 
-	// Create and write out the '.' and '..' entries.
-	dot_dir, err := CreateSystemDIR(".")
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to create '.' entry: %w", err),
-		}
-	}
-	dot_dir_end_loc, err := WriteDIR(vol.DiskRef, dot_dir, free_cluster_bytes)
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to write '.' entry: %w", err),
-		}
-	}
+/*
+Rewrite the directory represented by the path so its live entries sit back to
+back, squeezing out deleted entries and releasing the clusters on the end of the
+directory that are no longer needed. Entries move on disk, so any File read from
+the directory beforehand is out of date afterwards.
+*/
+func (vol *FAT32) CompactDir(dir_path string) error {
+	return compactDir(vol, dir_path)
+}
 
-	dotdot_dir, err := CreateSystemDIR("..")
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to create '..' entry: %w", err),
-		}
-	}
-	if _, err = WriteDIR(vol.DiskRef, dotdot_dir, dot_dir_end_loc); err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to write '..' entry: %w", err),
-		}
-	}
+/*
+Read a file's complete contents from the volume into the File.Content struct member.
+*/
+func (vol *FAT32) ReadAll(file *FATFile) (int, error) {
+	return ReadAll(file, vol)
+}
 
-	// Mark the cluster with the '.' and '..' entries as end of cluster.
-	vol.FAT.MarkEOC(uint(free_cluster))
+/*
+Read a portion of a file's contents from the volume into the buffer provided.
+*/
+func (vol *FAT32) Read(b []byte, file *FATFile) (int, error) {
+	return Read(b, vol, file)
+}
 
-	// Update the FSInfo with the next free cluster and new free cluster count.
-	next_free_cluster, err := vol.FAT.GetNextFreeCluster()
-	if err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to get cluster for FSInfo: %w", err),
-		}
-	}
-	vol.FSInfo.next_free = next_free_cluster
-	vol.FSInfo.free_count = vol.FSInfo.free_count - 1
+/*
+Check the consistency of the volume without changing it.
+*/
+func (vol *FAT32) Check() (*CheckReport, error) {
+	return Check(vol)
+}
 
-	// Write out the updated FSInfo and FATs.
-	if err := SyncFileSystemData(vol); err != nil {
-		return nil, &fs.FSError{
-			Op:   "CreateDir",
-			Path: dir_path,
-			Err:  fmt.Errorf("failed to sync volume info: %w", err),
-		}
-	}
+/*
+Check the consistency of the volume and repair the problems found.
+*/
+func (vol *FAT32) Repair() (*RepairReport, error) {
+	return Repair(vol)
+}
 
-	// Return a File representation of the new directory.
-	return &FATFile{
-		Name:    dir_name,
-		Content: nil,
-		FSSpecificData: &FATFileData{
-			LDIR_loc:  uint32(next_free_bytes),
-			DIR_loc:   ldir_end_location,
-			LDIREntry: ldirs,
-			DIREntry:  dir_entry,
-		},
-	}, nil
+/*
+Get the FAT type of the volume.
+*/
+func (vol *FAT32) Type() FATType {
+	return FAT_TYPE_32
 }
 
 /*
 Close the file that represents the FAT32 volume.
 */
 func (vol *FAT32) Close() error {
-	if err := vol.DiskRef.Close(); err != nil {
+	if err := closeDevice(vol.DiskRef); err != nil {
 		return &fs.FSError{
 			Op:   "Close",
-			Path: vol.DiskRef.Name(),
+			Path: deviceName(vol.DiskRef),
 			Err:  fmt.Errorf("failed to close volume: %w", err),
 		}
 	} else {
@@ -420,7 +258,7 @@ func (vol *FAT32) PrintInfo() {
 	fmt.Printf("+---------------------+\n")
 	fmt.Printf("|  VOLUME DEBUG INFO  |\n")
 	fmt.Printf("+---------------------+\n")
-	fmt.Printf("\\ volume_filename: %s\n", path.Base(vol.DiskRef.Name()))
+	fmt.Printf("\\ volume_filename: %s\n", path.Base(deviceName(vol.DiskRef)))
 	fmt.Printf("\\ bytes_per_sector: %d\n", vol.BPB.Common.BPB_bytspersec)
 	fmt.Printf("\\ sectors_per_cluster: %d\n", vol.BPB.Common.BPB_secperclus)
 	fmt.Printf("\\ volume_label: %v\n", string(vol.BPB.Extended.BS_vollab[:]))
@@ -0,0 +1,126 @@
+package fat
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+/*
+Collect the clusters a chain iterator yields, checking each comes with its
+position in the chain.
+*/
+func collectChain[T FATSize](t *testing.T, fat *FAT[T], start T) []T {
+	t.Helper()
+
+	var clusters []T
+	for i, cluster := range fat.Chain(start) {
+		if i != len(clusters) {
+			t.Fatalf("cluster %d yielded at position %d", len(clusters), i)
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters
+}
+
+func TestChainFollowsFAT(t *testing.T) {
+	fat := MakeFAT32(16)
+	fat.SetCluster(1, 0x0FFFFFFF)
+	fat.SetCluster(2, 5)
+	fat.SetCluster(5, 3)
+	fat.MarkEOC(3)
+
+	if chain := collectChain(t, fat, 2); !slices.Equal(chain, []uint32{2, 5, 3}) {
+		t.Errorf("chain from 2 is %v", chain)
+	}
+	if chain := collectChain(t, fat, 3); !slices.Equal(chain, []uint32{3}) {
+		t.Errorf("chain from 3 is %v", chain)
+	}
+
+	// Clusters 0 and 1 are reserved, so there's no chain to follow from them.
+	for _, start := range []uint32{0, 1, 16} {
+		if chain := collectChain(t, fat, start); len(chain) != 0 {
+			t.Errorf("chain from %d is %v", start, chain)
+		}
+	}
+
+	// Iteration can stop early.
+	for _, cluster := range fat.Chain(2) {
+		if cluster != 2 {
+			t.Errorf("first cluster is %d", cluster)
+		}
+		break
+	}
+
+	// A chain running into a free cluster stops there, and a looping chain
+	// stops once it's as long as the FAT.
+	fat.SetCluster(8, 0)
+	fat.SetCluster(7, 8)
+	if chain := collectChain(t, fat, 7); !slices.Equal(chain, []uint32{7, 8}) {
+		t.Errorf("chain into a free cluster is %v", chain)
+	}
+	fat.SetCluster(10, 11)
+	fat.SetCluster(11, 10)
+	if chain := collectChain(t, fat, 10); len(chain) != 16 {
+		t.Errorf("looping chain yielded %d clusters", len(chain))
+	}
+}
+
+func TestChainEndsAtEachEOCValue(t *testing.T) {
+	fat12 := MakeFAT12(16)
+	fat12.SetCluster(2, 3)
+	fat12.SetCluster(3, 0x0FF8)
+	if chain := collectChain(t, fat12, 2); !slices.Equal(chain, []uint16{2, 3}) {
+		t.Errorf("FAT12 chain is %v", chain)
+	}
+
+	fat16 := MakeFAT16(16)
+	fat16.SetCluster(2, 3)
+	fat16.SetCluster(3, 0xFFFF)
+	if chain := collectChain(t, fat16, 2); !slices.Equal(chain, []uint16{2, 3}) {
+		t.Errorf("FAT16 chain is %v", chain)
+	}
+
+	// The top 4 bits of a FAT32 entry are reserved.
+	fat32 := MakeFAT32(16)
+	fat32.SetCluster(2, 3)
+	fat32.SetCluster(3, 0xFFFFFFF8)
+	if chain := collectChain(t, fat32, 2); !slices.Equal(chain, []uint32{2, 3}) {
+		t.Errorf("FAT32 chain is %v", chain)
+	}
+}
+
+func TestFATRoundTripsThroughDisk(t *testing.T) {
+	tests := []struct {
+		fat     *FAT[uint16]
+		entries []uint16
+		encoded []byte
+	}{
+		// FAT12 packs each pair of entries into three bytes.
+		{MakeFAT12(5), []uint16{0xFF0, 0xFFF, 0x003, 0x004, 0xFFF}, []byte{0xF0, 0xFF, 0xFF, 0x03, 0x40, 0x00, 0xFF, 0x0F}},
+		{MakeFAT16(3), []uint16{0xFFF8, 0xFFFF, 0x1234}, []byte{0xF8, 0xFF, 0xFF, 0xFF, 0x34, 0x12}},
+	}
+	for _, test := range tests {
+		for i, entry := range test.entries {
+			test.fat.SetCluster(uint(i), entry)
+		}
+
+		dev := NewMemDevice(make([]byte, 512))
+		if err := test.fat.WriteFAT(dev, 100); err != nil {
+			t.Fatalf("WriteFAT: %v", err)
+		}
+		if written := dev.Bytes()[100 : 100+len(test.encoded)]; !bytes.Equal(written, test.encoded) {
+			t.Errorf("entries %#x written as % x, not % x", test.entries, written, test.encoded)
+		}
+
+		read := MakeFAT16(uint32(len(test.entries)))
+		read.packed = test.fat.packed
+		if err := read.ReadFAT(dev, 100, uint32(len(test.entries))); err != nil {
+			t.Fatalf("ReadFAT: %v", err)
+		}
+		if !slices.Equal(read.table, test.entries) {
+			t.Errorf("entries %#x read back as %#x", test.entries, read.table)
+		}
+	}
+}
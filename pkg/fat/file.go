@@ -2,7 +2,6 @@ package fat
 
 import (
 	"fmt"
-	"io"
 
 	"github.com/zni/fslib/internal/utilities"
 	"github.com/zni/fslib/pkg/fs/common"
@@ -85,15 +84,7 @@ func Read[T FATSystem](b []byte, fs T, file *FATFile) (n int, err error) {
 	)
 	file_loc_bytes := LookupClusterBytes(fs, file_cluster)
 
-	// Seek to first cluster for the file.
 	disk_ref := fs.GetDiskRef()
-	if _, err = disk_ref.Seek(int64(file_loc_bytes), io.SeekStart); err != nil {
-		return 0, &common.FileError{
-			Op:   "Read",
-			Path: file.Name,
-			Err:  fmt.Errorf("failed to seek to file cluster: %w", err),
-		}
-	}
 
 	var EOC uint32
 	fat_short := fs.GetFATShort()
@@ -109,7 +100,7 @@ func Read[T FATSystem](b []byte, fs T, file *FATFile) (n int, err error) {
 	var bytes_read int = 0
 
 	for bytes_to_read > 0 {
-		bytes_read, err = disk_ref.Read(b[total_bytes_read:(total_bytes_read + read_size)])
+		bytes_read, err = disk_ref.ReadAt(b[total_bytes_read:(total_bytes_read+read_size)], int64(file_loc_bytes))
 		if err != nil {
 			total_bytes_read += bytes_read
 			return total_bytes_read, &common.FileError{
@@ -139,13 +130,6 @@ func Read[T FATSystem](b []byte, fs T, file *FATFile) (n int, err error) {
 		}
 		if next_cluster != EOC {
 			file_loc_bytes = LookupClusterBytes(fs, next_cluster)
-			if _, err = disk_ref.Seek(int64(file_loc_bytes), io.SeekStart); err != nil {
-				return 0, &common.FileError{
-					Op:   "Read",
-					Path: file.Name,
-					Err:  fmt.Errorf("failed to seek to next cluster: %w", err),
-				}
-			}
 		}
 
 		bytes_to_read -= bytes_read
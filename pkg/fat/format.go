@@ -0,0 +1,466 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const default_sector_size uint16 = 512
+const default_media byte = 0xF8
+const default_volume_label string = "NO NAME"
+
+/*
+Options controlling the layout of a volume created by Format. Any option left
+at its zero value is given a sensible default.
+*/
+type FormatOptions struct {
+	// FAT type of the new volume, picked from the size of the volume when unset.
+	Type FATType
+
+	// Bytes per sector, one of 512, 1024, 2048 or 4096.
+	SectorSize uint16
+
+	// Bytes per cluster, a power of two multiple of the sector size.
+	// When unset the smallest size that suits the FAT type is used.
+	ClusterSize uint32
+
+	// Volume label of at most 11 ASCII characters.
+	Label string
+
+	// Volume serial number, generated from the current time when unset.
+	VolumeID uint32
+
+	// Sectors reserved in front of the first FAT, holding the boot sector and,
+	// on FAT32 volumes, the FSInfo and backup boot sector.
+	ReservedSectors uint16
+
+	// Sectors in front of the volume on its disk, which is the first sector of
+	// the partition holding it, or 0 when the volume takes up the whole disk.
+	HiddenSectors uint32
+}
+
+/*
+Geometry describes the layout of a volume written out by Format.
+*/
+type Geometry struct {
+	Type              FATType
+	BytesPerSector    uint16
+	SectorsPerCluster uint8
+	ReservedSectors   uint16
+	NumFATs           uint8
+	FATSectors        uint32
+	RootEntries       uint16
+	HiddenSectors     uint32
+	TotalSectors      uint32
+	Clusters          uint32
+	VolumeID          uint32
+	Label             string
+}
+
+/*
+Print geometry debug information.
+*/
+func (geometry *Geometry) PrintInfo() {
+	fmt.Printf("+------------------------+\n")
+	fmt.Printf("|  VOLUME GEOMETRY INFO  |\n")
+	fmt.Printf("+------------------------+\n")
+	fmt.Printf("\\ file_sys_type: %v\n", geometry.Type)
+	fmt.Printf("\\ bytes_per_sector: %d\n", geometry.BytesPerSector)
+	fmt.Printf("\\ sectors_per_cluster: %d\n", geometry.SectorsPerCluster)
+	fmt.Printf("\\ reserved_sectors: %d\n", geometry.ReservedSectors)
+	fmt.Printf("\\ fats: %d\n", geometry.NumFATs)
+	fmt.Printf("\\ sectors_per_fat: %d\n", geometry.FATSectors)
+	if geometry.Type != FAT_TYPE_32 {
+		fmt.Printf("\\ root_entries: %d\n", geometry.RootEntries)
+	}
+	fmt.Printf("\\ hidden_sectors: %d\n", geometry.HiddenSectors)
+	fmt.Printf("\\ total_sectors: %d\n", geometry.TotalSectors)
+	fmt.Printf("\\ clusters: %d\n", geometry.Clusters)
+	fmt.Printf("\\ volume_id: %08x\n", geometry.VolumeID)
+	fmt.Printf("\\ volume_label: %s\n", geometry.Label)
+	fmt.Println("")
+}
+
+/*
+Create a new, empty FAT volume of size bytes by writing out its boot sector,
+FSInfo and backup boot sector (on FAT32), both FATs and an empty root directory.
+The data region is left as it is, apart from the root directory.
+*/
+func Format(w io.WriterAt, size int64, opts *FormatOptions) (*Geometry, error) {
+	if opts == nil {
+		opts = &FormatOptions{}
+	}
+
+	geometry, err := planGeometry(size, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	label, err := createVolumeLabel(geometry.Label)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes_per_sector := int64(geometry.BytesPerSector)
+	cluster_size := int64(geometry.SectorsPerCluster) * bytes_per_sector
+	root_dir_sectors := ((uint32(geometry.RootEntries) * 32) + (uint32(bytes_per_sector) - 1)) / uint32(bytes_per_sector)
+	first_data_sector := int64(geometry.ReservedSectors) +
+		int64(geometry.NumFATs)*int64(geometry.FATSectors) +
+		int64(root_dir_sectors)
+
+	// Write out the last sector first, so the volume is its full size even when
+	// it's a new file.
+	last_sector := make([]byte, bytes_per_sector)
+	if _, err := w.WriteAt(last_sector, int64(geometry.TotalSectors-1)*bytes_per_sector); err != nil {
+		return nil, fmt.Errorf("failed to extend volume: %w", err)
+	}
+
+	// Lay out the reserved region, starting with the boot sector.
+	reserved := make([]byte, int64(geometry.ReservedSectors)*bytes_per_sector)
+	encodeBootSector(geometry, label, reserved[:bytes_per_sector])
+	if geometry.Type == FAT_TYPE_32 {
+		fsinfo := FSInfo{
+			lead_sig:   lead_signature,
+			struc_sig:  structure_signature,
+			free_count: geometry.Clusters - 1,
+			next_free:  3,
+			trail_sig:  trailing_signature,
+		}
+		fsinfo_sector := reserved[bytes_per_sector : 2*bytes_per_sector]
+		fsinfo.encode(fsinfo_sector)
+
+		// The backup boot sector and FSInfo sit at sector 6 and 7.
+		backup_loc := int64(backup_bpb_sector) * bytes_per_sector
+		copy(reserved[backup_loc:backup_loc+bytes_per_sector], reserved[:bytes_per_sector])
+		copy(reserved[backup_loc+bytes_per_sector:backup_loc+2*bytes_per_sector], fsinfo_sector)
+	}
+	if _, err := w.WriteAt(reserved, 0); err != nil {
+		return nil, fmt.Errorf("failed to write boot sector: %w", err)
+	}
+
+	// Each copy of the FAT starts out with the media and EOC entries, and on
+	// FAT32 the end of the root directory's chain.
+	fat_region := make([]byte, int64(geometry.FATSectors)*bytes_per_sector)
+	copy(fat_region, initialFAT(geometry))
+	for n := 0; n < int(geometry.NumFATs); n++ {
+		fat_loc := (int64(geometry.ReservedSectors) + int64(n)*int64(geometry.FATSectors)) * bytes_per_sector
+		if _, err := w.WriteAt(fat_region, fat_loc); err != nil {
+			return nil, fmt.Errorf("failed to write FAT: %w", err)
+		}
+	}
+
+	// The root directory is the fixed region following the FATs on FAT12 and
+	// FAT16, and cluster 2 on FAT32. Either way it holds just the volume label.
+	root_dir_loc := (first_data_sector - int64(root_dir_sectors)) * bytes_per_sector
+	root_dir := make([]byte, int64(root_dir_sectors)*bytes_per_sector)
+	if geometry.Type == FAT_TYPE_32 {
+		root_dir = make([]byte, cluster_size)
+	}
+	if geometry.Label != default_volume_label {
+		label_entry := DIR{DIR_name: label[:], DIR_attr: DIR_ATTR_VOLUME_ID}
+		label_entry.DIR_wrt_time, label_entry.DIR_wrt_date = CreateWriteTime()
+		label_entry.encode(root_dir[0:32])
+	}
+	if _, err := w.WriteAt(root_dir, root_dir_loc); err != nil {
+		return nil, fmt.Errorf("failed to write root directory: %w", err)
+	}
+
+	return geometry, nil
+}
+
+/*
+Work out the layout of a volume of size bytes from the format options.
+*/
+func planGeometry(size int64, opts *FormatOptions) (*Geometry, error) {
+	geometry := &Geometry{
+		Type:            opts.Type,
+		BytesPerSector:  opts.SectorSize,
+		ReservedSectors: opts.ReservedSectors,
+		HiddenSectors:   opts.HiddenSectors,
+		NumFATs:         2,
+		VolumeID:        opts.VolumeID,
+		Label:           strings.ToUpper(opts.Label),
+	}
+
+	if geometry.BytesPerSector == 0 {
+		geometry.BytesPerSector = default_sector_size
+	}
+	switch geometry.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid sector size %d", geometry.BytesPerSector)
+	}
+
+	total_sectors := size / int64(geometry.BytesPerSector)
+	if total_sectors > 0xFFFFFFFF {
+		return nil, errors.New("volume too large")
+	}
+	geometry.TotalSectors = uint32(total_sectors)
+
+	if geometry.Type == 0 {
+		switch {
+		case size < 16*1024*1024:
+			geometry.Type = FAT_TYPE_12
+		case size < 512*1024*1024:
+			geometry.Type = FAT_TYPE_16
+		default:
+			geometry.Type = FAT_TYPE_32
+		}
+	}
+
+	switch geometry.Type {
+	case FAT_TYPE_12:
+		geometry.RootEntries = 224
+	case FAT_TYPE_16:
+		geometry.RootEntries = 512
+	case FAT_TYPE_32:
+	default:
+		return nil, fmt.Errorf("invalid FAT type %d", geometry.Type)
+	}
+
+	if geometry.ReservedSectors == 0 {
+		geometry.ReservedSectors = 1
+		if geometry.Type == FAT_TYPE_32 {
+			geometry.ReservedSectors = 32
+		}
+	}
+	if geometry.Type == FAT_TYPE_32 && geometry.ReservedSectors <= backup_bpb_sector+1 {
+		return nil, fmt.Errorf("FAT32 needs more than %d reserved sectors", backup_bpb_sector+1)
+	}
+
+	if geometry.VolumeID == 0 {
+		geometry.VolumeID = uint32(time.Now().Unix())
+	}
+	if geometry.Label == "" {
+		geometry.Label = default_volume_label
+	}
+
+	// Try the requested cluster size, or each candidate size from smallest to
+	// largest, until the count of clusters suits the FAT type.
+	var cluster_sizes []uint32
+	if opts.ClusterSize != 0 {
+		cluster_sizes = []uint32{opts.ClusterSize}
+	} else {
+		cluster_sizes = defaultClusterSizes(geometry.Type, size)
+	}
+
+	var first_err error
+	for _, cluster_size := range cluster_sizes {
+		err := geometry.setClusterSize(cluster_size)
+		if err == nil {
+			return geometry, nil
+		}
+		if first_err == nil {
+			first_err = err
+		}
+	}
+
+	return nil, first_err
+}
+
+/*
+Get the cluster sizes worth trying for a volume, in the order to try them. FAT32
+starts from the sizes Microsoft recommends for the size of the volume.
+*/
+func defaultClusterSizes(fat_type FATType, size int64) []uint32 {
+	var smallest uint32 = 512
+	if fat_type == FAT_TYPE_32 {
+		switch {
+		case size <= 260*1024*1024:
+			smallest = 512
+		case size <= 8*1024*1024*1024:
+			smallest = 4 * 1024
+		case size <= 16*1024*1024*1024:
+			smallest = 8 * 1024
+		case size <= 32*1024*1024*1024:
+			smallest = 16 * 1024
+		default:
+			smallest = 32 * 1024
+		}
+	}
+
+	var cluster_sizes []uint32
+	for cluster_size := smallest; cluster_size <= 64*1024; cluster_size *= 2 {
+		cluster_sizes = append(cluster_sizes, cluster_size)
+	}
+
+	return cluster_sizes
+}
+
+/*
+Size the FATs for the given cluster size, checking the resulting count of
+clusters suits the FAT type.
+*/
+func (geometry *Geometry) setClusterSize(cluster_size uint32) error {
+	bytes_per_sector := uint32(geometry.BytesPerSector)
+	if cluster_size < bytes_per_sector || cluster_size%bytes_per_sector != 0 {
+		return fmt.Errorf("invalid cluster size %d", cluster_size)
+	}
+	sectors_per_cluster := cluster_size / bytes_per_sector
+	if sectors_per_cluster > 128 || sectors_per_cluster&(sectors_per_cluster-1) != 0 {
+		return fmt.Errorf("invalid cluster size %d", cluster_size)
+	}
+
+	root_dir_sectors := ((uint32(geometry.RootEntries) * 32) + (bytes_per_sector - 1)) / bytes_per_sector
+	meta_sectors := uint32(geometry.ReservedSectors) + root_dir_sectors
+	if meta_sectors >= geometry.TotalSectors {
+		return errors.New("volume too small")
+	}
+
+	// Grow the FATs until they can hold an entry for every cluster left over
+	// once they've been taken out of the volume.
+	var fat_sectors uint32 = 0
+	var clusters uint32
+	for {
+		used_sectors := meta_sectors + uint32(geometry.NumFATs)*fat_sectors
+		if used_sectors >= geometry.TotalSectors {
+			return errors.New("volume too small")
+		}
+		clusters = (geometry.TotalSectors - used_sectors) / sectors_per_cluster
+
+		var fat_bytes uint32
+		switch geometry.Type {
+		case FAT_TYPE_12:
+			fat_bytes = (3*(clusters+2) + 1) / 2
+		case FAT_TYPE_16:
+			fat_bytes = 2 * (clusters + 2)
+		default:
+			fat_bytes = 4 * (clusters + 2)
+		}
+
+		needed_sectors := (fat_bytes + bytes_per_sector - 1) / bytes_per_sector
+		if needed_sectors <= fat_sectors {
+			break
+		}
+		fat_sectors = needed_sectors
+	}
+
+	switch {
+	case geometry.Type == FAT_TYPE_12 && clusters >= max_fat12_clusters:
+		return fmt.Errorf("too many clusters for FAT12 with %d byte clusters", cluster_size)
+	case geometry.Type == FAT_TYPE_16 && clusters < max_fat12_clusters:
+		return fmt.Errorf("too few clusters for FAT16 with %d byte clusters", cluster_size)
+	case geometry.Type == FAT_TYPE_16 && clusters >= max_fat16_clusters:
+		return fmt.Errorf("too many clusters for FAT16 with %d byte clusters", cluster_size)
+	case geometry.Type == FAT_TYPE_32 && clusters < max_fat16_clusters:
+		return fmt.Errorf("too few clusters for FAT32 with %d byte clusters", cluster_size)
+	case geometry.Type == FAT_TYPE_32 && clusters > 0x0FFFFFF5:
+		return fmt.Errorf("too many clusters for FAT32 with %d byte clusters", cluster_size)
+	}
+
+	geometry.SectorsPerCluster = uint8(sectors_per_cluster)
+	geometry.FATSectors = fat_sectors
+	geometry.Clusters = clusters
+
+	return nil
+}
+
+/*
+Create the 11 byte volume label stored in the extended BPB and the root directory.
+Only ASCII characters are allowed, as anything else would need the OEM code page
+of whatever reads the volume.
+*/
+func createVolumeLabel(name string) ([11]byte, error) {
+	var label [11]byte
+	for i := range label {
+		label[i] = ' '
+	}
+	for i, c := range name {
+		if c > unicode.MaxASCII || (c != ' ' && !validCharacter(c)) {
+			return label, fmt.Errorf("invalid character %q in volume label", c)
+		}
+		if i >= len(label) {
+			return label, errors.New("volume label longer than 11 characters")
+		}
+		label[i] = byte(c)
+	}
+
+	return label, nil
+}
+
+/*
+Encode the boot sector for a volume with the given geometry.
+*/
+func encodeBootSector(geometry *Geometry, label [11]byte, sector []byte) {
+	common_bpb := CommonBPB{
+		BS_oemname:     [8]byte{'M', 'S', 'W', 'I', 'N', '4', '.', '1'},
+		BPB_bytspersec: geometry.BytesPerSector,
+		BPB_secperclus: geometry.SectorsPerCluster,
+		BPB_rsvdseccnt: geometry.ReservedSectors,
+		BPB_numfats:    geometry.NumFATs,
+		BPB_rootentcnt: geometry.RootEntries,
+		BPB_media:      default_media,
+		BPB_secpertrk:  63,
+		BPB_numheads:   255,
+		BPB_hiddsec:    geometry.HiddenSectors,
+	}
+	if geometry.TotalSectors < 0x10000 && geometry.Type != FAT_TYPE_32 {
+		common_bpb.BPB_totsec16 = uint16(geometry.TotalSectors)
+	} else {
+		common_bpb.BPB_totsec32 = geometry.TotalSectors
+	}
+
+	if geometry.Type == FAT_TYPE_32 {
+		common_bpb.BS_jmpboot = [3]byte{0xEB, 0x58, 0x90}
+		common_bpb.encode(sector)
+
+		extended_bpb := ExtBPBFull{
+			BPB_fatsz32:    geometry.FATSectors,
+			BPB_rootclus:   2,
+			BPB_fsinfo:     1,
+			BPB_bkbootsec:  backup_bpb_sector,
+			BS_drvnum:      0x80,
+			BS_bootsig:     0x29,
+			BS_volid:       geometry.VolumeID,
+			BS_vollab:      label,
+			BS_filsystype:  [8]byte{'F', 'A', 'T', '3', '2', ' ', ' ', ' '},
+			signature_word: [2]byte{0x55, 0xAA},
+		}
+		extended_bpb.encode(sector)
+		return
+	}
+
+	common_bpb.BS_jmpboot = [3]byte{0xEB, 0x3C, 0x90}
+	common_bpb.BPB_fatsz16 = uint16(geometry.FATSectors)
+	common_bpb.encode(sector)
+
+	extended_bpb := ExtBPBMinimal{
+		bs_drvnum:      0x80,
+		bs_bootsig:     0x29,
+		bs_volid:       geometry.VolumeID,
+		bs_vollab:      label,
+		signature_word: [2]byte{0x55, 0xAA},
+	}
+	copy(extended_bpb.bs_filsystype[:], fmt.Sprintf("%-8s", geometry.Type.String()))
+	extended_bpb.encode(sector)
+}
+
+/*
+Encode the FAT of a freshly formatted volume, holding only the media and EOC
+entries, and on FAT32 the root directory's single cluster.
+*/
+func initialFAT(geometry *Geometry) []byte {
+	max_clusters := geometry.Clusters + 2
+	switch geometry.Type {
+	case FAT_TYPE_12:
+		fat := MakeFAT12(max_clusters)
+		fat.SetCluster(0, 0x0F00|uint16(default_media))
+		fat.SetCluster(1, 0x0FFF)
+		return fat.encode()
+	case FAT_TYPE_16:
+		fat := MakeFAT16(max_clusters)
+		fat.SetCluster(0, 0xFF00|uint16(default_media))
+		fat.SetCluster(1, 0xFFFF)
+		return fat.encode()
+	default:
+		fat := MakeFAT32(max_clusters)
+		fat.SetCluster(0, 0x0FFFFF00|uint32(default_media))
+		fat.SetCluster(1, 0x0FFFFFFF)
+		fat.MarkEOC(2)
+		return fat.encode()
+	}
+}
@@ -0,0 +1,86 @@
+package fat
+
+import (
+	"testing"
+
+	"github.com/zni/fslib/internal/utilities"
+)
+
+func TestFormatEachFATType(t *testing.T) {
+	for fat_type, size := range test_image_sizes {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			dev := NewMemDevice(make([]byte, size))
+			opts := &FormatOptions{Type: fat_type, Label: "Data", VolumeID: 0x1234ABCD, HiddenSectors: 63}
+			geometry, err := Format(dev, size, opts)
+			if err != nil {
+				t.Fatalf("Format: %v", err)
+			}
+
+			if geometry.Type != fat_type || geometry.Label != "DATA" || geometry.TotalSectors != uint32(size/512) {
+				t.Errorf("geometry is %+v", *geometry)
+			}
+			switch {
+			case fat_type == FAT_TYPE_12 && geometry.Clusters >= max_fat12_clusters,
+				fat_type == FAT_TYPE_16 && (geometry.Clusters < max_fat12_clusters || geometry.Clusters >= max_fat16_clusters),
+				fat_type == FAT_TYPE_32 && geometry.Clusters < max_fat16_clusters:
+				t.Errorf("%d clusters don't make a %s volume", geometry.Clusters, fat_type)
+			}
+
+			// The label goes in the extended BPB, whose layout depends on the type.
+			image := dev.Bytes()
+			label_offset := 43
+			if fat_type == FAT_TYPE_32 {
+				label_offset = 71
+			}
+			if label := string(image[label_offset : label_offset+11]); label != "DATA       " {
+				t.Errorf("boot sector label is %q", label)
+			}
+			if hidden := utilities.BytesToInt(image[28:32]); hidden != 63 {
+				t.Errorf("BPB_hiddsec is %d, not 63", hidden)
+			}
+
+			vol, err := OpenDevice(dev)
+			if err != nil {
+				t.Fatalf("OpenDevice: %v", err)
+			}
+			if vol.Type() != fat_type {
+				t.Errorf("formatted volume opens as %s", vol.Type())
+			}
+			entries, err := vol.ReadDir("/")
+			if err != nil || len(entries) != 0 {
+				t.Errorf("new root directory holds %d entries, %v", len(entries), err)
+			}
+			assertClean(t, vol)
+		})
+	}
+}
+
+func TestFormatClusterSize(t *testing.T) {
+	size := test_image_sizes[FAT_TYPE_16]
+	geometry, err := Format(NewMemDevice(make([]byte, size)), size, &FormatOptions{Type: FAT_TYPE_16, ClusterSize: 2048})
+	if err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if geometry.SectorsPerCluster != 4 {
+		t.Errorf("2048 byte clusters have %d sectors", geometry.SectorsPerCluster)
+	}
+}
+
+func TestFormatRejectsBadOptions(t *testing.T) {
+	options := map[string]*FormatOptions{
+		"FAT32 too small":  {Type: FAT_TYPE_32},
+		"odd sector size":  {SectorSize: 768},
+		"odd cluster size": {ClusterSize: 3000},
+		"long label":       {Label: "TWELVE CHARS"},
+		"forbidden label":  {Label: "A*B"},
+		"non-ASCII label":  {Label: "DONNÉES"},
+		"non-Latin label":  {Label: "ДАННЫЕ"},
+		"label with a dot": {Label: "A.B"},
+	}
+
+	for name, opts := range options {
+		if _, err := Format(NewMemDevice(make([]byte, 1440*1024)), 1440*1024, opts); err == nil {
+			t.Errorf("%s: Format succeeded", name)
+		}
+	}
+}
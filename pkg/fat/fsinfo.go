@@ -3,7 +3,6 @@ package fat
 import (
 	"errors"
 	"io"
-	"os"
 
 	"github.com/zni/fslib/internal/utilities"
 )
@@ -11,6 +10,7 @@ import (
 const lead_signature uint32 = 0x41615252
 const structure_signature uint32 = 0x61417272
 const trailing_signature uint32 = 0xAA550000
+const unknown_fsinfo_value uint32 = 0xFFFFFFFF
 
 type FSInfo struct {
 	lead_sig   uint32
@@ -20,7 +20,11 @@ type FSInfo struct {
 	trail_sig  uint32
 }
 
-func (fsinfo *FSInfo) Read(f *os.File) error {
+/*
+Read the FSInfo from the sector at the given location on the device.
+*/
+func (fsinfo *FSInfo) Read(dev BlockDevice, loc int64) error {
+	f := io.NewSectionReader(dev, loc, 512)
 	int_ := make([]uint8, 4)
 
 	_, err := f.Read(int_)
@@ -75,53 +79,44 @@ func (fsinfo *FSInfo) Read(f *os.File) error {
 	return nil
 }
 
-func seekToFSInfo(fs *os.File, bpb *CommonBPB) error {
-	if _, err := fs.Seek(int64(bpb.BPB_bytspersec), io.SeekStart); err != nil {
-		return err
-	}
-
-	return nil
+/*
+The location of the FSInfo sector, which directly follows the boot sector.
+*/
+func fsinfoLoc(bpb *CommonBPB) int64 {
+	return int64(bpb.BPB_bytspersec)
 }
 
-func (fsinfo *FSInfo) Write(fs *os.File, bpb *CommonBPB) error {
-	if err := seekToFSInfo(fs, bpb); err != nil {
-		return err
-	}
-
-	_, err := fs.Write(utilities.IntToBytes(fsinfo.lead_sig))
-	if err != nil {
-		return err
-	}
-
-	_, err = fs.Seek(480, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-
-	_, err = fs.Write(utilities.IntToBytes(fsinfo.struc_sig))
-	if err != nil {
-		return err
-	}
-
-	_, err = fs.Write(utilities.IntToBytes(fsinfo.free_count))
-	if err != nil {
-		return err
-	}
-
-	_, err = fs.Write(utilities.IntToBytes(fsinfo.next_free))
-	if err != nil {
-		return err
-	}
-
-	_, err = fs.Seek(12, io.SeekCurrent)
-	if err != nil {
-		return err
-	}
-
-	_, err = fs.Write(utilities.IntToBytes(fsinfo.trail_sig))
-	if err != nil {
-		return err
+/*
+Write the FSInfo's fields to its sector, leaving the reserved bytes as they are.
+*/
+func (fsinfo *FSInfo) Write(dev BlockDevice, bpb *CommonBPB) error {
+	loc := fsinfoLoc(bpb)
+	fields := []struct {
+		offset int64
+		value  uint32
+	}{
+		{0, fsinfo.lead_sig},
+		{484, fsinfo.struc_sig},
+		{488, fsinfo.free_count},
+		{492, fsinfo.next_free},
+		{508, fsinfo.trail_sig},
+	}
+	for _, field := range fields {
+		if _, err := dev.WriteAt(utilities.IntToBytes(field.value), loc+field.offset); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+/*
+Encode the FSInfo into a sector.
+*/
+func (fsinfo *FSInfo) encode(sector []byte) {
+	copy(sector[0:4], utilities.IntToBytes(fsinfo.lead_sig))
+	copy(sector[484:488], utilities.IntToBytes(fsinfo.struc_sig))
+	copy(sector[488:492], utilities.IntToBytes(fsinfo.free_count))
+	copy(sector[492:496], utilities.IntToBytes(fsinfo.next_free))
+	copy(sector[508:512], utilities.IntToBytes(fsinfo.trail_sig))
+}
@@ -0,0 +1,699 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/zni/fslib/internal/utilities"
+	"github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+FileHandle is an open regular file with its own position. It implements
+io.Reader, io.ReaderAt, io.Seeker and io.Closer, and when opened for writing
+io.Writer and io.WriterAt as well.
+*/
+type FileHandle[T FATSystem] struct {
+	fs     T
+	file   *FATFile
+	flag   int
+	offset int64
+	closed bool
+
+	// Set when the FAT has changed and needs to be written out along with the FSInfo.
+	dirty bool
+
+	// The most recently visited cluster in the file's chain, so sequential
+	// reads don't walk the chain from the start every time.
+	cached_index   int64
+	cached_cluster uint32
+}
+
+/*
+Handle is an open regular file on a volume of any FAT type, as returned by the
+Open and OpenFile methods of a Volume.
+*/
+type Handle interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	File() *FATFile
+	Size() int64
+	Truncate(size int64) error
+	Sync() error
+}
+
+var _ Handle = (*FileHandle[*FAT12])(nil)
+var _ Handle = (*FileHandle[*FAT16])(nil)
+var _ Handle = (*FileHandle[*FAT32])(nil)
+
+/*
+Open a handle on the regular file at the path.
+*/
+func (vol *FAT12) Open(file_path string) (Handle, error) {
+	return openFile(vol, "Open", file_path, os.O_RDONLY)
+}
+
+/*
+Open a handle on the regular file at the path, as directed by the os.O_* flags
+in flag. O_CREATE, O_EXCL, O_TRUNC and O_APPEND behave as they do for os.OpenFile.
+*/
+func (vol *FAT12) OpenFile(file_path string, flag int) (Handle, error) {
+	return openFile(vol, "OpenFile", file_path, flag)
+}
+
+/*
+Open a handle on the regular file at the path.
+*/
+func (vol *FAT16) Open(file_path string) (Handle, error) {
+	return openFile(vol, "Open", file_path, os.O_RDONLY)
+}
+
+/*
+Open a handle on the regular file at the path, as directed by the os.O_* flags
+in flag. O_CREATE, O_EXCL, O_TRUNC and O_APPEND behave as they do for os.OpenFile.
+*/
+func (vol *FAT16) OpenFile(file_path string, flag int) (Handle, error) {
+	return openFile(vol, "OpenFile", file_path, flag)
+}
+
+/*
+Open a handle on the regular file at the path.
+*/
+func (vol *FAT32) Open(file_path string) (Handle, error) {
+	return openFile(vol, "Open", file_path, os.O_RDONLY)
+}
+
+/*
+Open a handle on the regular file at the path, as directed by the os.O_* flags
+in flag. O_CREATE, O_EXCL, O_TRUNC and O_APPEND behave as they do for os.OpenFile.
+*/
+func (vol *FAT32) OpenFile(file_path string, flag int) (Handle, error) {
+	return openFile(vol, "OpenFile", file_path, flag)
+}
+
+/*
+Open a handle on the regular file at the path, whatever the FAT type of the
+volume, reporting any failure to find or create it as op.
+*/
+func openFile[T FATSystem](fs T, op string, file_path string, flag int) (Handle, error) {
+	file, err := readFile(fs, file_path)
+	if err != nil && errors.Is(err, common.ErrNotExist) && (flag&os.O_CREATE) != 0 {
+		file, err = createFile(fs, "CreateFile", file_path, bytes.NewReader(nil))
+	} else if err == nil && (flag&(os.O_CREATE|os.O_EXCL)) == (os.O_CREATE|os.O_EXCL) {
+		err = common.ErrExist
+	}
+	if err != nil {
+		return nil, &common.FSError{
+			Op:   op,
+			Path: file_path,
+			Err:  err,
+		}
+	}
+
+	handle, err := OpenHandle(fs, file, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	if (flag & os.O_TRUNC) != 0 {
+		if err := handle.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+
+	return handle, nil
+}
+
+/*
+Open a handle on a regular file that has already been read from the volume, as
+directed by the os.O_* access mode and O_APPEND flags in flag.
+*/
+func OpenHandle[T FATSystem](fs T, file *FATFile, flag int) (*FileHandle[T], error) {
+	if IsDirectory(file.FSSpecificData.DIREntry) {
+		return nil, &common.FileError{
+			Op:   "Open",
+			Path: file.Name,
+			Err:  fmt.Errorf("file must not be a directory"),
+		}
+	}
+
+	first_cluster := utilities.DirClusterToUint(
+		uint(file.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(file.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+
+	return &FileHandle[T]{
+		fs:             fs,
+		file:           file,
+		flag:           flag,
+		cached_index:   0,
+		cached_cluster: first_cluster,
+	}, nil
+}
+
+/*
+Get the file the handle was opened on.
+*/
+func (h *FileHandle[T]) File() *FATFile {
+	return h.file
+}
+
+/*
+Get the size of the file in bytes.
+*/
+func (h *FileHandle[T]) Size() int64 {
+	return int64(h.file.FSSpecificData.DIREntry.DIR_filesize)
+}
+
+/*
+Read from the current position, advancing it by the number of bytes read.
+*/
+func (h *FileHandle[T]) Read(b []byte) (int, error) {
+	if h.closed {
+		return 0, &common.FileError{Op: "Read", Path: h.file.Name, Err: common.ErrClosed}
+	}
+
+	if !h.readable() {
+		return 0, &common.FileError{Op: "Read", Path: h.file.Name, Err: errors.New("not open for reading")}
+	}
+
+	n, err := h.readAt(b, h.offset)
+	h.offset += int64(n)
+	if err != nil && err != io.EOF {
+		return n, &common.FileError{Op: "Read", Path: h.file.Name, Err: err}
+	}
+
+	return n, err
+}
+
+/*
+Read from the given offset without moving the current position.
+*/
+func (h *FileHandle[T]) ReadAt(b []byte, off int64) (int, error) {
+	if h.closed {
+		return 0, &common.FileError{Op: "ReadAt", Path: h.file.Name, Err: common.ErrClosed}
+	}
+	if !h.readable() {
+		return 0, &common.FileError{Op: "ReadAt", Path: h.file.Name, Err: errors.New("not open for reading")}
+	}
+	if off < 0 {
+		return 0, &common.FileError{Op: "ReadAt", Path: h.file.Name, Err: errors.New("negative offset")}
+	}
+
+	n, err := h.readAt(b, off)
+	if err != nil && err != io.EOF {
+		return n, &common.FileError{Op: "ReadAt", Path: h.file.Name, Err: err}
+	}
+
+	// ReadAt must explain a short read.
+	if n < len(b) && err == nil {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+/*
+Set the position for the next Read.
+*/
+func (h *FileHandle[T]) Seek(offset int64, whence int) (int64, error) {
+	if h.closed {
+		return 0, &common.FileError{Op: "Seek", Path: h.file.Name, Err: common.ErrClosed}
+	}
+
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = h.offset + offset
+	case io.SeekEnd:
+		position = h.Size() + offset
+	default:
+		return 0, &common.FileError{Op: "Seek", Path: h.file.Name, Err: errors.New("invalid whence")}
+	}
+
+	if position < 0 {
+		return 0, &common.FileError{Op: "Seek", Path: h.file.Name, Err: errors.New("negative position")}
+	}
+	h.offset = position
+
+	return position, nil
+}
+
+/*
+Write at the current position, advancing it by the number of bytes written.
+With O_APPEND, every write goes to the end of the file.
+*/
+func (h *FileHandle[T]) Write(b []byte) (int, error) {
+	if err := h.checkWritable("Write"); err != nil {
+		return 0, err
+	}
+
+	if (h.flag & os.O_APPEND) != 0 {
+		h.offset = h.Size()
+	}
+
+	n, err := h.writeAt(b, h.offset)
+	h.offset += int64(n)
+	if err != nil {
+		return n, &common.FileError{Op: "Write", Path: h.file.Name, Err: err}
+	}
+
+	return n, nil
+}
+
+/*
+Write at the given offset without moving the current position. Writing past
+the end of the file fills the gap with zeroes.
+*/
+func (h *FileHandle[T]) WriteAt(b []byte, off int64) (int, error) {
+	if err := h.checkWritable("WriteAt"); err != nil {
+		return 0, err
+	}
+	if (h.flag & os.O_APPEND) != 0 {
+		return 0, &common.FileError{Op: "WriteAt", Path: h.file.Name, Err: errors.New("invalid use of WriteAt on file opened with O_APPEND")}
+	}
+	if off < 0 {
+		return 0, &common.FileError{Op: "WriteAt", Path: h.file.Name, Err: errors.New("negative offset")}
+	}
+
+	n, err := h.writeAt(b, off)
+	if err != nil {
+		return n, &common.FileError{Op: "WriteAt", Path: h.file.Name, Err: err}
+	}
+
+	return n, nil
+}
+
+/*
+Change the size of the file. Growing the file fills the new space with zeroes,
+shrinking it hands the clusters past the new end back to the FAT.
+*/
+func (h *FileHandle[T]) Truncate(size int64) error {
+	if err := h.checkWritable("Truncate"); err != nil {
+		return err
+	}
+	if size < 0 || size > math.MaxUint32 {
+		return &common.FileError{Op: "Truncate", Path: h.file.Name, Err: errors.New("invalid size")}
+	}
+
+	file_size := h.Size()
+	if size < file_size {
+		if err := h.shrinkChain(size); err != nil {
+			return &common.FileError{Op: "Truncate", Path: h.file.Name, Err: err}
+		}
+
+		// The DIR entry goes out before the FAT when shrinking, so it never
+		// points at clusters the FAT on disk has as free.
+		if err := h.updateDIR(size); err != nil {
+			return &common.FileError{Op: "Truncate", Path: h.file.Name, Err: err}
+		}
+		if err := h.syncFAT(); err != nil {
+			return &common.FileError{Op: "Truncate", Path: h.file.Name, Err: err}
+		}
+
+		return nil
+	}
+
+	if size > file_size {
+		if err := h.zeroFill(file_size, size); err != nil {
+			return &common.FileError{Op: "Truncate", Path: h.file.Name, Err: h.keepSize(file_size, err)}
+		}
+	}
+
+	if err := h.commitSize(size); err != nil {
+		return &common.FileError{Op: "Truncate", Path: h.file.Name, Err: err}
+	}
+
+	return nil
+}
+
+/*
+Write out any changes to the FAT and FSInfo made through the handle.
+*/
+func (h *FileHandle[T]) Sync() error {
+	if h.closed {
+		return &common.FileError{Op: "Sync", Path: h.file.Name, Err: common.ErrClosed}
+	}
+
+	if err := h.syncFAT(); err != nil {
+		return &common.FileError{Op: "Sync", Path: h.file.Name, Err: err}
+	}
+
+	return nil
+}
+
+/*
+Close the handle, writing out any outstanding changes. Any further use of it fails.
+*/
+func (h *FileHandle[T]) Close() error {
+	if h.closed {
+		return &common.FileError{Op: "Close", Path: h.file.Name, Err: common.ErrClosed}
+	}
+
+	err := h.Sync()
+	h.closed = true
+
+	return err
+}
+
+func (h *FileHandle[T]) readable() bool {
+	return (h.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)) != os.O_WRONLY
+}
+
+func (h *FileHandle[T]) checkWritable(op string) error {
+	if h.closed {
+		return &common.FileError{Op: op, Path: h.file.Name, Err: common.ErrClosed}
+	}
+	if (h.flag & (os.O_WRONLY | os.O_RDWR)) == 0 {
+		return &common.FileError{Op: op, Path: h.file.Name, Err: errors.New("not open for writing")}
+	}
+
+	return nil
+}
+
+/*
+Write b out starting at off, growing the file's cluster chain as needed.
+*/
+func (h *FileHandle[T]) writeAt(b []byte, off int64) (int, error) {
+	end := off + int64(len(b))
+	if end > math.MaxUint32 {
+		return 0, errors.New("file larger than 4GiB")
+	}
+
+	file_size := h.Size()
+	if off > file_size {
+		if err := h.zeroFill(file_size, off); err != nil {
+			return 0, h.keepSize(file_size, err)
+		}
+	}
+
+	n, err := h.writeContents(b, off)
+	new_size := file_size
+	if n > 0 {
+		new_size = max(file_size, off+int64(n))
+	}
+	if err != nil {
+		return n, h.keepSize(new_size, err)
+	}
+
+	if err := h.commitSize(new_size); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+/*
+Give up on growing the file after a failure, keeping the first size bytes of it
+and handing back any clusters allocated past them.
+*/
+func (h *FileHandle[T]) keepSize(size int64, err error) error {
+	if trim_err := h.shrinkChain(size); trim_err != nil {
+		return fmt.Errorf("%w, and failed to free the clusters allocated: %w", err, trim_err)
+	}
+	if commit_err := h.commitSize(size); commit_err != nil {
+		return fmt.Errorf("%w, and failed to record the file size: %w", err, commit_err)
+	}
+
+	return err
+}
+
+/*
+Record the size of a file that may have grown, writing out the FAT before the
+DIR entry, so the DIR entry never points at clusters the FAT on disk has as
+free.
+*/
+func (h *FileHandle[T]) commitSize(size int64) error {
+	if err := h.syncFAT(); err != nil {
+		return err
+	}
+
+	return h.updateDIR(size)
+}
+
+/*
+Write out the FAT and FSInfo, if they've changed.
+*/
+func (h *FileHandle[T]) syncFAT() error {
+	if !h.dirty {
+		return nil
+	}
+	if err := SyncFileSystemData(h.fs); err != nil {
+		return err
+	}
+	h.dirty = false
+
+	return nil
+}
+
+/*
+Fill the range [from, to) of the file with zeroes.
+*/
+func (h *FileHandle[T]) zeroFill(from int64, to int64) error {
+	zeroes := make([]byte, ClusterSize(h.fs))
+	for from < to {
+		chunk := min(int64(len(zeroes)), to-from)
+		n, err := h.writeContents(zeroes[:chunk], from)
+		if err != nil {
+			return err
+		}
+		from += int64(n)
+	}
+
+	return nil
+}
+
+/*
+Write b out starting at off, cluster by cluster, without touching the DIR entry.
+*/
+func (h *FileHandle[T]) writeContents(b []byte, off int64) (int, error) {
+	cluster_size := int64(ClusterSize(h.fs))
+	if err := h.growChain((off + int64(len(b)) + cluster_size - 1) / cluster_size); err != nil {
+		return 0, err
+	}
+
+	disk_ref := h.fs.GetDiskRef()
+	total_bytes_written := 0
+	for total_bytes_written < len(b) {
+		cluster, err := h.clusterAt(off / cluster_size)
+		if err != nil {
+			return total_bytes_written, err
+		}
+
+		// Write up to the end of this cluster or the end of the buffer.
+		cluster_offset := off % cluster_size
+		write_size := min(cluster_size-cluster_offset, int64(len(b)-total_bytes_written))
+
+		cluster_loc := int64(LookupClusterBytes(h.fs, cluster)) + cluster_offset
+		bytes_written, err := disk_ref.WriteAt(b[total_bytes_written:total_bytes_written+int(write_size)], cluster_loc)
+		total_bytes_written += bytes_written
+		off += int64(bytes_written)
+		if err != nil {
+			return total_bytes_written, fmt.Errorf("failed to write contents after %d bytes: %w", total_bytes_written, err)
+		}
+	}
+
+	return total_bytes_written, nil
+}
+
+/*
+Make sure the file's cluster chain holds at least count clusters, allocating
+and zeroing new clusters on the end of it.
+*/
+func (h *FileHandle[T]) growChain(count int64) error {
+	// The chain already covers the current size of the file.
+	cluster_size := int64(ClusterSize(h.fs))
+	if count <= (h.Size()+cluster_size-1)/cluster_size {
+		return nil
+	}
+
+	dir_entry := h.file.FSSpecificData.DIREntry
+	first_cluster := utilities.DirClusterToUint(uint(dir_entry.DIR_cluster_lo), uint(dir_entry.DIR_cluster_hi))
+
+	// An empty file has no chain at all yet.
+	if first_cluster == 0 {
+		cluster, err := h.allocateCluster(2)
+		if err != nil {
+			return err
+		}
+		dir_entry.DIR_cluster_lo = uint16(cluster & 0x0000FFFF)
+		dir_entry.DIR_cluster_hi = uint16((cluster & 0xFFFF0000) >> 16)
+		h.cached_index = 0
+		h.cached_cluster = cluster
+	}
+
+	// Walk to the current end of the chain.
+	for {
+		next_cluster, end := NextCluster(h.fs, h.cached_cluster)
+		if end {
+			break
+		}
+		h.cached_cluster = next_cluster
+		h.cached_index++
+	}
+
+	for h.cached_index+1 < count {
+		cluster, err := h.allocateCluster(h.cached_cluster + 1)
+		if err != nil {
+			return err
+		}
+		LinkCluster(h.fs, h.cached_cluster, cluster)
+		h.cached_cluster = cluster
+		h.cached_index++
+	}
+
+	return nil
+}
+
+/*
+Allocate and zero a single cluster.
+*/
+func (h *FileHandle[T]) allocateCluster(start uint32) (uint32, error) {
+	cluster, err := AllocateCluster(h.fs, start)
+	if err != nil {
+		return 0, err
+	}
+	UpdateFSInfo(h.fs, 1)
+	h.dirty = true
+
+	// The cluster isn't linked to anything yet, so it has to be handed back
+	// here or it's lost.
+	if err := ZeroCluster(h.fs, LookupClusterBytes(h.fs, cluster)); err != nil {
+		LinkCluster(h.fs, cluster, 0)
+		UpdateFSInfo(h.fs, -1)
+		return 0, fmt.Errorf("failed to zero cluster: %w", err)
+	}
+
+	return cluster, nil
+}
+
+/*
+Cut the file's cluster chain down to what is needed to hold size bytes.
+*/
+func (h *FileHandle[T]) shrinkChain(size int64) error {
+	dir_entry := h.file.FSSpecificData.DIREntry
+	first_cluster := utilities.DirClusterToUint(uint(dir_entry.DIR_cluster_lo), uint(dir_entry.DIR_cluster_hi))
+	if first_cluster == 0 {
+		return nil
+	}
+
+	cluster_size := int64(ClusterSize(h.fs))
+	count := (size + cluster_size - 1) / cluster_size
+
+	var freed int
+	if count == 0 {
+		freed = FreeChain(h.fs, first_cluster)
+		dir_entry.DIR_cluster_lo = 0
+		dir_entry.DIR_cluster_hi = 0
+		h.cached_index = 0
+		h.cached_cluster = 0
+	} else {
+		last_cluster, err := h.clusterAt(count - 1)
+		if err != nil {
+			return err
+		}
+		next_cluster, end := NextCluster(h.fs, last_cluster)
+		if !end {
+			freed = FreeChain(h.fs, next_cluster)
+		}
+		MarkEOC(h.fs, last_cluster)
+	}
+
+	if freed > 0 {
+		UpdateFSInfo(h.fs, -freed)
+		h.dirty = true
+	}
+
+	return nil
+}
+
+/*
+Record the new file size and write time in the file's DIR entry on disk.
+*/
+func (h *FileHandle[T]) updateDIR(size int64) error {
+	dir_entry := h.file.FSSpecificData.DIREntry
+	dir_entry.DIR_filesize = uint32(size)
+	dir_entry.DIR_wrt_time, dir_entry.DIR_wrt_date = CreateWriteTime()
+
+	if _, err := WriteDIR(h.fs.GetDiskRef(), dir_entry, h.file.FSSpecificData.DIR_loc); err != nil {
+		return fmt.Errorf("failed to write DIR entry: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Read up to len(b) bytes starting at off, stopping with io.EOF at the end of the file.
+*/
+func (h *FileHandle[T]) readAt(b []byte, off int64) (int, error) {
+	file_size := h.Size()
+	if off >= file_size {
+		return 0, io.EOF
+	}
+
+	cluster_size := int64(ClusterSize(h.fs))
+	disk_ref := h.fs.GetDiskRef()
+
+	total_bytes_read := 0
+	for total_bytes_read < len(b) && off < file_size {
+		cluster, err := h.clusterAt(off / cluster_size)
+		if err != nil {
+			return total_bytes_read, err
+		}
+
+		// Read up to the end of this cluster, the end of the file, or the
+		// end of the buffer, whichever comes first.
+		cluster_offset := off % cluster_size
+		read_size := min(cluster_size-cluster_offset, file_size-off, int64(len(b)-total_bytes_read))
+
+		cluster_loc := int64(LookupClusterBytes(h.fs, cluster)) + cluster_offset
+		bytes_read, err := disk_ref.ReadAt(b[total_bytes_read:total_bytes_read+int(read_size)], cluster_loc)
+		total_bytes_read += bytes_read
+		off += int64(bytes_read)
+		if err != nil {
+			return total_bytes_read, fmt.Errorf("failed to read contents after %d bytes: %w", total_bytes_read, err)
+		}
+	}
+
+	if off >= file_size {
+		return total_bytes_read, io.EOF
+	}
+
+	return total_bytes_read, nil
+}
+
+/*
+Walk the file's cluster chain to find the cluster holding the index'th cluster
+worth of the file's contents.
+*/
+func (h *FileHandle[T]) clusterAt(index int64) (uint32, error) {
+	if index < h.cached_index {
+		h.cached_index = 0
+		h.cached_cluster = utilities.DirClusterToUint(
+			uint(h.file.FSSpecificData.DIREntry.DIR_cluster_lo),
+			uint(h.file.FSSpecificData.DIREntry.DIR_cluster_hi),
+		)
+	}
+
+	for h.cached_index < index {
+		next_cluster, end := NextCluster(h.fs, h.cached_cluster)
+		if end {
+			return 0, errors.New("cluster chain shorter than file size")
+		}
+		h.cached_cluster = next_cluster
+		h.cached_index++
+	}
+
+	return h.cached_cluster, nil
+}
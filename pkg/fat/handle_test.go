@@ -0,0 +1,290 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+func TestOpenFileOnEachFATType(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			var vol Volume = newFixture(t, fat_type)
+
+			handle, err := vol.OpenFile("/new.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL)
+			if err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+			if _, err := io.WriteString(handle, "written through a handle"); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := handle.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if _, err := vol.OpenFile("/new.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL); err == nil {
+				t.Errorf("OpenFile with O_EXCL opened an existing file")
+			}
+
+			handle, err = vol.Open("/NEW.TXT")
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer handle.Close()
+			contents, err := io.ReadAll(handle)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if string(contents) != "written through a handle" {
+				t.Errorf("read back %q", contents)
+			}
+			if _, err := handle.Write([]byte("x")); err == nil {
+				t.Errorf("Write succeeded on a handle opened read only")
+			}
+			assertClean(t, vol)
+		})
+	}
+}
+
+/*
+A device that fails writes to a range of bytes once a number of them have
+succeeded.
+*/
+type failingDevice struct {
+	*MemDevice
+	from, to   int64
+	fail_after int
+}
+
+func (dev *failingDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off < dev.to && off+int64(len(b)) > dev.from {
+		if dev.fail_after == 0 {
+			return 0, errors.New("injected write failure")
+		}
+		dev.fail_after--
+	}
+
+	return dev.MemDevice.WriteAt(b, off)
+}
+
+func TestHandleWritesFATBeforeSync(t *testing.T) {
+	mem := newFixture(t, FAT_TYPE_16)
+
+	handle, err := mem.OpenFile("/grown.bin", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := handle.Write(contents); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Without a Sync or Close, the image must already hold a consistent
+	// volume.
+	reloaded, err := LoadBytes(bytes.Clone(mem.Bytes()))
+	if err != nil {
+		t.Fatalf("LoadBytes: %v", err)
+	}
+	assertClean(t, reloaded)
+	file, err := reloaded.ReadFile("/grown.bin")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if _, err := reloaded.ReadAll(file); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(file.Content, contents) {
+		t.Errorf("read back %d bytes that differ from the %d written", len(file.Content), len(contents))
+	}
+}
+
+func TestHandleWriteFailureFreesClusters(t *testing.T) {
+	// The first write to the new cluster zeroes it, the second fills it.
+	for fail_after := 0; fail_after < 2; fail_after++ {
+		mem := newFixture(t, FAT_TYPE_16)
+		vol := mem.Volume.(*FAT16)
+		if _, err := vol.CreateFile("/empty.bin", nil); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+
+		cluster, err := NextFreeCluster(vol)
+		if err != nil {
+			t.Fatalf("NextFreeCluster: %v", err)
+		}
+		from := int64(LookupClusterBytes(vol, cluster))
+		dev := &failingDevice{MemDevice: mem.dev, from: from, to: from + int64(ClusterSize(vol)), fail_after: fail_after}
+		vol.DiskRef = dev
+
+		handle, err := vol.OpenFile("/empty.bin", os.O_RDWR)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		if _, err := handle.Write([]byte("never written")); err == nil {
+			t.Fatalf("Write succeeded on a failing device")
+		}
+		if size := handle.Size(); size != 0 {
+			t.Errorf("file is %d bytes after a failed write", size)
+		}
+
+		vol.DiskRef = mem.dev
+		assertClean(t, vol)
+		reloaded, err := LoadBytes(bytes.Clone(mem.Bytes()))
+		if err != nil {
+			t.Fatalf("LoadBytes: %v", err)
+		}
+		assertClean(t, reloaded)
+	}
+}
+
+func TestHandleTruncateAndAppend(t *testing.T) {
+	mem := newFixture(t, FAT_TYPE_12)
+	cluster_size := int64(ClusterSize(mem.Volume.(*FAT12)))
+
+	handle, err := mem.OpenFile("/hello.txt", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	// Growing fills the new space with zeroes, over several clusters.
+	if err := handle.Truncate(3 * cluster_size); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	tail := make([]byte, 10)
+	if n, err := handle.ReadAt(tail, 3*cluster_size-10); n != len(tail) {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(tail, make([]byte, 10)) {
+		t.Errorf("grown file ends in %q, not zeroes", tail)
+	}
+	assertClean(t, mem)
+
+	// Shrinking hands clusters back.
+	if err := handle.Truncate(5); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if err := handle.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	assertClean(t, mem)
+
+	handle, err = mem.OpenFile("/hello.txt", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := handle.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if _, err := io.WriteString(handle, ", again"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := handle.WriteAt([]byte("x"), 0); err == nil {
+		t.Errorf("WriteAt succeeded on a handle opened with O_APPEND")
+	}
+	handle.Close()
+
+	file, err := mem.ReadFile("/hello.txt")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if _, err := mem.ReadAll(file); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(file.Content) != "hello, again" {
+		t.Errorf("file holds %q", file.Content)
+	}
+
+	// O_TRUNC empties the file and frees its chain.
+	handle, err = mem.OpenFile("/hello.txt", os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if handle.Size() != 0 || handle.File().FSSpecificData.DIREntry.DIR_cluster_lo != 0 {
+		t.Errorf("O_TRUNC left %d bytes in the file", handle.Size())
+	}
+	handle.Close()
+	assertClean(t, mem)
+}
+
+func TestHandleSeekAndReadAt(t *testing.T) {
+	vol := newFixtureFAT32(t)
+	cluster_size := int64(ClusterSize(vol))
+
+	// A few clusters and a bit, with no two nearby bytes alike.
+	contents := make([]byte, 3*cluster_size+cluster_size/2)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+	if _, err := vol.CreateFile("/docs/big.bin", contents); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	handle, err := vol.Open("/docs/big.bin")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := iotest.TestReader(handle, contents); err != nil {
+		t.Errorf("TestReader: %v", err)
+	}
+
+	// Reads across a cluster boundary, then back to an earlier cluster.
+	size := int64(len(contents))
+	for _, off := range []int64{2*cluster_size - 5, cluster_size - 5, 0} {
+		b := make([]byte, 10)
+		if n, err := handle.ReadAt(b, off); n != len(b) || err != nil {
+			t.Errorf("ReadAt(%d) read %d bytes, %v", off, n, err)
+		}
+		if !bytes.Equal(b, contents[off:off+10]) {
+			t.Errorf("ReadAt(%d) read %v, not %v", off, b, contents[off:off+10])
+		}
+	}
+
+	// A read running off the end is short, and says why.
+	b := make([]byte, 10)
+	if n, err := handle.ReadAt(b, size-3); n != 3 || err != io.EOF {
+		t.Errorf("ReadAt near the end read %d bytes, %v", n, err)
+	}
+	if n, err := handle.ReadAt(b, size); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end read %d bytes, %v", n, err)
+	}
+	if _, err := handle.ReadAt(b, -1); err == nil || err == io.EOF {
+		t.Errorf("ReadAt a negative offset gave %v", err)
+	}
+
+	// ReadAt leaves the position alone, while Read and Seek move it.
+	if position, err := handle.Seek(-10, io.SeekEnd); position != size-10 || err != nil {
+		t.Fatalf("Seek from the end went to %d, %v", position, err)
+	}
+	if n, err := handle.Read(b); n != 10 || !bytes.Equal(b, contents[size-10:]) {
+		t.Errorf("Read of the last 10 bytes read %d bytes %v, %v", n, b[:n], err)
+	}
+	if n, err := handle.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end read %d bytes, %v", n, err)
+	}
+	if position, err := handle.Seek(5, io.SeekCurrent); position != size+5 || err != nil {
+		t.Fatalf("Seek past the end went to %d, %v", position, err)
+	}
+	if n, err := handle.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read past the end read %d bytes, %v", n, err)
+	}
+	if _, err := handle.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seek to a negative position succeeded")
+	}
+	if _, err := handle.Seek(0, 3); err == nil {
+		t.Errorf("Seek with an invalid whence succeeded")
+	}
+	if position, _ := handle.Seek(0, io.SeekCurrent); position != size+5 {
+		t.Errorf("failed Seeks moved the position to %d", position)
+	}
+
+	if err := handle.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := handle.Read(b); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Read after Close gave %v, not ErrClosed", err)
+	}
+}
@@ -0,0 +1,288 @@
+package fat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+FS adapts a FAT12, FAT16 or FAT32 volume to the io/fs interfaces so it can be
+handed to any code that accepts an fs.FS.
+*/
+type FS struct {
+	vol Volume
+}
+
+/*
+Wrap a loaded volume in an fs.FS.
+*/
+func NewFS(vol Volume) *FS {
+	return &FS{vol}
+}
+
+/*
+Open the named file or directory for reading.
+*/
+func (fsys *FS) Open(name string) (fs.File, error) {
+	file, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &fileInfo{entryName(name, file), file.FSSpecificData.DIREntry}
+	if info.IsDir() {
+		return &dirFile{fsys: fsys, file_path: volumePath(name), info: info}, nil
+	}
+
+	handle, err := fsys.vol.Open(volumePath(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &regularFile{Handle: handle, info: info}, nil
+}
+
+/*
+Return the FileInfo describing the named file.
+*/
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	file, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{entryName(name, file), file.FSSpecificData.DIREntry}, nil
+}
+
+/*
+Read the named directory and return its entries sorted by name.
+*/
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	file, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !IsDirectory(file.FSSpecificData.DIREntry) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := fsys.readDirEntries(volumePath(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return entries, nil
+}
+
+/*
+Read the named file's complete contents.
+*/
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	file, err := fsys.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsDirectory(file.FSSpecificData.DIREntry) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+
+	if _, err := fsys.vol.ReadAll(file); err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+
+	return file.Content, nil
+}
+
+/*
+Resolve an io/fs style path against the volume.
+*/
+func (fsys *FS) lookup(op string, name string) (*FATFile, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	file, err := fsys.vol.ReadFile(volumePath(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return file, nil
+}
+
+/*
+Build the sorted DirEntry list for the directory at the volume path.
+*/
+func (fsys *FS) readDirEntries(dir_path string) ([]fs.DirEntry, error) {
+	files, err := fsys.vol.ReadDir(dir_path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, &fileInfo{f.Name, f.FSSpecificData.DIREntry})
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries, nil
+}
+
+/*
+Get the volume path of a valid io/fs style path.
+*/
+func volumePath(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
+
+/*
+Get the name to report for a file looked up by the given path. Lookups ignore
+case, so the name is taken from the entry to keep its on-disk casing, except
+for the root directory which has no entry.
+*/
+func entryName(name string, file *FATFile) string {
+	if file.FSSpecificData.DIR_loc == 0 {
+		return baseName(name)
+	}
+	return file.Name
+}
+
+/*
+Get the last element of an io/fs style path.
+*/
+func baseName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+/*
+fileInfo describes a DIR entry as both an fs.FileInfo and an fs.DirEntry.
+*/
+type fileInfo struct {
+	name string
+	dir  *DIR
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+func (fi *fileInfo) Size() int64  { return int64(fi.dir.DIR_filesize) }
+func (fi *fileInfo) IsDir() bool  { return IsDirectory(fi.dir) }
+func (fi *fileInfo) Sys() any     { return fi.dir }
+
+func (fi *fileInfo) ModTime() time.Time {
+	return ModTime(fi.dir)
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	var mode fs.FileMode = 0666
+	if (fi.dir.DIR_attr & DIR_ATTR_READONLY) == DIR_ATTR_READONLY {
+		mode = 0444
+	}
+	if fi.IsDir() {
+		mode |= fs.ModeDir | 0111
+	}
+
+	return mode
+}
+
+func (fi *fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+func (fi *fileInfo) String() string             { return fs.FormatFileInfo(fi) }
+
+/*
+regularFile is an open file, read through a Handle.
+*/
+type regularFile struct {
+	Handle
+	info   *fileInfo
+	closed bool
+}
+
+func (f *regularFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.info.name, Err: fs.ErrClosed}
+	}
+	return f.info, nil
+}
+
+func (f *regularFile) Close() error {
+	f.closed = true
+	return f.Handle.Close()
+}
+
+/*
+dirFile is an open directory whose entries are read in on first use.
+*/
+type dirFile struct {
+	fsys      *FS
+	file_path string
+	info      *fileInfo
+	entries   []fs.DirEntry
+	offset    int
+	loaded    bool
+	closed    bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "stat", Path: d.info.name, Err: fs.ErrClosed}
+	}
+	return d.info, nil
+}
+
+func (d *dirFile) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.info.name, Err: fs.ErrClosed}
+	}
+
+	if !d.loaded {
+		entries, err := d.fsys.readDirEntries(d.file_path)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.info.name, Err: err}
+		}
+		d.entries = entries
+		d.loaded = true
+	}
+
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+
+	return remaining[:n], nil
+}
+
+func (d *dirFile) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.info.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,72 @@
+package fat
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+/*
+Format a volume of the given FAT type in memory holding a small tree of files
+and directories.
+*/
+func newFixture(t *testing.T, fat_type FATType) *MemVolume {
+	t.Helper()
+
+	mem, err := NewMemVolume(test_image_sizes[fat_type], &FormatOptions{Type: fat_type})
+	if err != nil {
+		t.Fatalf("NewMemVolume: %v", err)
+	}
+
+	for _, dir := range []string{"/docs", "/docs/nested", "/empty"} {
+		if _, err := mem.CreateDir(dir); err != nil {
+			t.Fatalf("CreateDir(%q): %v", dir, err)
+		}
+	}
+	files := map[string]string{
+		"/hello.txt":                        "hello, world\n",
+		"/docs/readme.md":                   "# readme\n",
+		"/docs/nested/A Long File Name.txt": "a file with a long name\n",
+		"/zero":                             "",
+	}
+	for name, contents := range files {
+		if _, err := mem.CreateFile(name, []byte(contents)); err != nil {
+			t.Fatalf("CreateFile(%q): %v", name, err)
+		}
+	}
+
+	return mem
+}
+
+/*
+Format a FAT32 volume in memory holding a small tree of files and directories.
+*/
+func newFixtureFAT32(t *testing.T) *FAT32 {
+	t.Helper()
+
+	mem := newFixture(t, FAT_TYPE_32)
+	vol, ok := mem.Volume.(*FAT32)
+	if !ok {
+		t.Fatalf("volume is %T, not *FAT32", mem.Volume)
+	}
+
+	return vol
+}
+
+func TestFSPassesFSTest(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			fsys := NewFS(newFixture(t, fat_type))
+
+			err := fstest.TestFS(fsys,
+				"hello.txt",
+				"zero",
+				"empty",
+				"docs/readme.md",
+				"docs/nested/A Long File Name.txt",
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"os"
 	"slices"
-	"strings"
 	"unicode/utf16"
 
 	"github.com/zni/fslib/internal/utilities"
@@ -27,9 +25,10 @@ type LDIR struct {
 }
 
 /*
-Read a single LDIR entry from the volume.
+Read the LDIR entry at the location loc on disk.
 */
-func ReadLDIR(fs *os.File) (*LDIR, error) {
+func ReadLDIR(dev BlockDevice, loc int64) (*LDIR, error) {
+	fs := io.NewSectionReader(dev, loc, 32)
 	var name_part LDIR
 	var byte_ []uint8 = make([]uint8, 1)
 	var short_ []uint8 = make([]uint8, 2)
@@ -89,27 +88,23 @@ func ReadLDIR(fs *os.File) (*LDIR, error) {
 Join an array of LDIRs into a string containing the filename.
 */
 func joinLDIRs(ldirs []*LDIR) string {
-	slices.Reverse(ldirs)
-	var name []byte = make([]byte, 0, 255)
-	for _, l := range ldirs {
-		name0 := [][]uint8{l.name1, l.name2, l.name3}
-
-		byte_name := bytes.Join(name0, []uint8{})
-		name = append(name, byte_name...)
-	}
-	name = bytes.Trim(name, "\xff")
+	// LDIRs are stored in reverse order, so walk them backwards.
 	var name_utf16 []uint16
-	for i := 0; i < len(name); {
-		name_hi := uint16(name[i])
-		name_lo := uint16(name[i+1])
-		codepoint := (name_lo << 8) | name_hi
-		name_utf16 = append(name_utf16, codepoint)
-		i += 2
+	for i := len(ldirs) - 1; i >= 0; i-- {
+		l := ldirs[i]
+		name := bytes.Join([][]uint8{l.name1, l.name2, l.name3}, []uint8{})
+		for j := 0; j+1 < len(name); j += 2 {
+			codepoint := utilities.BytesToShort(name[j : j+2])
+
+			// The name is terminated by 0x0000 and padded out with 0xFFFF.
+			if codepoint == 0x0000 {
+				return string(utf16.Decode(name_utf16))
+			}
+			name_utf16 = append(name_utf16, codepoint)
+		}
 	}
 
-	filename := string(utf16.Decode(name_utf16))
-	filename = strings.Trim(filename, "\x00")
-	return filename
+	return string(utf16.Decode(name_utf16))
 }
 
 /*
@@ -197,41 +192,28 @@ func CreateLDIRs(name string, chksum uint8) ([]*LDIR, error) {
 /*
 Write out an array of LDIRs to the location loc on disk.
 */
-func WriteLDIRs(fs *os.File, ldirs []*LDIR, loc int64) (uint32, error) {
-	if _, err := fs.Seek(loc, io.SeekStart); err != nil {
+func WriteLDIRs(dev BlockDevice, ldirs []*LDIR, loc int64) (uint32, error) {
+	slots := make([]byte, 32*len(ldirs))
+	for i, ldir := range ldirs {
+		ldir.encode(slots[32*i : 32*(i+1)])
+	}
+	if _, err := dev.WriteAt(slots, loc); err != nil {
 		return 0, err
 	}
 
-	for _, ldir := range ldirs {
-		if _, err := fs.Write([]byte{ldir.ordinal}); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write(ldir.name1); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write([]byte{ldir.attr}); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write([]byte{ldir.ltype}); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write([]byte{ldir.chksum}); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write(ldir.name2); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write(utilities.ShortToBytes(ldir.cluster_lo)); err != nil {
-			return 0, err
-		}
-		if _, err := fs.Write(ldir.name3); err != nil {
-			return 0, err
-		}
-	}
+	return uint32(loc) + uint32(len(slots)), nil
+}
 
-	ldir_end_loc, err := fs.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, err
-	}
-	return uint32(ldir_end_loc), nil
+/*
+Encode an LDIR entry into a 32 byte directory slot.
+*/
+func (ldir *LDIR) encode(slot []byte) {
+	slot[0] = ldir.ordinal
+	copy(slot[1:11], ldir.name1)
+	slot[11] = ldir.attr
+	slot[12] = ldir.ltype
+	slot[13] = ldir.chksum
+	copy(slot[14:26], ldir.name2)
+	copy(slot[26:28], utilities.ShortToBytes(ldir.cluster_lo))
+	copy(slot[28:32], ldir.name3)
 }
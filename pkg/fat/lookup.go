@@ -0,0 +1,191 @@
+package fat
+
+import (
+	"fmt"
+	"iter"
+	"strings"
+
+	"github.com/zni/fslib/internal/utilities"
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+Read a file from the volume given by the path.
+*/
+func readFile[T FATSystem](vol T, file_path string) (*FATFile, error) {
+	// Split the path on forward slashes.
+	// If we only have one element '/', which becomes "", then return.
+	segmented_path := strings.Split(file_path, "/")
+	if segmented_path[0] == "" && len(segmented_path) == 1 {
+		return nil, &fs.FSError{
+			Op:   "ReadFile",
+			Path: file_path,
+			Err:  fmt.Errorf("no file specified"),
+		}
+	}
+
+	// Start in the root directory, which has no entry of its own.
+	file := rootDir(vol)
+	for _, s := range segmented_path {
+		// If we have a leftover from the slash split, just continue.
+		if s == "" {
+			continue
+		}
+
+		// Only a directory can be descended into.
+		if !IsDirectory(file.FSSpecificData.DIREntry) {
+			return nil, &fs.FSError{
+				Op:   "ReadFile",
+				Path: file_path,
+				Err:  fs.ErrNotExist,
+			}
+		}
+
+		cluster := utilities.DirClusterToUint(
+			uint(file.FSSpecificData.DIREntry.DIR_cluster_lo),
+			uint(file.FSSpecificData.DIREntry.DIR_cluster_hi),
+		)
+		next_file, err := lookupEntry(vol, cluster, s)
+		if err != nil {
+			return nil, &fs.FSError{
+				Op:   "ReadFile",
+				Path: file_path,
+				Err:  err,
+			}
+		}
+		file = next_file
+	}
+
+	return file, nil
+}
+
+/*
+Read the entries of the directory represented by the path, including the '.'
+and '..' entries only when include_dots is set.
+*/
+func readDir[T FATSystem](vol T, op string, dir_path string, include_dots bool) ([]*FATFile, error) {
+	dir, err := readFile(vol, dir_path)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: dir_path,
+			Err:  err,
+		}
+	}
+
+	if !IsDirectory(dir.FSSpecificData.DIREntry) {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: dir_path,
+			Err:  fmt.Errorf("not a directory"),
+		}
+	}
+
+	cluster := utilities.DirClusterToUint(
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+	files, err := readDirEntries(vol, cluster, include_dots)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to read directory: %w", err),
+		}
+	}
+
+	return files, nil
+}
+
+/*
+Iterate over the entries of the directory represented by the path, skipping the
+'.' and '..' entries.
+*/
+func entries[T FATSystem](vol T, dir_path string) iter.Seq2[*FATFile, error] {
+	return func(yield func(*FATFile, error) bool) {
+		dir, err := readFile(vol, dir_path)
+		if err != nil {
+			yield(nil, &fs.FSError{Op: "Entries", Path: dir_path, Err: err})
+			return
+		}
+
+		if !IsDirectory(dir.FSSpecificData.DIREntry) {
+			yield(nil, &fs.FSError{Op: "Entries", Path: dir_path, Err: fmt.Errorf("not a directory")})
+			return
+		}
+
+		cluster := utilities.DirClusterToUint(
+			uint(dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+			uint(dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+		)
+		for file, err := range dirEntries(vol, cluster, false) {
+			if err != nil {
+				yield(nil, &fs.FSError{Op: "Entries", Path: dir_path, Err: fmt.Errorf("failed to read directory: %w", err)})
+				return
+			}
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Find the entry with the given name in the directory starting at the given cluster.
+Names are matched case-insensitively against both the long name and the 8.3
+alias, as any FAT driver would, and the entry keeps its on-disk casing.
+*/
+func lookupEntry[T FATSystem](vol T, cluster uint32, name string) (*FATFile, error) {
+	// A '..' entry pointing at cluster 0 refers to the root directory.
+	if cluster == 0 {
+		cluster = RootCluster(vol)
+	}
+
+	for file, err := range dirEntries(vol, cluster, true) {
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file: %w", err)
+		}
+
+		if matchesName(file, name) {
+			return file, nil
+		}
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+/*
+Get the first cluster of the root directory. The fixed root directory region of
+FAT12 and FAT16 volumes isn't part of the data region, so it's referred to as
+cluster 0, the same as a '..' entry does.
+*/
+func RootCluster[T FATSystem](vol T) uint32 {
+	extended_bpb := vol.GetExtendedBPBFull()
+	if extended_bpb == nil {
+		return 0
+	}
+
+	return extended_bpb.BPB_rootclus
+}
+
+/*
+Create a File representing the root directory, which has no DIR entry on the volume.
+*/
+func rootDir[T FATSystem](vol T) *FATFile {
+	root_cluster := RootCluster(vol)
+	dir_name, _ := CreateDIRName("/", true)
+
+	return &FATFile{
+		Name:    "/",
+		Content: nil,
+		FSSpecificData: &FATFileData{
+			LDIREntry: nil,
+			DIREntry: &DIR{
+				DIR_name:       dir_name,
+				DIR_attr:       DIR_ATTR_DIRECTORY,
+				DIR_cluster_lo: uint16(root_cluster & 0x0000FFFF),
+				DIR_cluster_hi: uint16((root_cluster & 0xFFFF0000) >> 16),
+			},
+		},
+	}
+}
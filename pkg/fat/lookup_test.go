@@ -0,0 +1,214 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"testing"
+
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+Count the clusters in the chain starting at the given cluster, and whether each
+follows straight on from the one before.
+*/
+func chainLayout(vol *FAT32, start uint32) (int, bool) {
+	count := 0
+	contiguous := true
+	var previous uint32
+	for i, cluster := range ClusterChain(vol, start) {
+		if i > 0 && cluster != previous+1 {
+			contiguous = false
+		}
+		previous = cluster
+		count++
+	}
+
+	return count, contiguous
+}
+
+func TestLookupFollowsDirectoryChains(t *testing.T) {
+	vol := newFixtureFAT32(t)
+
+	// Creating files in two directories by turns scatters each directory's
+	// clusters across the volume as they grow.
+	var names []string
+	for i := 0; i < 40; i++ {
+		for _, dir := range []string{"/", "/docs/nested"} {
+			name := path.Join(dir, fmt.Sprintf("Entry number %d.txt", i))
+			if _, err := vol.CreateFile(name, []byte(name)); err != nil {
+				t.Fatalf("CreateFile(%q): %v", name, err)
+			}
+			names = append(names, name)
+		}
+	}
+	if _, err := vol.CreateDir("/docs/nested/Last Directory"); err != nil {
+		t.Fatalf("CreateDir: %v", err)
+	}
+	if _, err := vol.CreateFile("/docs/nested/Last Directory/inside.txt", []byte("inside")); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	nested, err := vol.ReadFile("/docs/nested")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for dir, cluster := range map[string]uint32{"/": RootCluster(vol), "/docs/nested": firstCluster(nested)} {
+		if count, contiguous := chainLayout(vol, cluster); count < 3 || contiguous {
+			t.Fatalf("%s spans %d clusters, contiguous %v", dir, count, contiguous)
+		}
+	}
+
+	for _, name := range names {
+		file, err := vol.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile(%q): %v", name, err)
+		}
+		if _, err := vol.ReadAll(file); err != nil || string(file.Content) != name {
+			t.Errorf("%s holds %q, %v", name, file.Content, err)
+		}
+	}
+	if _, err := vol.ReadFile("/docs/nested/last directory/INSIDE.TXT"); err != nil {
+		t.Errorf("ReadFile through the last cluster of a directory: %v", err)
+	}
+
+	// A missing name is looked for through the whole chain.
+	if _, err := vol.ReadFile("/docs/nested/Entry number 40.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile of a missing file gave %v, not ErrNotExist", err)
+	}
+	assertClean(t, vol)
+}
+
+/*
+Get the names of a list of entries.
+*/
+func entryNames(files []*FATFile) []string {
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+
+	return names
+}
+
+func TestReadDirListsLiveEntries(t *testing.T) {
+	for fat_type, size := range test_image_sizes {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			vol, err := NewMemVolume(size, &FormatOptions{Type: fat_type, Label: "listing"})
+			if err != nil {
+				t.Fatalf("NewMemVolume: %v", err)
+			}
+
+			for _, name := range []string{"/Long Name.txt", "/gone with a long name.txt", "/SHORT.TXT"} {
+				if _, err := vol.CreateFile(name, []byte(name)); err != nil {
+					t.Fatalf("CreateFile(%q): %v", name, err)
+				}
+			}
+			if _, err := vol.CreateDir("/sub"); err != nil {
+				t.Fatalf("CreateDir: %v", err)
+			}
+			if err := vol.Remove("/gone with a long name.txt"); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+
+			// The volume label and the deleted entries are left out.
+			root, err := vol.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir: %v", err)
+			}
+			if names := entryNames(root); !slices.Equal(names, []string{"Long Name.txt", "SHORT.TXT", "sub"}) {
+				t.Errorf("root directory lists %q", names)
+			}
+			if len(root) == 3 && (!IsDirectory(root[2].FSSpecificData.DIREntry) || IsDirectory(root[0].FSSpecificData.DIREntry)) {
+				t.Errorf("listing mixes up files and directories")
+			}
+
+			sub, err := vol.ReadDir("/sub")
+			if err != nil || len(sub) != 0 {
+				t.Errorf("new directory lists %q, %v", entryNames(sub), err)
+			}
+			sub, err = vol.ReadDirWithDots("/sub")
+			if names := entryNames(sub); err != nil || !slices.Equal(names, []string{".", ".."}) {
+				t.Errorf("new directory lists %q with dots, %v", names, err)
+			}
+
+			if _, err := vol.ReadDir("/SHORT.TXT"); err == nil {
+				t.Errorf("ReadDir of a file succeeded")
+			}
+			if _, err := vol.ReadDir("/missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("ReadDir of a missing directory gave %v, not ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestEntriesMatchesReadDir(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			vol := newFixture(t, fat_type)
+
+			for _, dir := range []string{"/", "/docs", "/empty"} {
+				listed, err := vol.ReadDir(dir)
+				if err != nil {
+					t.Fatalf("ReadDir(%q): %v", dir, err)
+				}
+				var iterated []*FATFile
+				for file, err := range vol.Entries(dir) {
+					if err != nil {
+						t.Fatalf("Entries(%q): %v", dir, err)
+					}
+					iterated = append(iterated, file)
+				}
+				if !slices.Equal(entryNames(iterated), entryNames(listed)) {
+					t.Errorf("Entries(%q) yields %q, ReadDir lists %q", dir, entryNames(iterated), entryNames(listed))
+				}
+			}
+
+			// Iteration can stop early.
+			count := 0
+			for range vol.Entries("/") {
+				count++
+				break
+			}
+			if count != 1 {
+				t.Errorf("Entries yielded %d entries before stopping", count)
+			}
+
+			// Errors end the iteration.
+			for _, dir := range []string{"/missing", "/hello.txt"} {
+				count := 0
+				for file, err := range vol.Entries(dir) {
+					if file != nil || err == nil {
+						t.Errorf("Entries(%q) yielded %v, %v", dir, file, err)
+					}
+					count++
+				}
+				if count != 1 {
+					t.Errorf("Entries(%q) yielded %d times", dir, count)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterChainCoversFile(t *testing.T) {
+	vol := newFixtureFAT32(t)
+	cluster_size := int(ClusterSize(vol))
+	file, err := vol.CreateFile("/three.bin", make([]byte, 2*cluster_size+1))
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	var clusters []uint32
+	for i, cluster := range ClusterChain(vol, firstCluster(file)) {
+		if i != len(clusters) {
+			t.Fatalf("cluster %d yielded at position %d", len(clusters), i)
+		}
+		clusters = append(clusters, cluster)
+	}
+	if len(clusters) != 3 || clusters[0] != firstCluster(file) {
+		t.Errorf("file of 3 clusters starting at %d has chain %v", firstCluster(file), clusters)
+	}
+}
@@ -0,0 +1,67 @@
+package fat
+
+import (
+	"fmt"
+
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+MemVolume is a volume held entirely in memory, for tests and images that never
+need to touch the disk.
+*/
+type MemVolume struct {
+	Volume
+	dev *MemDevice
+}
+
+/*
+Format a new volume of the given size in memory. The options are the same as
+for Format, and may be nil.
+*/
+func NewMemVolume(size int64, opts *FormatOptions) (*MemVolume, error) {
+	if size <= 0 {
+		return nil, &fs.FSError{
+			Op:   "NewMemVolume",
+			Path: "memory",
+			Err:  fmt.Errorf("invalid size %d", size),
+		}
+	}
+
+	dev := NewMemDevice(make([]byte, size))
+	if _, err := Format(dev, size, opts); err != nil {
+		return nil, &fs.FSError{
+			Op:   "NewMemVolume",
+			Path: "memory",
+			Err:  fmt.Errorf("failed to format volume: %w", err),
+		}
+	}
+
+	return openMemVolume(dev)
+}
+
+/*
+Load the volume held in a byte slice, such as an image read into memory. The
+volume works on the slice in place, so every change made to the volume shows up
+in it.
+*/
+func LoadBytes(data []byte) (*MemVolume, error) {
+	return openMemVolume(NewMemDevice(data))
+}
+
+func openMemVolume(dev *MemDevice) (*MemVolume, error) {
+	vol, err := OpenDevice(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemVolume{Volume: vol, dev: dev}, nil
+}
+
+/*
+The contents of the volume as an image, shared with the volume rather than
+copied.
+*/
+func (vol *MemVolume) Bytes() []byte {
+	return vol.dev.Bytes()
+}
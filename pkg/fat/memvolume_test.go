@@ -0,0 +1,67 @@
+package fat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemVolumeRoundTrip(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			mem, err := NewMemVolume(test_image_sizes[fat_type], &FormatOptions{Type: fat_type, Label: "memory"})
+			if err != nil {
+				t.Fatalf("NewMemVolume: %v", err)
+			}
+			if mem.Type() != fat_type {
+				t.Fatalf("formatted a %s volume, not %s", mem.Type(), fat_type)
+			}
+			if _, err := mem.CreateDir("/dir"); err != nil {
+				t.Fatalf("CreateDir: %v", err)
+			}
+			contents := bytes.Repeat([]byte("round trip "), 500)
+			if _, err := mem.CreateFile("/dir/file.txt", contents); err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+
+			image := bytes.Clone(mem.Bytes())
+			if int64(len(image)) != test_image_sizes[fat_type] {
+				t.Errorf("image is %d bytes, not %d", len(image), test_image_sizes[fat_type])
+			}
+
+			loaded, err := LoadBytes(image)
+			if err != nil {
+				t.Fatalf("LoadBytes: %v", err)
+			}
+			file, err := loaded.ReadFile("/dir/file.txt")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if _, err := loaded.ReadAll(file); err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(file.Content, contents) {
+				t.Errorf("read back %d bytes that differ from the %d written", len(file.Content), len(contents))
+			}
+			assertClean(t, loaded)
+
+			// The loaded volume works on the slice in place.
+			if err := loaded.Remove("/dir/file.txt"); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if &loaded.Bytes()[0] != &image[0] {
+				t.Errorf("Bytes isn't the slice the volume was loaded from")
+			}
+			if _, err := mem.ReadFile("/dir/file.txt"); err != nil {
+				t.Errorf("removing from the copy changed the original: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewMemVolumeRejectsBadSize(t *testing.T) {
+	for _, size := range []int64{0, -1, 4096} {
+		if _, err := NewMemVolume(size, nil); err == nil {
+			t.Errorf("NewMemVolume(%d) succeeded", size)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package fat
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	fs "github.com/zni/fslib/pkg/fs/common"
+	"github.com/zni/fslib/pkg/gpt"
+	"github.com/zni/fslib/pkg/mbr"
+)
+
+/*
+Open the FAT volume in the numbered partition of a disk partitioned with an MBR.
+Primary partitions are numbered 1 to 4 and logical partitions from 5. The
+volume's BPB_hiddsec must hold the partition's first sector, or 0 when it was
+never set; logical partitions may also count their hidden sectors from their
+EBR, as older versions of DOS did. Closing the volume leaves the disk's device
+open.
+*/
+func OpenMBRPartition(dev BlockDevice, number int) (Volume, error) {
+	name := fmt.Sprintf("%s partition %d", deviceName(dev), number)
+
+	table, err := mbr.Read(dev, dev.SectorSize())
+	if err != nil {
+		return nil, &fs.FSError{Op: "OpenMBRPartition", Path: name, Err: err}
+	}
+
+	partition, err := table.Partition(number)
+	if err != nil {
+		return nil, &fs.FSError{Op: "OpenMBRPartition", Path: name, Err: err}
+	}
+	if partition.IsExtended() {
+		return nil, &fs.FSError{
+			Op:   "OpenMBRPartition",
+			Path: name,
+			Err:  fmt.Errorf("partition is an extended partition"),
+		}
+	}
+	if partition.Type == mbr.TYPE_GPT_PROTECTIVE {
+		return nil, &fs.FSError{
+			Op:   "OpenMBRPartition",
+			Path: name,
+			Err:  fmt.Errorf("disk is partitioned with a GPT"),
+		}
+	}
+
+	sector_size := dev.SectorSize()
+	section, err := NewSectionDevice(dev, partition.Offset(sector_size), partition.Size(sector_size))
+	if err != nil {
+		return nil, &fs.FSError{Op: "OpenMBRPartition", Path: name, Err: err}
+	}
+
+	hidden_sectors := []int64{partition.Offset(sector_size)}
+	if partition.IsLogical() {
+		hidden_sectors = append(hidden_sectors, int64(partition.FirstLBA-partition.EBRLBA)*int64(sector_size))
+	}
+	if err := checkPartitionBPB(section, hidden_sectors); err != nil {
+		return nil, &fs.FSError{Op: "OpenMBRPartition", Path: name, Err: err}
+	}
+
+	return OpenDevice(section)
+}
+
+/*
+Open the FAT volume in a partition of a disk partitioned with a GPT, picked by
+its index in the partition entry array, its name or its type GUID. The volume's
+BPB_hiddsec must hold the partition's first sector, or 0 when it was never set
+or the first sector doesn't fit in 32 bits. Closing the volume leaves the disk's
+device open.
+*/
+func OpenGPTPartition(dev BlockDevice, sel gpt.Selector) (Volume, error) {
+	name := fmt.Sprintf("%s partition with %s", deviceName(dev), sel)
+
+	table, err := gpt.Read(dev, dev.SectorSize(), dev.Size())
+	if err != nil {
+		return nil, &fs.FSError{Op: "OpenGPTPartition", Path: name, Err: err}
+	}
+
+	partition, err := table.Find(sel)
+	if err != nil {
+		return nil, &fs.FSError{Op: "OpenGPTPartition", Path: name, Err: err}
+	}
+
+	sector_size := dev.SectorSize()
+	section, err := NewSectionDevice(dev, partition.Offset(sector_size), partition.Size(sector_size))
+	if err != nil {
+		return nil, &fs.FSError{Op: "OpenGPTPartition", Path: name, Err: err}
+	}
+
+	var hidden_sectors []int64
+	if partition.FirstLBA <= math.MaxUint32 {
+		hidden_sectors = append(hidden_sectors, partition.Offset(sector_size))
+	}
+	if err := checkPartitionBPB(section, hidden_sectors); err != nil {
+		return nil, &fs.FSError{Op: "OpenGPTPartition", Path: name, Err: err}
+	}
+
+	return OpenDevice(section)
+}
+
+/*
+Check the BPB of the volume in a partition agrees with the partition: the volume
+has to fit inside it, and BPB_hiddsec has to be 0 or count the bytes before the
+partition given by one of the offsets. With no offsets, BPB_hiddsec isn't
+checked at all.
+*/
+func checkPartitionBPB(section *SectionDevice, offsets []int64) error {
+	bpb, err := ReadCommonBPB(io.NewSectionReader(section, 0, section.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to read BPB: %w", err)
+	}
+	if bpb.BPB_bytspersec == 0 {
+		return fmt.Errorf("invalid BPB")
+	}
+
+	total_sectors := uint32(bpb.BPB_totsec16)
+	if total_sectors == 0 {
+		total_sectors = bpb.BPB_totsec32
+	}
+	if volume_size := int64(total_sectors) * int64(bpb.BPB_bytspersec); volume_size > section.Size() {
+		return fmt.Errorf("volume of %d bytes doesn't fit in partition of %d bytes", volume_size, section.Size())
+	}
+
+	if bpb.BPB_hiddsec == 0 || len(offsets) == 0 {
+		return nil
+	}
+	for _, offset := range offsets {
+		if int64(bpb.BPB_hiddsec)*int64(bpb.BPB_bytspersec) == offset {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("BPB_hiddsec of %d doesn't match the partition starting at sector %d", bpb.BPB_hiddsec, offsets[0]/int64(bpb.BPB_bytspersec))
+}
@@ -0,0 +1,463 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/zni/fslib/internal/utilities"
+)
+
+// Fixing one problem can turn up another, such as a truncated chain leaving
+// lost clusters behind, so the volume is checked and repaired a few times over.
+const max_repair_passes int = 4
+
+const found_dir_path string = "/FOUND.000"
+
+/*
+RepairAction is a single change made to a volume while repairing it.
+*/
+type RepairAction struct {
+	Kind    ProblemKind
+	Path    string
+	Message string
+}
+
+func (action *RepairAction) String() string {
+	if action.Path == "" {
+		return action.Message
+	}
+
+	return fmt.Sprintf("%s: %s", action.Path, action.Message)
+}
+
+/*
+RepairReport holds the problems found on a volume, every change made to repair
+them, and the problems still left afterwards.
+*/
+type RepairReport struct {
+	Before  *CheckReport
+	Actions []*RepairAction
+	After   *CheckReport
+}
+
+/*
+Did the repair leave the volume without any problems?
+*/
+func (report *RepairReport) Clean() bool {
+	return report.After.Clean()
+}
+
+/*
+Check the consistency of a volume and repair the problems found, the same way
+dosfsck does. File sizes are changed to match the length of their chains,
+cross-linked chains are split by copying the shared clusters, lost chains are
+recovered into FOUND.000/FILE0000.CHK and onwards, orphaned LDIR entries are
+deleted, every copy of the FAT is rewritten from the FAT, and the FSInfo is
+recomputed. Every change made is listed in the report.
+*/
+func Repair[T FATSystem](vol T) (*RepairReport, error) {
+	check, err := Check(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{Before: check}
+	for pass := 0; pass < max_repair_passes && !check.Clean(); pass++ {
+		repairer := &repairer[T]{vol: vol}
+		if err := repairer.run(check); err != nil {
+			return nil, err
+		}
+		if len(repairer.actions) == 0 {
+			break
+		}
+		report.Actions = append(report.Actions, repairer.actions...)
+
+		check, err = Check(vol)
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.After = check
+
+	return report, nil
+}
+
+type repairer[T FATSystem] struct {
+	vol     T
+	actions []*RepairAction
+}
+
+func (r *repairer[T]) log(kind ProblemKind, path string, format string, args ...any) {
+	r.actions = append(r.actions, &RepairAction{kind, path, fmt.Sprintf(format, args...)})
+}
+
+/*
+Repair the problems in the report, a kind at a time, then write out the FATs
+and FSInfo.
+*/
+func (r *repairer[T]) run(check *CheckReport) error {
+	repairs := []struct {
+		kind   ProblemKind
+		repair func(*Problem) error
+	}{
+		{PROBLEM_ORPHANED_LDIR, r.dropOrphanedLDIRs},
+		{PROBLEM_BAD_DOT_ENTRY, r.fixDotEntry},
+		{PROBLEM_BAD_CHAIN, r.fixBadChain},
+		{PROBLEM_CROSS_LINKED, r.splitCrossLink},
+		{PROBLEM_CHAIN_TOO_SHORT, r.fixFileSize},
+		{PROBLEM_CHAIN_TOO_LONG, r.fixFileSize},
+		{PROBLEM_LOST_CLUSTERS, r.recoverLostChain},
+	}
+	for _, repair := range repairs {
+		for _, problem := range check.ProblemsOfKind(repair.kind) {
+			if err := repair.repair(problem); err != nil {
+				return fmt.Errorf("failed to repair %s: %w", problem, err)
+			}
+		}
+	}
+
+	for _, problem := range check.ProblemsOfKind(PROBLEM_FAT_MISMATCH) {
+		r.log(problem.Kind, "", "rewrote FAT copies from the FAT (%s)", problem.Message)
+	}
+
+	// Anything repaired so far may have changed the count of free clusters.
+	if len(r.actions) > 0 || len(check.ProblemsOfKind(PROBLEM_FSINFO_FREE_COUNT)) > 0 || len(check.ProblemsOfKind(PROBLEM_FSINFO_NEXT_FREE)) > 0 {
+		r.recomputeFSInfo()
+	}
+
+	if len(r.actions) > 0 {
+		if err := SyncFileSystemData(r.vol); err != nil {
+			return fmt.Errorf("failed to sync volume info: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Mark a run of LDIR entries that don't belong to any file as deleted.
+*/
+func (r *repairer[T]) dropOrphanedLDIRs(problem *Problem) error {
+	for _, loc := range problem.Slots {
+		if err := MarkDIRDeleted(r.vol.GetDiskRef(), loc); err != nil {
+			return err
+		}
+	}
+
+	r.log(problem.Kind, problem.Path, "deleted %d orphaned long name entries at %08x", len(problem.Slots), problem.Loc)
+	return nil
+}
+
+/*
+Point a '.' or '..' entry back at the right cluster, writing the entry out
+afresh if its slot is empty. Stray '.' and '..' entries anywhere else in a
+directory are deleted.
+*/
+func (r *repairer[T]) fixDotEntry(problem *Problem) error {
+	dir_entry, err := ReadDIR(r.vol.GetDiskRef(), problem.Loc)
+	if err != nil {
+		return err
+	}
+
+	name, err := r.dotEntryName(problem)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if err := MarkDIRDeleted(r.vol.GetDiskRef(), problem.Loc); err != nil {
+			return err
+		}
+		r.log(problem.Kind, problem.Path, "deleted stray '%s' entry at %08x", ShortName(dir_entry), problem.Loc)
+		return nil
+	}
+
+	free_slot := dir_entry.DIR_name[0] == free_entry || dir_entry.DIR_name[0] == deleted_entry
+	if !free_slot && (dir_entry.DIR_attr&long_entry) != long_entry && ShortName(dir_entry) == name {
+		dir_entry.DIR_attr |= DIR_ATTR_DIRECTORY
+		if err := r.setFirstCluster(dir_entry, problem.Loc, problem.Cluster); err != nil {
+			return err
+		}
+		r.log(problem.Kind, problem.Path, "pointed '%s' entry at cluster %d", name, problem.Cluster)
+		return nil
+	}
+
+	if !free_slot {
+		r.log(problem.Kind, problem.Path, "left '%s' entry missing, its slot is in use", name)
+		return nil
+	}
+
+	dot_entry, err := CreateSystemDIR(name)
+	if err != nil {
+		return err
+	}
+	if err := r.setFirstCluster(dot_entry, problem.Loc, problem.Cluster); err != nil {
+		return err
+	}
+
+	r.log(problem.Kind, problem.Path, "recreated '%s' entry pointing at cluster %d", name, problem.Cluster)
+	return nil
+}
+
+/*
+Work out which entry belongs in the slot of a bad '.' or '..' entry from where
+the slot lies in its directory. Returns "" for a slot that should hold neither.
+*/
+func (r *repairer[T]) dotEntryName(problem *Problem) (string, error) {
+	if problem.Path == "/" {
+		return "", nil
+	}
+
+	dir, err := readFile(r.vol, problem.Path)
+	if err != nil {
+		return "", err
+	}
+
+	first_cluster := utilities.DirClusterToUint(
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+	switch problem.Loc {
+	case LookupClusterBytes(r.vol, first_cluster):
+		return ".", nil
+	case LookupClusterBytes(r.vol, first_cluster) + 32:
+		return "..", nil
+	}
+
+	return "", nil
+}
+
+/*
+Cut a broken chain short at its last good cluster. A chain with no good
+clusters at all is dropped from its entry, and a directory without any
+clusters is deleted.
+*/
+func (r *repairer[T]) fixBadChain(problem *Problem) error {
+	// The FAT32 root directory is the only chain without a DIR entry.
+	if problem.Loc == 0 {
+		if problem.Count == 0 {
+			r.log(problem.Kind, problem.Path, "left root directory chain as is, it has no good clusters")
+			return nil
+		}
+		last_cluster := r.walk(RootCluster(r.vol), problem.Count-1)
+		MarkEOC(r.vol, last_cluster)
+		r.log(problem.Kind, problem.Path, "ended chain at cluster %d after %d clusters", last_cluster, problem.Count)
+		return nil
+	}
+
+	dir_entry, err := ReadDIR(r.vol.GetDiskRef(), problem.Loc)
+	if err != nil {
+		return err
+	}
+
+	if problem.Count == 0 {
+		if IsDirectory(dir_entry) {
+			if err := MarkDIRDeleted(r.vol.GetDiskRef(), problem.Loc); err != nil {
+				return err
+			}
+			r.log(problem.Kind, problem.Path, "deleted directory entry without any clusters")
+			return nil
+		}
+
+		if err := r.setFirstCluster(dir_entry, problem.Loc, 0); err != nil {
+			return err
+		}
+		r.log(problem.Kind, problem.Path, "dropped chain without any good clusters")
+		return nil
+	}
+
+	first_cluster := utilities.DirClusterToUint(uint(dir_entry.DIR_cluster_lo), uint(dir_entry.DIR_cluster_hi))
+	last_cluster := r.walk(first_cluster, problem.Count-1)
+	MarkEOC(r.vol, last_cluster)
+
+	r.log(problem.Kind, problem.Path, "ended chain at cluster %d after %d clusters", last_cluster, problem.Count)
+	return nil
+}
+
+/*
+Give a chain that runs into another chain its own copy of the clusters they
+share, from the shared cluster on.
+*/
+func (r *repairer[T]) splitCrossLink(problem *Problem) error {
+	dir_entry, err := ReadDIR(r.vol.GetDiskRef(), problem.Loc)
+	if err != nil {
+		return err
+	}
+
+	// Copy the shared part of the chain into newly allocated clusters.
+	var copied []uint32
+	buffer := make([]byte, ClusterSize(r.vol))
+	for _, shared_cluster := range ClusterChain(r.vol, problem.Cluster) {
+		cluster, err := AllocateCluster(r.vol, 2)
+		if err != nil {
+			releaseChain(r.vol, copied)
+			return err
+		}
+		if err := r.copyCluster(shared_cluster, cluster, buffer); err != nil {
+			releaseChain(r.vol, append(copied, cluster))
+			return err
+		}
+		if len(copied) > 0 {
+			LinkCluster(r.vol, copied[len(copied)-1], cluster)
+		}
+		copied = append(copied, cluster)
+	}
+	if len(copied) == 0 {
+		return errors.New("shared chain is empty")
+	}
+
+	// Splice the copy in where the chain used to run into the shared clusters.
+	if problem.Count == 0 {
+		if err := r.setFirstCluster(dir_entry, problem.Loc, copied[0]); err != nil {
+			releaseChain(r.vol, copied)
+			return err
+		}
+	} else {
+		first_cluster := utilities.DirClusterToUint(uint(dir_entry.DIR_cluster_lo), uint(dir_entry.DIR_cluster_hi))
+		LinkCluster(r.vol, r.walk(first_cluster, problem.Count-1), copied[0])
+	}
+	UpdateFSInfo(r.vol, len(copied))
+
+	r.log(problem.Kind, problem.Path, "copied %d shared clusters from cluster %d to cluster %d", len(copied), problem.Cluster, copied[0])
+	return nil
+}
+
+/*
+Change a file's size to the length of its chain.
+*/
+func (r *repairer[T]) fixFileSize(problem *Problem) error {
+	dir_entry, err := ReadDIR(r.vol.GetDiskRef(), problem.Loc)
+	if err != nil {
+		return err
+	}
+
+	cluster_size := uint64(ClusterSize(r.vol))
+	chain_size := uint64(problem.Count) * cluster_size
+
+	// A chain too long to describe with a 32 bit size is cut down instead.
+	if chain_size > math.MaxUint32 {
+		clusters := uint32(math.MaxUint32 / cluster_size)
+		last_cluster := r.walk(problem.Cluster, clusters-1)
+		next_cluster, end := NextCluster(r.vol, last_cluster)
+		if !end {
+			UpdateFSInfo(r.vol, -FreeChain(r.vol, next_cluster))
+		}
+		MarkEOC(r.vol, last_cluster)
+		chain_size = uint64(clusters) * cluster_size
+		r.log(problem.Kind, problem.Path, "ended chain at cluster %d after %d clusters", last_cluster, clusters)
+	}
+
+	old_size := dir_entry.DIR_filesize
+	dir_entry.DIR_filesize = uint32(chain_size)
+	if _, err := WriteDIR(r.vol.GetDiskRef(), dir_entry, problem.Loc); err != nil {
+		return err
+	}
+
+	r.log(problem.Kind, problem.Path, "changed file size from %d to %d bytes to match its chain", old_size, chain_size)
+	return nil
+}
+
+/*
+Recover a lost chain into a new FILEnnnn.CHK file in FOUND.000.
+*/
+func (r *repairer[T]) recoverLostChain(problem *Problem) error {
+	// Make sure the chain ends where the check found it ending.
+	MarkEOC(r.vol, r.walk(problem.Cluster, problem.Count-1))
+
+	found_dir, err := readFile(r.vol, found_dir_path)
+	if err != nil {
+		found_dir, err = createDir(r.vol, found_dir_path)
+		if err != nil {
+			return err
+		}
+		r.log(problem.Kind, found_dir_path, "created directory for lost chains")
+	}
+	if !IsDirectory(found_dir.FSSpecificData.DIREntry) {
+		return fmt.Errorf("%s is not a directory", found_dir_path)
+	}
+
+	var name string
+	for n := 0; ; n++ {
+		if n > 9999 {
+			return fmt.Errorf("%s is full", found_dir_path)
+		}
+		name = fmt.Sprintf("FILE%04d.CHK", n)
+		if _, err := readFile(r.vol, found_dir_path+"/"+name); err != nil {
+			break
+		}
+	}
+
+	dir_entry, err := CreateDIR(name, DIR_ATTR_ARCHIVE)
+	if err != nil {
+		return err
+	}
+	dir_entry.DIR_cluster_lo = uint16(problem.Cluster & 0x0000FFFF)
+	dir_entry.DIR_cluster_hi = uint16((problem.Cluster & 0xFFFF0000) >> 16)
+	dir_entry.DIR_filesize = uint32(min(uint64(problem.Count)*uint64(ClusterSize(r.vol)), math.MaxUint32))
+	if _, err := writeEntry(r.vol, found_dir, name, dir_entry); err != nil {
+		return err
+	}
+
+	r.log(problem.Kind, found_dir_path+"/"+name, "recovered %d lost clusters starting at cluster %d", problem.Count, problem.Cluster)
+	return nil
+}
+
+/*
+Recompute the FSInfo's free count and next free cluster from the FAT.
+*/
+func (r *repairer[T]) recomputeFSInfo() {
+	fsinfo := r.vol.GetFSInfo()
+	if fsinfo == nil {
+		return
+	}
+
+	var free_count uint32
+	for cluster := uint32(2); cluster < CountOfClusters(r.vol)+2; cluster++ {
+		if next_cluster, _ := NextCluster(r.vol, cluster); next_cluster == 0 {
+			free_count++
+		}
+	}
+
+	next_free, err := NextFreeCluster(r.vol)
+	if err != nil {
+		next_free = unknown_fsinfo_value
+	}
+
+	if fsinfo.free_count != free_count || fsinfo.next_free != next_free {
+		r.log(PROBLEM_FSINFO_FREE_COUNT, "", "set FSInfo free count to %d and next free cluster to %d", free_count, next_free)
+	}
+	fsinfo.free_count = free_count
+	fsinfo.next_free = next_free
+}
+
+/*
+Follow the chain starting at the given cluster for the given number of steps.
+*/
+func (r *repairer[T]) walk(start uint32, steps uint32) uint32 {
+	cluster := start
+	for ; steps > 0; steps-- {
+		cluster, _ = NextCluster(r.vol, cluster)
+	}
+
+	return cluster
+}
+
+func (r *repairer[T]) setFirstCluster(dir_entry *DIR, loc uint32, cluster uint32) error {
+	dir_entry.DIR_cluster_lo = uint16(cluster & 0x0000FFFF)
+	dir_entry.DIR_cluster_hi = uint16((cluster & 0xFFFF0000) >> 16)
+	_, err := WriteDIR(r.vol.GetDiskRef(), dir_entry, loc)
+
+	return err
+}
+
+func (r *repairer[T]) copyCluster(from uint32, to uint32, buffer []byte) error {
+	disk_ref := r.vol.GetDiskRef()
+	if _, err := disk_ref.ReadAt(buffer, int64(LookupClusterBytes(r.vol, from))); err != nil {
+		return err
+	}
+	if _, err := disk_ref.WriteAt(buffer, int64(LookupClusterBytes(r.vol, to))); err != nil {
+		return err
+	}
+
+	return nil
+}
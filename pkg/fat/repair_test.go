@@ -0,0 +1,36 @@
+package fat
+
+import "testing"
+
+func TestRepairRecoversLostChain(t *testing.T) {
+	vol := newFixtureFAT32(t)
+
+	// Allocate a chain of two clusters that no entry points at.
+	fat := vol.GetFATInt()
+	lost, err := fat.GetNextFreeCluster()
+	if err != nil {
+		t.Fatalf("GetNextFreeCluster: %v", err)
+	}
+	fat.SetCluster(uint(lost), lost+1)
+	fat.MarkEOC(uint(lost + 1))
+
+	report, err := vol.Repair()
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if problems := report.Before.ProblemsOfKind(PROBLEM_LOST_CLUSTERS); len(problems) != 1 {
+		t.Errorf("found %d lost chains, not 1", len(problems))
+	}
+	for _, problem := range report.After.Problems {
+		t.Errorf("left after repair: %s", problem)
+	}
+
+	file, err := vol.ReadFile("/FOUND.000/FILE0000.CHK")
+	if err != nil {
+		t.Fatalf("lost chain wasn't recovered: %v", err)
+	}
+	if size := file.FSSpecificData.DIREntry.DIR_filesize; size != 2*ClusterSize(vol) {
+		t.Errorf("recovered file is %d bytes, not %d", size, 2*ClusterSize(vol))
+	}
+	assertClean(t, vol)
+}
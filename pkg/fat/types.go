@@ -1,15 +1,11 @@
 package fat
 
-import (
-	"os"
-)
-
 type FATSystem interface {
 	FAT12 | FAT16 | FAT32 | *FAT12 | *FAT16 | *FAT32
 	GetCommonBPB() *CommonBPB
 	GetExtendedBPBMin() *ExtBPBMinimal
 	GetExtendedBPBFull() *ExtBPBFull
-	GetDiskRef() *os.File
+	GetDiskRef() BlockDevice
 	GetFSInfo() *FSInfo
 	GetFATShort() *FAT[uint16]
 	GetFATInt() *FAT[uint32]
@@ -20,7 +16,7 @@ type FAT12 struct {
 	BackupBPB *BPB12
 	FAT       *FAT[uint16]
 	BackupFAT *FAT[uint16]
-	DiskRef   *os.File
+	DiskRef   BlockDevice
 }
 
 func (fs FAT12) GetCommonBPB() *CommonBPB {
@@ -35,7 +31,7 @@ func (fs FAT12) GetExtendedBPBFull() *ExtBPBFull {
 	return nil
 }
 
-func (fs FAT12) GetDiskRef() *os.File {
+func (fs FAT12) GetDiskRef() BlockDevice {
 	return fs.DiskRef
 }
 
@@ -56,7 +52,7 @@ type FAT16 struct {
 	BackupBPB *BPB16
 	FAT       *FAT[uint16]
 	BackupFAT *FAT[uint16]
-	DiskRef   *os.File
+	DiskRef   BlockDevice
 }
 
 func (fs FAT16) GetCommonBPB() *CommonBPB {
@@ -71,7 +67,7 @@ func (fs FAT16) GetExtendedBPBFull() *ExtBPBFull {
 	return nil
 }
 
-func (fs FAT16) GetDiskRef() *os.File {
+func (fs FAT16) GetDiskRef() BlockDevice {
 	return fs.DiskRef
 }
 
@@ -94,7 +90,7 @@ type FAT32 struct {
 	BackupFSInfo *FSInfo
 	FAT          *FAT[uint32]
 	BackupFAT    *FAT[uint32]
-	DiskRef      *os.File
+	DiskRef      BlockDevice
 }
 
 func (vol FAT32) GetCommonBPB() *CommonBPB {
@@ -109,7 +105,7 @@ func (vol FAT32) GetExtendedBPBFull() *ExtBPBFull {
 	return vol.BPB.Extended
 }
 
-func (vol FAT32) GetDiskRef() *os.File {
+func (vol FAT32) GetDiskRef() BlockDevice {
 	return vol.DiskRef
 }
 
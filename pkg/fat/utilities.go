@@ -1,89 +1,211 @@
 package fat
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"iter"
 	"strings"
 )
 
 /*
-Look up the location in bytes of the given cluster.
+Look up the location in bytes of the given cluster. On FAT12 and FAT16 volumes
+cluster 0 refers to the fixed root directory region.
 */
 func LookupClusterBytes[T FATSystem](fs T, cluster uint32) uint32 {
+	common_bpb := fs.GetCommonBPB()
+	bytes_per_sector := int64(common_bpb.BPB_bytspersec)
+
+	if cluster == 0 && fs.GetExtendedBPBFull() == nil {
+		return uint32(RootDirBytes(fs))
+	}
+
+	// Data clusters are numbered from 2 at the start of the data region.
+	data_bytes := int64(FirstDataSector(fs)) * bytes_per_sector
+	cluster_bytes := (int64(cluster) - 2) * int64(ClusterSize(fs))
+
+	return uint32(data_bytes + cluster_bytes)
+}
+
+/*
+Get the number of sectors in each copy of the FAT.
+*/
+func FATSectors[T FATSystem](fs T) uint32 {
 	common_bpb := fs.GetCommonBPB()
 	extended_bpb := fs.GetExtendedBPBFull()
+	if common_bpb.BPB_fatsz16 != 0 || extended_bpb == nil {
+		return uint32(common_bpb.BPB_fatsz16)
+	}
 
-	// Calculate the bytes taken up by the file system information.
-	var reserved_bytes int64 = int64(common_bpb.BPB_rsvdseccnt * common_bpb.BPB_bytspersec)
-	var fat_bytes int64
-	if extended_bpb == nil {
-		fat_bytes = int64(2 * (uint32(common_bpb.BPB_fatsz16) * uint32(common_bpb.BPB_bytspersec)))
-	} else {
-		fat_bytes = int64(2 * (extended_bpb.BPB_fatsz32 * uint32(common_bpb.BPB_bytspersec)))
+	return extended_bpb.BPB_fatsz32
+}
+
+/*
+Get the number of sectors taken up by the fixed root directory region, which is
+always 0 on FAT32 volumes.
+*/
+func RootDirSectors[T FATSystem](fs T) uint32 {
+	common_bpb := fs.GetCommonBPB()
+	bytes_per_sector := uint32(common_bpb.BPB_bytspersec)
+
+	return ((uint32(common_bpb.BPB_rootentcnt) * 32) + (bytes_per_sector - 1)) / bytes_per_sector
+}
+
+/*
+Look up the location in bytes of the fixed root directory region, which sits
+between the FATs and the data region.
+*/
+func RootDirBytes[T FATSystem](fs T) int64 {
+	common_bpb := fs.GetCommonBPB()
+	return LookupFATBytes(fs, int(common_bpb.BPB_numfats))
+}
+
+/*
+Get the first sector of the data region, where cluster 2 starts.
+*/
+func FirstDataSector[T FATSystem](fs T) uint32 {
+	common_bpb := fs.GetCommonBPB()
+	return uint32(common_bpb.BPB_rsvdseccnt) +
+		uint32(common_bpb.BPB_numfats)*FATSectors(fs) +
+		RootDirSectors(fs)
+}
+
+/*
+Get the count of data clusters on the volume, which is what determines whether
+it's FAT12, FAT16 or FAT32.
+*/
+func CountOfClusters[T FATSystem](fs T) uint32 {
+	common_bpb := fs.GetCommonBPB()
+	total_sectors := uint32(common_bpb.BPB_totsec16)
+	if total_sectors == 0 {
+		total_sectors = common_bpb.BPB_totsec32
 	}
-	data_sector := reserved_bytes + fat_bytes
 
-	// Calculate the amount of bytes a sector takes up, multiplied by its location.
-	var current_cluster int64
-	if extended_bpb == nil {
-		current_cluster = int64(cluster)
-	} else {
-		current_cluster = int64(cluster - extended_bpb.BPB_rootclus)
+	return (total_sectors - FirstDataSector(fs)) / uint32(common_bpb.BPB_secperclus)
+}
+
+/*
+Check the BPB of a volume describes a layout that makes sense, before anything
+else is worked out from it. Each entry of the FAT takes up the given number of
+bits.
+*/
+func checkBPB[T FATSystem](fs T, fat_bits uint32) error {
+	common_bpb := fs.GetCommonBPB()
+	switch common_bpb.BPB_bytspersec {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid sector size %d", common_bpb.BPB_bytspersec)
+	}
+	if common_bpb.BPB_secperclus == 0 || common_bpb.BPB_secperclus&(common_bpb.BPB_secperclus-1) != 0 {
+		return fmt.Errorf("invalid sectors per cluster %d", common_bpb.BPB_secperclus)
+	}
+	if common_bpb.BPB_rsvdseccnt == 0 || common_bpb.BPB_numfats == 0 || FATSectors(fs) == 0 {
+		return errors.New("invalid BPB")
+	}
+
+	// Worked out in 64 bits, so a huge FAT can't wrap around.
+	total_sectors := uint64(common_bpb.BPB_totsec16)
+	if total_sectors == 0 {
+		total_sectors = uint64(common_bpb.BPB_totsec32)
+	}
+	meta_sectors := uint64(common_bpb.BPB_rsvdseccnt) + uint64(common_bpb.BPB_numfats)*uint64(FATSectors(fs)) + uint64(RootDirSectors(fs))
+	if meta_sectors >= total_sectors {
+		return fmt.Errorf("volume of %d sectors too small for its %d reserved, FAT and root directory sectors", total_sectors, meta_sectors)
 	}
-	var cluster_size int64 = int64(common_bpb.BPB_bytspersec * uint16(common_bpb.BPB_secperclus))
-	cluster_sector := current_cluster * cluster_size
 
-	// Return the reserved bytes in addition to the bytes to the cluster.
-	return uint32(data_sector + cluster_sector)
+	count_of_clusters := CountOfClusters(fs)
+	if count_of_clusters == 0 {
+		return errors.New("volume has no data clusters")
+	}
+	fat_bytes := uint64(FATSectors(fs)) * uint64(common_bpb.BPB_bytspersec)
+	if needed := (uint64(count_of_clusters+2)*uint64(fat_bits) + 7) / 8; fat_bytes < needed {
+		return fmt.Errorf("FAT of %d bytes too small for %d clusters", fat_bytes, count_of_clusters)
+	}
+
+	if extended_bpb := fs.GetExtendedBPBFull(); extended_bpb != nil {
+		if extended_bpb.BPB_rootclus < 2 || extended_bpb.BPB_rootclus >= count_of_clusters+2 {
+			return fmt.Errorf("invalid root directory cluster %d", extended_bpb.BPB_rootclus)
+		}
+	}
+
+	return nil
 }
 
 /*
-Read a file's complete LDIR and DIR entries from the volume.
+Look up the cluster holding the given location in bytes.
 */
-func GetFile[T FATSystem](fs T) (*FATFile, error) {
+func LookupBytesCluster[T FATSystem](fs T, loc uint32) uint32 {
+	data_sector := LookupClusterBytes(fs, 2)
+	return 2 + (loc-data_sector)/ClusterSize(fs)
+}
+
+/*
+Read a file's complete LDIR and DIR entries from the volume, starting at the
+location loc and assuming the entries are stored contiguously.
+*/
+func GetFile[T FATSystem](fs T, loc int64) (*FATFile, error) {
+	next_loc := loc
+	return readEntry(fs, func() (int64, error) {
+		slot_loc := next_loc
+		next_loc += 32
+		return slot_loc, nil
+	})
+}
+
+/*
+Read a file's complete LDIR and DIR entries from the volume. The location of
+each 32 byte slot making up the entries is handed out by next_slot.
+*/
+func readEntry[T FATSystem](fs T, next_slot func() (int64, error)) (*FATFile, error) {
 	var ldirs []*LDIR
 	disk_ref := fs.GetDiskRef()
 
 	// Get location of the first LDIR.
-	ldir_loc, err := disk_ref.Seek(0, io.SeekCurrent)
+	ldir_loc, err := next_slot()
 	if err != nil {
 		return nil, err
 	}
-
-	lname_entry, err := ReadLDIR(disk_ref)
+	lname_entry, err := ReadLDIR(disk_ref, ldir_loc)
 	if err != nil {
 		return nil, err
 	}
-	is_long_entry := (lname_entry.attr & long_entry) == long_entry
-	var name string
+	is_long_entry := (lname_entry.attr&long_entry) == long_entry && lname_entry.ordinal != deleted_entry
+
+	// Get location of the DIR entry.
+	dir_loc := ldir_loc
 	if is_long_entry {
 		ldirs = append(ldirs, lname_entry)
-		ldir_count := int(lname_entry.ordinal^last_long_entry) - 1
+		ldir_count := int(lname_entry.ordinal&^last_long_entry) - 1
 		for i := 0; i < ldir_count; i++ {
-			lname_entry, err = ReadLDIR(disk_ref)
+			ldir_loc, err := next_slot()
+			if err != nil {
+				return nil, err
+			}
+			lname_entry, err = ReadLDIR(disk_ref, ldir_loc)
 			if err != nil {
 				return nil, err
 			}
 			ldirs = append(ldirs, lname_entry)
 		}
 
-		name = joinLDIRs(ldirs)
-	} else {
-		disk_ref.Seek(-32, io.SeekCurrent)
+		dir_loc, err = next_slot()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Get location of the DIR entry.
-	dir_loc, err := disk_ref.Seek(0, io.SeekCurrent)
+	dir_entry, err := ReadDIR(disk_ref, uint32(dir_loc))
 	if err != nil {
 		return nil, err
 	}
 
-	dir_entry, err := ReadDIR(disk_ref)
-	if err != nil {
-		return nil, err
+	// Only trust the long name if the LDIRs belong to this DIR entry.
+	var name string
+	if len(ldirs) > 0 && ldirs[0].chksum == computeShortChecksum(dir_entry) {
+		name = joinLDIRs(ldirs)
 	}
-
 	if name == "" {
-		name = strings.Trim(string(dir_entry.DIR_name), " ")
+		name = ShortName(dir_entry)
 	}
 
 	fat_file_data := FATFileData{uint32(ldir_loc), uint32(dir_loc), ldirs, dir_entry}
@@ -93,17 +215,266 @@ func GetFile[T FATSystem](fs T) (*FATFile, error) {
 }
 
 /*
-Zero out a cluster for use.
+Does the name refer to the file? The long name is compared using Unicode simple
+case folding, and the 8.3 alias in DIR_name is compared ignoring case as well.
 */
-func ZeroCluster[T FATSystem](fs T, cluster uint32) error {
-	disk_ref := fs.GetDiskRef()
-	if _, err := disk_ref.Seek(int64(cluster), io.SeekStart); err != nil {
-		return err
+func matchesName(file *FATFile, name string) bool {
+	if strings.EqualFold(file.Name, name) {
+		return true
+	}
+
+	return strings.EqualFold(ShortName(file.FSSpecificData.DIREntry), name)
+}
+
+/*
+Read every live entry of the directory starting at the given cluster, following
+the directory's cluster chain. Deleted entries and the volume label are skipped,
+as are the '.' and '..' entries unless include_dots is set.
+*/
+func readDirEntries[T FATSystem](fs T, cluster uint32, include_dots bool) ([]*FATFile, error) {
+	var files []*FATFile
+	for file, err := range dirEntries(fs, cluster, include_dots) {
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
 	}
 
+	return files, nil
+}
+
+/*
+Iterate over the live entries of the directory starting at the given cluster,
+reading each entry from the volume only when it's asked for. Deleted entries and
+the volume label are skipped, as are the '.' and '..' entries unless include_dots
+is set. Iteration stops after the first error.
+*/
+func dirEntries[T FATSystem](fs T, cluster uint32, include_dots bool) iter.Seq2[*FATFile, error] {
+	return func(yield func(*FATFile, error) bool) {
+		reader := NewDirReader(fs, cluster)
+		for {
+			file, err := reader.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			dir_entry := file.FSSpecificData.DIREntry
+			if dir_entry.DIR_name[0] == deleted_entry || IsVolumeLabel(dir_entry) {
+				continue
+			}
+			if IsSystemDIR(dir_entry) && !include_dots {
+				continue
+			}
+
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Get the location in bytes of every slot used by a file's LDIR and DIR entries,
+following the directory's cluster chain where the entries cross a cluster.
+*/
+func EntrySlots[T FATSystem](fs T, file *FATFile) ([]uint32, error) {
+	cluster_size := ClusterSize(fs)
+	slot_count := len(file.FSSpecificData.LDIREntry) + 1
+
+	loc := file.FSSpecificData.LDIR_loc
+	slots := []uint32{loc}
+
+	// The fixed root directory of a FAT12 or FAT16 volume is one contiguous
+	// region, sitting in front of the data region.
+	if loc < LookupClusterBytes(fs, 2) {
+		for len(slots) < slot_count {
+			loc += 32
+			slots = append(slots, loc)
+		}
+	}
+
+	for len(slots) < slot_count {
+		cluster := LookupBytesCluster(fs, loc)
+		loc += 32
+		if loc >= LookupClusterBytes(fs, cluster)+cluster_size {
+			next_cluster, end := NextCluster(fs, cluster)
+			if end {
+				return nil, errors.New("entry runs past the end of the directory")
+			}
+			loc = LookupClusterBytes(fs, next_cluster)
+		}
+		slots = append(slots, loc)
+	}
+
+	if slots[len(slots)-1] != file.FSSpecificData.DIR_loc {
+		return nil, errors.New("entry slots don't end at the DIR entry")
+	}
+
+	return slots, nil
+}
+
+/*
+Look up the cluster following the given cluster in the FAT, and whether the chain
+ends at the given cluster.
+*/
+func NextCluster[T FATSystem](fs T, cluster uint32) (uint32, bool) {
+	fat_short := fs.GetFATShort()
+	if fat_short != nil {
+		next_cluster := fat_short.GetCluster(uint(cluster))
+		return uint32(next_cluster), fat_short.IsEOC(next_cluster) || !fat_short.isValidCluster(next_cluster)
+	}
+
+	fat_int := fs.GetFATInt()
+	next_cluster := fat_int.GetCluster(uint(cluster))
+	return next_cluster, fat_int.IsEOC(next_cluster) || !fat_int.isValidCluster(next_cluster)
+}
+
+/*
+Get the first free cluster in the FAT, without allocating it.
+*/
+func NextFreeCluster[T FATSystem](fs T) (uint32, error) {
+	fat_short := fs.GetFATShort()
+	if fat_short != nil {
+		cluster, err := fat_short.GetNextFreeCluster()
+		return uint32(cluster), err
+	}
+
+	return fs.GetFATInt().GetNextFreeCluster()
+}
+
+/*
+Iterate over the clusters in the chain starting at the given cluster, along
+with each cluster's position in the chain, until the end of chain marker.
+*/
+func ClusterChain[T FATSystem](fs T, start uint32) iter.Seq2[int, uint32] {
+	return func(yield func(int, uint32) bool) {
+		fat_short := fs.GetFATShort()
+		if fat_short != nil {
+			for i, cluster := range fat_short.Chain(uint16(start)) {
+				if !yield(i, uint32(cluster)) {
+					return
+				}
+			}
+			return
+		}
+
+		for i, cluster := range fs.GetFATInt().Chain(start) {
+			if !yield(i, cluster) {
+				return
+			}
+		}
+	}
+}
+
+/*
+Allocate a free cluster, searching from the given cluster onward, and mark it as
+the end of a chain.
+*/
+func AllocateCluster[T FATSystem](fs T, start uint32) (uint32, error) {
+	if start < 2 {
+		start = 2
+	}
+
+	fat_short := fs.GetFATShort()
+	if fat_short != nil {
+		cluster, err := fat_short.getNextFreeClusterAfter(uint16(start))
+		if err != nil {
+			cluster, err = fat_short.GetNextFreeCluster()
+		}
+		if err != nil {
+			return 0, err
+		}
+		fat_short.MarkEOC(uint(cluster))
+		return uint32(cluster), nil
+	}
+
+	fat_int := fs.GetFATInt()
+	cluster, err := fat_int.getNextFreeClusterAfter(start)
+	if err != nil {
+		cluster, err = fat_int.GetNextFreeCluster()
+	}
+	if err != nil {
+		return 0, err
+	}
+	fat_int.MarkEOC(uint(cluster))
+	return cluster, nil
+}
+
+/*
+Point the given cluster at the next cluster in its chain.
+*/
+func LinkCluster[T FATSystem](fs T, cluster uint32, next_cluster uint32) {
+	fat_short := fs.GetFATShort()
+	if fat_short != nil {
+		fat_short.SetCluster(uint(cluster), uint16(next_cluster))
+	} else {
+		fs.GetFATInt().SetCluster(uint(cluster), next_cluster)
+	}
+}
+
+/*
+Mark the given cluster as the end of its chain.
+*/
+func MarkEOC[T FATSystem](fs T, cluster uint32) {
+	fat_short := fs.GetFATShort()
+	if fat_short != nil {
+		fat_short.MarkEOC(uint(cluster))
+	} else {
+		fs.GetFATInt().MarkEOC(uint(cluster))
+	}
+}
+
+/*
+Free every cluster in the chain starting at the given cluster, returning the
+number of clusters freed.
+*/
+func FreeChain[T FATSystem](fs T, start uint32) int {
+	fat_short := fs.GetFATShort()
+	if fat_short != nil {
+		return fat_short.FreeChain(uint16(start))
+	}
+
+	return fs.GetFATInt().FreeChain(start)
+}
+
+/*
+Update the in-memory FSInfo, if the volume has one, to account for newly used
+clusters (or freed clusters, when negative).
+*/
+func UpdateFSInfo[T FATSystem](fs T, clusters_used int) {
+	fsinfo := fs.GetFSInfo()
+	if fsinfo == nil {
+		return
+	}
+
+	next_free_cluster, err := NextFreeCluster(fs)
+	if err != nil {
+		next_free_cluster = unknown_fsinfo_value
+	}
+
+	fsinfo.next_free = next_free_cluster
+	if fsinfo.free_count != unknown_fsinfo_value {
+		fsinfo.free_count = uint32(int64(fsinfo.free_count) - int64(clusters_used))
+	}
+}
+
+/*
+Get the size of a cluster in bytes.
+*/
+func ClusterSize[T FATSystem](fs T) uint32 {
 	common_bpb := fs.GetCommonBPB()
-	cluster_size := common_bpb.BPB_bytspersec * uint16(common_bpb.BPB_secperclus)
-	if _, err := disk_ref.Write(make([]byte, cluster_size)); err != nil {
+	return uint32(common_bpb.BPB_bytspersec) * uint32(common_bpb.BPB_secperclus)
+}
+
+/*
+Zero out a cluster for use.
+*/
+func ZeroCluster[T FATSystem](fs T, cluster uint32) error {
+	if _, err := fs.GetDiskRef().WriteAt(make([]byte, ClusterSize(fs)), int64(cluster)); err != nil {
 		return err
 	}
 
@@ -117,11 +488,6 @@ func SyncFileSystemData[T FATSystem](fs T) error {
 	disk_ref := fs.GetDiskRef()
 	common_bpb := fs.GetCommonBPB()
 
-	// Jump to FSInfo block
-	if err := seekToFSInfo(disk_ref, common_bpb); err != nil {
-		return err
-	}
-
 	// Write out FSInfo block
 	fsinfo := fs.GetFSInfo()
 	if fsinfo != nil {
@@ -130,29 +496,31 @@ func SyncFileSystemData[T FATSystem](fs T) error {
 		}
 	}
 
-	// Seek to FAT
-	if err := SeekToFAT(disk_ref, common_bpb); err != nil {
-		return err
-	}
-
-	// Write out FAT and Backup FAT
-	fat_short := fs.GetFATShort()
-	if fat_short != nil {
-		if err := fat_short.WriteFAT(disk_ref); err != nil {
-			return err
-		}
-		if err := fat_short.WriteFAT(disk_ref); err != nil {
-			return err
-		}
-	} else {
-		fat_int := fs.GetFATInt()
-		if err := fat_int.WriteFAT(disk_ref); err != nil {
-			return err
-		}
-		if err := fat_int.WriteFAT(disk_ref); err != nil {
-			return err
+	// Write out the FAT to each of its copies on the volume.
+	for n := 0; n < int(common_bpb.BPB_numfats); n++ {
+		fat_short := fs.GetFATShort()
+		if fat_short != nil {
+			if err := fat_short.WriteFAT(disk_ref, LookupFATBytes(fs, n)); err != nil {
+				return err
+			}
+		} else {
+			fat_int := fs.GetFATInt()
+			if err := fat_int.WriteFAT(disk_ref, LookupFATBytes(fs, n)); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
+
+/*
+Look up the location in bytes of the nth copy of the FAT.
+*/
+func LookupFATBytes[T FATSystem](fs T, n int) int64 {
+	common_bpb := fs.GetCommonBPB()
+
+	fat_sectors := int64(FATSectors(fs))
+	reserved_sectors := int64(common_bpb.BPB_rsvdseccnt)
+	return (reserved_sectors + int64(n)*fat_sectors) * int64(common_bpb.BPB_bytspersec)
+}
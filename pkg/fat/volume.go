@@ -0,0 +1,154 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/zni/fslib/internal/utilities"
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+The type of FAT on a volume, as determined by its count of clusters.
+*/
+type FATType int
+
+const (
+	FAT_TYPE_12 FATType = 12
+	FAT_TYPE_16 FATType = 16
+	FAT_TYPE_32 FATType = 32
+)
+
+func (t FATType) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+/*
+Volume is a loaded FAT12, FAT16 or FAT32 volume, letting callers work with a
+volume without knowing its FAT type in advance.
+*/
+type Volume interface {
+	ReadFile(file_path string) (*FATFile, error)
+	ReadDir(dir_path string) ([]*FATFile, error)
+	ReadDirWithDots(dir_path string) ([]*FATFile, error)
+	Entries(dir_path string) iter.Seq2[*FATFile, error]
+
+	ReadAll(file *FATFile) (int, error)
+	Read(b []byte, file *FATFile) (int, error)
+
+	CreateDir(dir_path string) (*FATFile, error)
+	CreateFile(file_path string, data []byte) (*FATFile, error)
+	CreateFileFrom(file_path string, r io.Reader) (*FATFile, error)
+	Remove(file_path string) error
+	Rename(old_path string, new_path string) error
+	CompactDir(dir_path string) error
+
+	Open(file_path string) (Handle, error)
+	OpenFile(file_path string, flag int) (Handle, error)
+
+	Check() (*CheckReport, error)
+	Repair() (*RepairReport, error)
+
+	Type() FATType
+	PrintInfo()
+	Close() error
+}
+
+var _ Volume = (*FAT12)(nil)
+var _ Volume = (*FAT16)(nil)
+var _ Volume = (*FAT32)(nil)
+
+/*
+Load a volume's information into memory, picking FAT12, FAT16 or FAT32 from the
+count of clusters on the volume rather than the BS_filsystype string.
+*/
+func Open(path string) (Volume, error) {
+	dev, err := OpenFileDevice(path)
+	if err != nil {
+		return nil, &fs.FSError{Op: "Open", Path: path, Err: err}
+	}
+
+	vol, err := OpenDevice(dev)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+/*
+Load the information of the volume on a device into memory, picking FAT12,
+FAT16 or FAT32 the same way as Open. Closing the volume closes the device, if
+it can be closed.
+*/
+func OpenDevice(dev BlockDevice) (Volume, error) {
+	fat_type, err := DetectFATType(dev)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "Open",
+			Path: deviceName(dev),
+			Err:  fmt.Errorf("failed to read BPB: %w", err),
+		}
+	}
+
+	switch fat_type {
+	case FAT_TYPE_12:
+		return LoadFAT12Device(dev)
+	case FAT_TYPE_16:
+		return LoadFAT16Device(dev)
+	default:
+		return LoadDevice(dev)
+	}
+}
+
+/*
+Work out the FAT type of the volume from its boot sector, following the
+Microsoft specification: the count of data clusters alone decides the type.
+*/
+func DetectFATType(dev BlockDevice) (FATType, error) {
+	f := io.NewSectionReader(dev, 0, dev.Size())
+	bpb, err := ReadCommonBPB(f)
+	if err != nil {
+		return 0, err
+	}
+	if bpb.BPB_bytspersec == 0 || bpb.BPB_secperclus == 0 {
+		return 0, errors.New("invalid BPB")
+	}
+
+	// BPB_fatsz32 directly follows the common BPB, and is only used when
+	// BPB_fatsz16 is 0.
+	int_ := make([]byte, 4)
+	if _, err := io.ReadFull(f, int_); err != nil {
+		return 0, err
+	}
+
+	bytes_per_sector := uint32(bpb.BPB_bytspersec)
+	root_dir_sectors := ((uint32(bpb.BPB_rootentcnt) * 32) + (bytes_per_sector - 1)) / bytes_per_sector
+
+	fat_sectors := uint32(bpb.BPB_fatsz16)
+	if fat_sectors == 0 {
+		fat_sectors = utilities.BytesToInt(int_)
+	}
+
+	total_sectors := uint32(bpb.BPB_totsec16)
+	if total_sectors == 0 {
+		total_sectors = bpb.BPB_totsec32
+	}
+
+	meta_sectors := uint32(bpb.BPB_rsvdseccnt) + uint32(bpb.BPB_numfats)*fat_sectors + root_dir_sectors
+	if meta_sectors >= total_sectors {
+		return 0, errors.New("invalid BPB")
+	}
+
+	count_of_clusters := (total_sectors - meta_sectors) / uint32(bpb.BPB_secperclus)
+	if count_of_clusters < max_fat12_clusters {
+		return FAT_TYPE_12, nil
+	} else if count_of_clusters < max_fat16_clusters {
+		return FAT_TYPE_16, nil
+	}
+
+	return FAT_TYPE_32, nil
+}
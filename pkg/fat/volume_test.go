@@ -0,0 +1,131 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/zni/fslib/internal/utilities"
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+Format an image of the given FAT type and size in memory.
+*/
+func formatImage(t *testing.T, fat_type FATType, size int64) []byte {
+	t.Helper()
+
+	dev := NewMemDevice(make([]byte, size))
+	if _, err := Format(dev, size, &FormatOptions{Type: fat_type}); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+
+	return dev.Bytes()
+}
+
+/*
+Load an image with the loader for its FAT type.
+*/
+func loadImage(fat_type FATType, image []byte) (Volume, error) {
+	dev := NewMemDevice(image)
+	switch fat_type {
+	case FAT_TYPE_12:
+		return LoadFAT12Device(dev)
+	case FAT_TYPE_16:
+		return LoadFAT16Device(dev)
+	}
+	return LoadDevice(dev)
+}
+
+var test_image_sizes = map[FATType]int64{
+	FAT_TYPE_12: 1440 * 1024,
+	FAT_TYPE_16: 20 * 1024 * 1024,
+	FAT_TYPE_32: 40 * 1024 * 1024,
+}
+
+func TestLoadEachFATType(t *testing.T) {
+	for fat_type, size := range test_image_sizes {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			image := formatImage(t, fat_type, size)
+
+			vol, err := loadImage(fat_type, image)
+			if err != nil {
+				t.Fatalf("loading %s: %v", fat_type, err)
+			}
+			if vol.Type() != fat_type {
+				t.Errorf("loaded a %s volume, not %s", vol.Type(), fat_type)
+			}
+			if _, err := vol.CreateFile("/a.txt", []byte("a")); err != nil {
+				t.Fatalf("CreateFile: %v", err)
+			}
+			assertClean(t, vol)
+
+			opened, err := OpenDevice(NewMemDevice(image))
+			if err != nil {
+				t.Fatalf("OpenDevice: %v", err)
+			}
+			if opened.Type() != fat_type {
+				t.Errorf("OpenDevice picked %s, not %s", opened.Type(), fat_type)
+			}
+			if _, err := opened.ReadFile("/A.TXT"); err != nil {
+				t.Errorf("ReadFile: %v", err)
+			}
+		})
+	}
+
+	// A volume's type is decided by its count of clusters, so each loader
+	// refuses the other types.
+	if _, err := LoadFAT12Device(NewMemDevice(formatImage(t, FAT_TYPE_16, test_image_sizes[FAT_TYPE_16]))); err == nil {
+		t.Errorf("LoadFAT12Device loaded a FAT16 volume")
+	}
+	if _, err := LoadFAT16Device(NewMemDevice(formatImage(t, FAT_TYPE_12, test_image_sizes[FAT_TYPE_12]))); err == nil {
+		t.Errorf("LoadFAT16Device loaded a FAT12 volume")
+	}
+}
+
+/*
+A way of damaging the BPB of an image.
+*/
+type bpbCorruption struct {
+	name    string
+	corrupt func(image []byte)
+}
+
+func TestLoadRejectsCorruptBPB(t *testing.T) {
+	corruptions := []bpbCorruption{
+		{"no sectors per cluster", func(image []byte) { image[13] = 0 }},
+		{"odd sector size", func(image []byte) { copy(image[11:13], utilities.ShortToBytes(500)) }},
+		{"no FATs", func(image []byte) { image[16] = 0 }},
+		{"too few sectors", func(image []byte) {
+			copy(image[19:21], utilities.ShortToBytes(0))
+			copy(image[32:36], utilities.IntToBytes(8))
+		}},
+	}
+
+	for fat_type, size := range test_image_sizes {
+		cases := corruptions
+		if fat_type == FAT_TYPE_32 {
+			cases = append(cases,
+				bpbCorruption{"root cluster 0", func(image []byte) { copy(image[44:48], utilities.IntToBytes(0)) }},
+				bpbCorruption{"root cluster past the end", func(image []byte) { copy(image[44:48], utilities.IntToBytes(0x0FFFFFF0)) }},
+			)
+		}
+
+		for _, c := range cases {
+			t.Run(fat_type.String()+"/"+c.name, func(t *testing.T) {
+				image := formatImage(t, fat_type, size)
+				c.corrupt(image)
+				before := bytes.Clone(image)
+
+				_, err := loadImage(fat_type, image)
+				var fs_err *fs.FSError
+				if !errors.As(err, &fs_err) {
+					t.Fatalf("loading gave %v, not an FSError", err)
+				}
+				if !bytes.Equal(image, before) {
+					t.Errorf("loading changed the image")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,803 @@
+package fat
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path"
+
+	"github.com/zni/fslib/internal/utilities"
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+Create a directory represented by the path.
+*/
+func createDir[T FATSystem](vol T, dir_path string) (*FATFile, error) {
+	// Validate the path and read in the containing directory.
+	dir_name, base_dir, err := prepareEntry(vol, dir_path, nil)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  err,
+		}
+	}
+
+	// Create our DIR entry.
+	dir_entry, err := CreateDIR(dir_name, DIR_ATTR_DIRECTORY)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to create DIR: %w", err),
+		}
+	}
+
+	// Compute the next free cluster to hold the contents of the directory.
+	free_cluster, err := NextFreeCluster(vol)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to get cluster: %w", err),
+		}
+	}
+	free_cluster_bytes := LookupClusterBytes(vol, free_cluster)
+	dir_entry.DIR_cluster_lo = uint16(free_cluster & 0x0000FFFF)
+	dir_entry.DIR_cluster_hi = uint16((free_cluster & 0xFFFF0000) >> 16)
+
+	// Zero the cluster where we'll store the contents of the new directory.
+	if err := ZeroCluster(vol, free_cluster_bytes); err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to zero cluster: %w", err),
+		}
+	}
+
+	// Create and write out the '.' and '..' entries.
+	dot_dir, err := CreateSystemDIR(".")
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to create '.' entry: %w", err),
+		}
+	}
+	dot_dir.DIR_cluster_lo = uint16(free_cluster & 0x0000FFFF)
+	dot_dir.DIR_cluster_hi = uint16((free_cluster & 0xFFFF0000) >> 16)
+	dot_dir_end_loc, err := WriteDIR(vol.GetDiskRef(), dot_dir, free_cluster_bytes)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to write '.' entry: %w", err),
+		}
+	}
+
+	dotdot_dir, err := CreateSystemDIR("..")
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to create '..' entry: %w", err),
+		}
+	}
+	parent_cluster := dotdotCluster(vol, base_dir)
+	dotdot_dir.DIR_cluster_lo = uint16(parent_cluster & 0x0000FFFF)
+	dotdot_dir.DIR_cluster_hi = uint16((parent_cluster & 0xFFFF0000) >> 16)
+	if _, err = WriteDIR(vol.GetDiskRef(), dotdot_dir, dot_dir_end_loc); err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to write '..' entry: %w", err),
+		}
+	}
+
+	// Mark the cluster with the '.' and '..' entries as end of cluster.
+	MarkEOC(vol, free_cluster)
+
+	// Write out the LDIR and DIR entries for the directory.
+	file, err := writeEntry(vol, base_dir, dir_name, dir_entry)
+	if err != nil {
+		releaseChain(vol, []uint32{free_cluster})
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  err,
+		}
+	}
+
+	// Update the FSInfo and write it out along with the FATs.
+	if err := updateFSInfo(vol, 1); err != nil {
+		return nil, &fs.FSError{
+			Op:   "CreateDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to sync volume info: %w", err),
+		}
+	}
+
+	return file, nil
+}
+
+func createFile[T FATSystem](vol T, op string, file_path string, r io.Reader) (*FATFile, error) {
+	// Validate the path and read in the containing directory.
+	file_name, base_dir, err := prepareEntry(vol, file_path, nil)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: file_path,
+			Err:  err,
+		}
+	}
+
+	// Create our DIR entry.
+	dir_entry, err := CreateDIR(file_name, DIR_ATTR_ARCHIVE)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: file_path,
+			Err:  fmt.Errorf("failed to create DIR: %w", err),
+		}
+	}
+
+	// Write the contents out to a fresh cluster chain.
+	chain, file_size, err := writeChain(vol, r)
+	if err != nil {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: file_path,
+			Err:  fmt.Errorf("failed to write contents: %w", err),
+		}
+	}
+	if len(chain) > 0 {
+		dir_entry.DIR_cluster_lo = uint16(chain[0] & 0x0000FFFF)
+		dir_entry.DIR_cluster_hi = uint16((chain[0] & 0xFFFF0000) >> 16)
+	}
+	dir_entry.DIR_filesize = file_size
+
+	// Write out the LDIR and DIR entries for the file.
+	file, err := writeEntry(vol, base_dir, file_name, dir_entry)
+	if err != nil {
+		releaseChain(vol, chain)
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: file_path,
+			Err:  err,
+		}
+	}
+
+	// Update the FSInfo and write it out along with the FATs.
+	if err := updateFSInfo(vol, len(chain)); err != nil {
+		return nil, &fs.FSError{
+			Op:   op,
+			Path: file_path,
+			Err:  fmt.Errorf("failed to sync volume info: %w", err),
+		}
+	}
+
+	return file, nil
+}
+
+/*
+Remove the file or empty directory represented by the path.
+*/
+func remove[T FATSystem](vol T, file_path string) error {
+	// '.' and '..' are entries of a directory pointing at itself and its
+	// parent, not files of their own.
+	if name := path.Base(file_path); name == "." || name == ".." {
+		return &fs.FSError{
+			Op:   "Remove",
+			Path: file_path,
+			Err:  fmt.Errorf("invalid path"),
+		}
+	}
+
+	file, err := readFile(vol, file_path)
+	if err != nil {
+		return &fs.FSError{
+			Op:   "Remove",
+			Path: file_path,
+			Err:  err,
+		}
+	}
+
+	// The root directory has no entry to remove.
+	if file.FSSpecificData.DIR_loc == 0 {
+		return &fs.FSError{
+			Op:   "Remove",
+			Path: file_path,
+			Err:  fmt.Errorf("cannot remove root directory"),
+		}
+	}
+
+	dir_entry := file.FSSpecificData.DIREntry
+	cluster := utilities.DirClusterToUint(
+		uint(dir_entry.DIR_cluster_lo),
+		uint(dir_entry.DIR_cluster_hi),
+	)
+
+	// Directories may only be removed once they hold nothing but '.' and '..'.
+	if IsDirectory(dir_entry) {
+		entries, err := readDirEntries(vol, cluster, false)
+		if err != nil {
+			return &fs.FSError{
+				Op:   "Remove",
+				Path: file_path,
+				Err:  fmt.Errorf("failed to read directory: %w", err),
+			}
+		}
+		if len(entries) > 0 {
+			return &fs.FSError{
+				Op:   "Remove",
+				Path: file_path,
+				Err:  fs.ErrNotEmpty,
+			}
+		}
+	}
+
+	// Mark each of the LDIR entries and the DIR entry as deleted.
+	slots, err := EntrySlots(vol, file)
+	if err != nil {
+		return &fs.FSError{
+			Op:   "Remove",
+			Path: file_path,
+			Err:  fmt.Errorf("failed to delete entry: %w", err),
+		}
+	}
+	for _, loc := range slots {
+		if err := MarkDIRDeleted(vol.GetDiskRef(), loc); err != nil {
+			return &fs.FSError{
+				Op:   "Remove",
+				Path: file_path,
+				Err:  fmt.Errorf("failed to delete entry: %w", err),
+			}
+		}
+	}
+
+	// Hand the file's clusters back to the FAT.
+	freed := FreeChain(vol, cluster)
+
+	// Update the FSInfo and write it out along with the FATs.
+	if err := updateFSInfo(vol, -freed); err != nil {
+		return &fs.FSError{
+			Op:   "Remove",
+			Path: file_path,
+			Err:  fmt.Errorf("failed to sync volume info: %w", err),
+		}
+	}
+
+	return nil
+}
+
+/*
+Rename the file or directory at old_path to new_path, moving it to a new
+containing directory if needed.
+*/
+func rename[T FATSystem](vol T, old_path string, new_path string) error {
+	if name := path.Base(old_path); name == "." || name == ".." {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: old_path,
+			Err:  fmt.Errorf("invalid path"),
+		}
+	}
+
+	if path.Clean(old_path) == path.Clean(new_path) {
+		return nil
+	}
+
+	file, err := readFile(vol, old_path)
+	if err != nil {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: old_path,
+			Err:  err,
+		}
+	}
+
+	// The root directory has no entry to rename.
+	if file.FSSpecificData.DIR_loc == 0 {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: old_path,
+			Err:  fmt.Errorf("cannot rename root directory"),
+		}
+	}
+
+	// Validate the new path and read in the new containing directory.
+	new_name, new_base_dir, err := prepareEntry(vol, new_path, file)
+	if err != nil {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: new_path,
+			Err:  err,
+		}
+	}
+
+	old_entry := file.FSSpecificData.DIREntry
+	cluster := utilities.DirClusterToUint(
+		uint(old_entry.DIR_cluster_lo),
+		uint(old_entry.DIR_cluster_hi),
+	)
+	old_base_dir, err := readFile(vol, path.Dir(old_path))
+	if err != nil {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: old_path,
+			Err:  fmt.Errorf("failed to read parent directory: %w", err),
+		}
+	}
+	parent_changed := dotdotCluster(vol, old_base_dir) != dotdotCluster(vol, new_base_dir)
+
+	// A directory can't be moved underneath itself.
+	if IsDirectory(old_entry) && parent_changed {
+		inside, err := isWithin(vol, path.Dir(new_path), cluster)
+		if err != nil {
+			return &fs.FSError{
+				Op:   "Rename",
+				Path: new_path,
+				Err:  err,
+			}
+		}
+		if inside {
+			return &fs.FSError{
+				Op:   "Rename",
+				Path: new_path,
+				Err:  fmt.Errorf("cannot move a directory into itself"),
+			}
+		}
+	}
+
+	// Build the new DIR entry, its short name is regenerated for the new
+	// containing directory when it's written out.
+	new_entry := *old_entry
+
+	slots, err := EntrySlots(vol, file)
+	if err != nil {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: old_path,
+			Err:  fmt.Errorf("failed to delete entry: %w", err),
+		}
+	}
+	deleteOldEntry := func() error {
+		for _, loc := range slots {
+			if err := MarkDIRDeleted(vol.GetDiskRef(), loc); err != nil {
+				return &fs.FSError{
+					Op:   "Rename",
+					Path: old_path,
+					Err:  fmt.Errorf("failed to delete entry: %w", err),
+				}
+			}
+		}
+		return nil
+	}
+
+	// Write out the new entries before deleting the old ones, so a failure
+	// part way through never loses the file. When only the case of the name
+	// changes the new path is the old entry, which has to go first so its
+	// short name is free for reuse, so its slots are saved to be put back if
+	// the new entries can't be written.
+	_, err = readFile(vol, new_path)
+	case_change := err == nil
+	var saved_slots [][]byte
+	if case_change {
+		for _, loc := range slots {
+			slot := make([]byte, 32)
+			if _, err := vol.GetDiskRef().ReadAt(slot, int64(loc)); err != nil {
+				return &fs.FSError{
+					Op:   "Rename",
+					Path: old_path,
+					Err:  fmt.Errorf("failed to read entry: %w", err),
+				}
+			}
+			saved_slots = append(saved_slots, slot)
+		}
+		if err := deleteOldEntry(); err != nil {
+			return err
+		}
+	}
+	if _, err := writeEntry(vol, new_base_dir, new_name, &new_entry); err != nil {
+		for i, slot := range saved_slots {
+			if _, restore_err := vol.GetDiskRef().WriteAt(slot, int64(slots[i])); restore_err != nil {
+				err = fmt.Errorf("%w, and failed to restore the old entry: %w", err, restore_err)
+				break
+			}
+		}
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: new_path,
+			Err:  err,
+		}
+	}
+	if !case_change {
+		if err := deleteOldEntry(); err != nil {
+			return err
+		}
+	}
+
+	// Point the '..' entry of a moved directory at its new parent.
+	if IsDirectory(old_entry) && parent_changed {
+		if err := updateDotDot(vol, cluster, dotdotCluster(vol, new_base_dir)); err != nil {
+			return &fs.FSError{
+				Op:   "Rename",
+				Path: new_path,
+				Err:  fmt.Errorf("failed to update '..' entry: %w", err),
+			}
+		}
+	}
+
+	// The new containing directory may have grown, so write out the FATs.
+	if err := SyncFileSystemData(vol); err != nil {
+		return &fs.FSError{
+			Op:   "Rename",
+			Path: new_path,
+			Err:  fmt.Errorf("failed to sync volume info: %w", err),
+		}
+	}
+
+	return nil
+}
+
+/*
+Rewrite the directory represented by the path so its live entries sit back to
+back, squeezing out deleted entries and releasing the clusters on the end of the
+directory that are no longer needed. Entries move on disk, so any File read from
+the directory beforehand is out of date afterwards.
+*/
+func compactDir[T FATSystem](vol T, dir_path string) error {
+	dir, err := readFile(vol, dir_path)
+	if err != nil {
+		return &fs.FSError{
+			Op:   "CompactDir",
+			Path: dir_path,
+			Err:  err,
+		}
+	}
+
+	if !IsDirectory(dir.FSSpecificData.DIREntry) {
+		return &fs.FSError{
+			Op:   "CompactDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("not a directory"),
+		}
+	}
+
+	cluster := utilities.DirClusterToUint(
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+
+	// Read in every entry worth keeping, including '.', '..' and the volume label.
+	var files []*FATFile
+	reader := NewDirReader(vol, cluster)
+	for {
+		file, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &fs.FSError{
+				Op:   "CompactDir",
+				Path: dir_path,
+				Err:  fmt.Errorf("failed to read directory: %w", err),
+			}
+		}
+
+		if file.FSSpecificData.DIREntry.DIR_name[0] != deleted_entry {
+			files = append(files, file)
+		}
+	}
+
+	var chain []uint32
+	slots_per_cluster := int(ClusterSize(vol) / 32)
+	if cluster == 0 {
+		// The fixed root directory of a FAT12 or FAT16 volume is a single
+		// region rather than a chain of clusters.
+		chain = []uint32{0}
+		slots_per_cluster = int(vol.GetCommonBPB().BPB_rootentcnt)
+	} else {
+		for _, c := range ClusterChain(vol, cluster) {
+			chain = append(chain, c)
+		}
+	}
+
+	slot_loc := func(index int) uint32 {
+		return LookupClusterBytes(vol, chain[index/slots_per_cluster]) + uint32(32*(index%slots_per_cluster))
+	}
+
+	// Write the entries back out from the start of the directory.
+	index := 0
+	for _, file := range files {
+		dir_entry := file.FSSpecificData.DIREntry
+
+		// LDIRs that don't belong to their DIR entry are dropped.
+		ldirs := file.FSSpecificData.LDIREntry
+		if len(ldirs) > 0 && ldirs[0].chksum != computeShortChecksum(dir_entry) {
+			ldirs = nil
+		}
+
+		for _, ldir := range ldirs {
+			if _, err := WriteLDIRs(vol.GetDiskRef(), []*LDIR{ldir}, int64(slot_loc(index))); err != nil {
+				return &fs.FSError{
+					Op:   "CompactDir",
+					Path: dir_path,
+					Err:  fmt.Errorf("failed to write LDIR entries: %w", err),
+				}
+			}
+			index++
+		}
+
+		if _, err := WriteDIR(vol.GetDiskRef(), dir_entry, slot_loc(index)); err != nil {
+			return &fs.FSError{
+				Op:   "CompactDir",
+				Path: dir_path,
+				Err:  fmt.Errorf("failed to write DIR entry: %w", err),
+			}
+		}
+		index++
+	}
+
+	// Clear out what's left of the last cluster still in use, which also
+	// leaves an end of directory marker after the last entry.
+	used_clusters := max(1, (index+slots_per_cluster-1)/slots_per_cluster)
+	if remaining := used_clusters*slots_per_cluster - index; remaining > 0 {
+		if _, err := vol.GetDiskRef().WriteAt(make([]byte, 32*remaining), int64(slot_loc(index))); err != nil {
+			return &fs.FSError{
+				Op:   "CompactDir",
+				Path: dir_path,
+				Err:  fmt.Errorf("failed to clear free entries: %w", err),
+			}
+		}
+	}
+
+	// Hand the clusters no longer needed back to the FAT.
+	freed := 0
+	if used_clusters < len(chain) {
+		freed = FreeChain(vol, chain[used_clusters])
+		MarkEOC(vol, chain[used_clusters-1])
+	}
+
+	// Update the FSInfo and write it out along with the FATs.
+	if err := updateFSInfo(vol, -freed); err != nil {
+		return &fs.FSError{
+			Op:   "CompactDir",
+			Path: dir_path,
+			Err:  fmt.Errorf("failed to sync volume info: %w", err),
+		}
+	}
+
+	return nil
+}
+
+/*
+Check that a new entry can be created at the path, returning the name of the
+new entry and its containing directory. Since lookups ignore case, the path may
+already resolve to the file being renamed when only the case of its name is
+changing.
+*/
+func prepareEntry[T FATSystem](vol T, file_path string, renaming *FATFile) (string, *FATFile, error) {
+	// Get the base path before our new entry.
+	file_name := path.Base(file_path)
+	if (file_name == "/") || (file_name == ".") || (file_name == "..") {
+		return "", nil, fmt.Errorf("invalid path")
+	}
+	if err := validLongName(file_name); err != nil {
+		return "", nil, fmt.Errorf("invalid name %q: %w", file_name, err)
+	}
+
+	// Check if this filename already exists.
+	if existing, err := readFile(vol, file_path); err == nil {
+		if renaming == nil || existing.FSSpecificData.DIR_loc != renaming.FSSpecificData.DIR_loc {
+			return "", nil, fs.ErrExist
+		}
+	}
+
+	// Read in the information for the containing directory.
+	base_dir, err := readFile(vol, path.Dir(file_path))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read parent directory: %w", err)
+	}
+	if !IsDirectory(base_dir.FSSpecificData.DIREntry) {
+		return "", nil, fmt.Errorf("parent is not a directory")
+	}
+
+	return file_name, base_dir, nil
+}
+
+/*
+Give a DIR entry a short name that's unique within the containing directory,
+create the LDIR entries for it if the name isn't a valid 8.3 name, and write
+them both out to the next free location in the containing directory.
+*/
+func writeEntry[T FATSystem](vol T, base_dir *FATFile, name string, dir_entry *DIR) (*FATFile, error) {
+	base_dir_cluster := utilities.DirClusterToUint(
+		uint(base_dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(base_dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+
+	// Generate the short name, adding a numeric tail if it's needed.
+	basis_name, lossy, err := CreateBasisName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DIR name: %w", err)
+	}
+	dir_format_name, err := UniqueShortName(vol, base_dir_cluster, basis_name, lossy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DIR name: %w", err)
+	}
+	dir_entry.DIR_name = dir_format_name
+	dir_entry.DIR_ntres = 0
+
+	// A name that reads back the same from the short name alone needs no LDIRs.
+	var ldirs []*LDIR
+	if name != ShortName(dir_entry) {
+		chksum := computeShortChecksum(dir_entry)
+		ldirs, err = CreateLDIRs(name, chksum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create LDIRs: %w", err)
+		}
+	}
+
+	// Find room for our DIR and LDIR entries, growing the directory if needed.
+	slots, err := GetFreeDIRSlots(vol, base_dir_cluster, len(ldirs)+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get free DIR entries: %w", err)
+	}
+
+	// The entries may cross into another cluster, so write them out a slot at a time.
+	for i, ldir := range ldirs {
+		if _, err := WriteLDIRs(vol.GetDiskRef(), []*LDIR{ldir}, slots[i]); err != nil {
+			return nil, fmt.Errorf("failed to write LDIR entries: %w", err)
+		}
+	}
+	dir_loc := uint32(slots[len(slots)-1])
+	if _, err = WriteDIR(vol.GetDiskRef(), dir_entry, dir_loc); err != nil {
+		return nil, fmt.Errorf("failed to write DIR entry: %w", err)
+	}
+
+	return &FATFile{
+		Name:    name,
+		Content: nil,
+		FSSpecificData: &FATFileData{
+			LDIR_loc:  uint32(slots[0]),
+			DIR_loc:   dir_loc,
+			LDIREntry: ldirs,
+			DIREntry:  dir_entry,
+		},
+	}, nil
+}
+
+/*
+Get the cluster a '..' entry uses to refer to the given directory. The root
+directory is always referred to as cluster 0.
+*/
+func dotdotCluster[T FATSystem](vol T, dir *FATFile) uint32 {
+	cluster := utilities.DirClusterToUint(
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+	if cluster == RootCluster(vol) {
+		return 0
+	}
+
+	return cluster
+}
+
+/*
+Rewrite the '..' entry of the directory at the given cluster to point at parent_cluster.
+*/
+func updateDotDot[T FATSystem](vol T, cluster uint32, parent_cluster uint32) error {
+	dotdot_loc := LookupClusterBytes(vol, cluster) + 32
+	dotdot_dir, err := ReadDIR(vol.GetDiskRef(), dotdot_loc)
+	if err != nil {
+		return err
+	}
+	if string(dotdot_dir.DIR_name) != "..         " {
+		return fmt.Errorf("directory has no '..' entry")
+	}
+
+	dotdot_dir.DIR_cluster_lo = uint16(parent_cluster & 0x0000FFFF)
+	dotdot_dir.DIR_cluster_hi = uint16((parent_cluster & 0xFFFF0000) >> 16)
+	if _, err := WriteDIR(vol.GetDiskRef(), dotdot_dir, dotdot_loc); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+Is the directory at dir_path, or any directory above it, the directory stored
+at the given cluster?
+*/
+func isWithin[T FATSystem](vol T, dir_path string, cluster uint32) (bool, error) {
+	for current := path.Clean(dir_path); ; current = path.Dir(current) {
+		dir, err := readFile(vol, current)
+		if err != nil {
+			return false, err
+		}
+
+		dir_cluster := utilities.DirClusterToUint(
+			uint(dir.FSSpecificData.DIREntry.DIR_cluster_lo),
+			uint(dir.FSSpecificData.DIREntry.DIR_cluster_hi),
+		)
+		if dir_cluster == cluster {
+			return true, nil
+		}
+
+		if current == "/" || current == "." {
+			return false, nil
+		}
+	}
+}
+
+/*
+Write everything read from r into a newly allocated cluster chain, returning the
+clusters of the chain and the number of bytes written.
+*/
+func writeChain[T FATSystem](vol T, r io.Reader) ([]uint32, uint32, error) {
+	buffer := make([]byte, ClusterSize(vol))
+
+	var chain []uint32
+	var total_bytes uint64 = 0
+	var next_cluster uint32 = 2
+	for {
+		bytes_read, read_err := io.ReadFull(r, buffer)
+		if bytes_read > 0 {
+			total_bytes += uint64(bytes_read)
+			if total_bytes > math.MaxUint32 {
+				releaseChain(vol, chain)
+				return nil, 0, fmt.Errorf("file larger than 4GiB")
+			}
+
+			// Grab a cluster and link it on to the end of the chain.
+			cluster, err := AllocateCluster(vol, next_cluster)
+			if err != nil {
+				releaseChain(vol, chain)
+				return nil, 0, err
+			}
+			if len(chain) > 0 {
+				LinkCluster(vol, chain[len(chain)-1], cluster)
+			}
+			chain = append(chain, cluster)
+			next_cluster = cluster + 1
+
+			// Pad out the last cluster with zeroes.
+			clear(buffer[bytes_read:])
+			if _, err := vol.GetDiskRef().WriteAt(buffer, int64(LookupClusterBytes(vol, cluster))); err != nil {
+				releaseChain(vol, chain)
+				return nil, 0, err
+			}
+		}
+
+		if read_err == io.EOF || read_err == io.ErrUnexpectedEOF {
+			break
+		}
+		if read_err != nil {
+			releaseChain(vol, chain)
+			return nil, 0, read_err
+		}
+	}
+
+	return chain, uint32(total_bytes), nil
+}
+
+/*
+Mark every cluster in the chain as free again.
+*/
+func releaseChain[T FATSystem](vol T, chain []uint32) {
+	for _, cluster := range chain {
+		LinkCluster(vol, cluster, 0)
+	}
+}
+
+/*
+Update the FSInfo to account for newly used clusters (or freed clusters, when
+negative), then write it out along with the FATs.
+*/
+func updateFSInfo[T FATSystem](vol T, clusters_used int) error {
+	UpdateFSInfo(vol, clusters_used)
+
+	return SyncFileSystemData(vol)
+}
@@ -0,0 +1,251 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/zni/fslib/internal/utilities"
+	fs "github.com/zni/fslib/pkg/fs/common"
+)
+
+/*
+Fail the test if the volume's checker finds anything wrong with it.
+*/
+func assertClean(t *testing.T, vol Volume) {
+	t.Helper()
+
+	report, err := vol.Check()
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	for _, problem := range report.Problems {
+		t.Errorf("%s", problem)
+	}
+}
+
+/*
+Get the first cluster of a file from its DIR entry.
+*/
+func firstCluster(file *FATFile) uint32 {
+	return utilities.DirClusterToUint(
+		uint(file.FSSpecificData.DIREntry.DIR_cluster_lo),
+		uint(file.FSSpecificData.DIREntry.DIR_cluster_hi),
+	)
+}
+
+/*
+Fail the test unless the '..' entry of the directory at dir_path refers to the
+directory at parent_path, which is cluster 0 for the root directory.
+*/
+func assertDotDot(t *testing.T, vol Volume, dir_path string, parent_path string) {
+	t.Helper()
+
+	var want uint32
+	if parent_path != "/" {
+		parent, err := vol.ReadFile(parent_path)
+		if err != nil {
+			t.Fatalf("ReadFile(%q): %v", parent_path, err)
+		}
+		want = firstCluster(parent)
+	}
+
+	entries, err := vol.ReadDirWithDots(dir_path)
+	if err != nil {
+		t.Fatalf("ReadDirWithDots(%q): %v", dir_path, err)
+	}
+	for _, entry := range entries {
+		if entry.Name == ".." {
+			if cluster := firstCluster(entry); cluster != want {
+				t.Errorf("'..' of %s refers to cluster %d, not %d", dir_path, cluster, want)
+			}
+			return
+		}
+	}
+	t.Errorf("%s has no '..' entry", dir_path)
+}
+
+func TestRemoveRejectsDotEntries(t *testing.T) {
+	vol, err := NewMemVolume(4*1024*1024, nil)
+	if err != nil {
+		t.Fatalf("NewMemVolume: %v", err)
+	}
+	if _, err := vol.CreateDir("/b"); err != nil {
+		t.Fatalf("CreateDir: %v", err)
+	}
+
+	for _, name := range []string{"/b/.", "/b/.."} {
+		if err := vol.Remove(name); err == nil {
+			t.Errorf("Remove(%q) succeeded", name)
+		}
+		if err := vol.Rename(name, "/c"); err == nil {
+			t.Errorf("Rename(%q) succeeded", name)
+		}
+	}
+
+	// The directory's clusters must still be in use, so a new file can't be
+	// given one of them.
+	if _, err := vol.CreateFile("/z", []byte("z")); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	assertClean(t, vol)
+
+	if err := vol.Remove("/b"); err != nil {
+		t.Fatalf("Remove(%q): %v", "/b", err)
+	}
+	if _, err := vol.ReadFile("/b"); err == nil {
+		t.Errorf("/b still exists after Remove")
+	}
+	assertClean(t, vol)
+}
+
+func TestRenameCaseOnlyKeepsFileWhenDirectoryIsFull(t *testing.T) {
+	vol, err := NewMemVolume(20*1024*1024, &FormatOptions{Type: FAT_TYPE_16})
+	if err != nil {
+		t.Fatalf("NewMemVolume: %v", err)
+	}
+
+	// Fill every slot of the fixed root directory with short names.
+	for i := 0; i < 512; i++ {
+		name := fmt.Sprintf("/F%d", i)
+		if _, err := vol.CreateFile(name, []byte(name)); err != nil {
+			t.Fatalf("CreateFile(%q): %v", name, err)
+		}
+	}
+
+	// The lower case name needs an LDIR as well, which doesn't fit.
+	if err := vol.Rename("/F0", "/f0"); err == nil {
+		t.Fatalf("Rename succeeded in a full root directory")
+	}
+
+	file, err := vol.ReadFile("/F0")
+	if err != nil {
+		t.Fatalf("/F0 lost after failed rename: %v", err)
+	}
+	if file.Name != "F0" {
+		t.Errorf("file is named %q, not %q", file.Name, "F0")
+	}
+	assertClean(t, vol)
+}
+
+func TestCreateFileReadsBack(t *testing.T) {
+	vol, err := NewMemVolume(4*1024*1024, nil)
+	if err != nil {
+		t.Fatalf("NewMemVolume: %v", err)
+	}
+
+	contents := bytes.Repeat([]byte("several clusters "), 300)
+	if _, err := vol.CreateFile("/big.txt", contents); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if _, err := vol.CreateFileFrom("/streamed.txt", bytes.NewReader(contents)); err != nil {
+		t.Fatalf("CreateFileFrom: %v", err)
+	}
+	if _, err := vol.CreateFile("/BIG.TXT", nil); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("CreateFile over an existing file gave %v, not ErrExist", err)
+	}
+
+	for _, name := range []string{"/big.txt", "/streamed.txt"} {
+		file, err := vol.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile(%q): %v", name, err)
+		}
+		if _, err := vol.ReadAll(file); err != nil {
+			t.Fatalf("ReadAll(%q): %v", name, err)
+		}
+		if !bytes.Equal(file.Content, contents) {
+			t.Errorf("%s holds %d bytes that differ from the %d written", name, len(file.Content), len(contents))
+		}
+	}
+	assertClean(t, vol)
+}
+
+func TestCreateFileRejectsNamesWindowsCantOpen(t *testing.T) {
+	vol, err := NewMemVolume(4*1024*1024, nil)
+	if err != nil {
+		t.Fatalf("NewMemVolume: %v", err)
+	}
+	if _, err := vol.CreateFile("/file.txt", nil); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	for _, name := range []string{"trailing.", "trailing ", " leading", "..x", "...", "a:b", "tab\tname"} {
+		if _, err := vol.CreateFile("/"+name, nil); err == nil {
+			t.Errorf("CreateFile(%q) succeeded", name)
+		}
+		if _, err := vol.CreateDir("/" + name); err == nil {
+			t.Errorf("CreateDir(%q) succeeded", name)
+		}
+		if err := vol.Rename("/file.txt", "/"+name); err == nil {
+			t.Errorf("Rename to %q succeeded", name)
+		}
+	}
+
+	// Leading periods and embedded spaces are fine.
+	for _, name := range []string{".hidden", "a name.with dots.txt"} {
+		if _, err := vol.CreateFile("/"+name, nil); err != nil {
+			t.Errorf("CreateFile(%q): %v", name, err)
+		}
+	}
+	assertClean(t, vol)
+}
+
+func TestRenameMovesAcrossDirectories(t *testing.T) {
+	for _, fat_type := range []FATType{FAT_TYPE_12, FAT_TYPE_16, FAT_TYPE_32} {
+		t.Run(fat_type.String(), func(t *testing.T) {
+			vol := newFixture(t, fat_type)
+
+			// Moving a directory takes its contents along and repoints its '..'.
+			if err := vol.Rename("/docs/nested", "/empty/Moved Here"); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+			if _, err := vol.ReadFile("/docs/nested"); err == nil {
+				t.Errorf("/docs/nested still exists after Rename")
+			}
+			file, err := vol.ReadFile("/empty/Moved Here/A Long File Name.txt")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if _, err := vol.ReadAll(file); err != nil || string(file.Content) != "a file with a long name\n" {
+				t.Errorf("moved file holds %q, %v", file.Content, err)
+			}
+			assertDotDot(t, vol, "/empty/Moved Here", "/empty")
+
+			if err := vol.Rename("/empty/Moved Here", "/top"); err != nil {
+				t.Fatalf("Rename to the root directory: %v", err)
+			}
+			assertDotDot(t, vol, "/top", "/")
+
+			// A directory can't be moved underneath itself.
+			if _, err := vol.CreateDir("/top/inner"); err != nil {
+				t.Fatalf("CreateDir: %v", err)
+			}
+			for _, new_path := range []string{"/top/top", "/top/inner/top"} {
+				if err := vol.Rename("/top", new_path); err == nil {
+					t.Errorf("Rename(%q, %q) succeeded", "/top", new_path)
+				}
+			}
+			assertDotDot(t, vol, "/top/inner", "/top")
+
+			// Renaming a file in place gives it a short name to match.
+			if err := vol.Rename("/hello.txt", "/Greetings to everyone.txt"); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+			if _, err := vol.ReadFile("/hello.txt"); err == nil {
+				t.Errorf("/hello.txt still exists after Rename")
+			}
+			file, err = vol.ReadFile("/Greetings to everyone.txt")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if name := ShortName(file.FSSpecificData.DIREntry); name != "GREETI~1.TXT" {
+				t.Errorf("renamed file has short name %q", name)
+			}
+			if _, err := vol.ReadAll(file); err != nil || string(file.Content) != "hello, world\n" {
+				t.Errorf("renamed file holds %q, %v", file.Content, err)
+			}
+			assertClean(t, vol)
+		})
+	}
+}
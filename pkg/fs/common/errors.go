@@ -1,6 +1,17 @@
 package common
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+var (
+	ErrNotExist = fs.ErrNotExist
+	ErrExist    = fs.ErrExist
+	ErrNotEmpty = errors.New("directory not empty")
+	ErrClosed   = fs.ErrClosed
+)
 
 type FSError struct {
 	Op   string
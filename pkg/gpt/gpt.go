@@ -0,0 +1,593 @@
+package gpt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/zni/fslib/internal/utilities"
+	"github.com/zni/fslib/pkg/mbr"
+)
+
+const header_signature string = "EFI PART"
+const header_revision uint32 = 0x00010000
+const min_header_size uint32 = 92
+const min_entry_size uint32 = 128
+const name_length int = 36
+
+// The number of entries in the partition entry arrays of a new table.
+const default_entries uint32 = 128
+
+// Guards against headers claiming an absurd number of partition entries, or
+// absurdly large ones.
+const max_entries uint32 = 1024
+const max_entry_size uint32 = 4096
+
+var ErrNoGPT = errors.New("no GPT partition table")
+
+/*
+GUID is a globally unique identifier, held in the mixed endian byte order it's
+stored in on disk.
+*/
+type GUID [16]byte
+
+// Partition type GUIDs.
+var (
+	TYPE_UNUSED         = GUID{}
+	TYPE_EFI_SYSTEM     = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TYPE_BASIC_DATA     = MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	TYPE_LINUX_FS       = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	TYPE_BIOS_BOOT      = MustParseGUID("21686148-6449-6E6F-744E-656564454649")
+	TYPE_MICROSOFT_RSVD = MustParseGUID("E3C9E316-0B5C-4DB8-817D-F92DF00215AE")
+)
+
+/*
+Parse a GUID written in its usual form, such as
+C12A7328-F81F-11D2-BA4B-00A0C93EC93B.
+*/
+func ParseGUID(s string) (GUID, error) {
+	var guid GUID
+	fields := strings.Split(s, "-")
+	if len(fields) != 5 || len(fields[0]) != 8 || len(fields[1]) != 4 || len(fields[2]) != 4 || len(fields[3]) != 4 || len(fields[4]) != 12 {
+		return guid, fmt.Errorf("invalid GUID %q", s)
+	}
+
+	b, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return guid, fmt.Errorf("invalid GUID %q", s)
+	}
+
+	// The first three fields are stored little endian.
+	copy(guid[:], b)
+	guid[0], guid[1], guid[2], guid[3] = b[3], b[2], b[1], b[0]
+	guid[4], guid[5] = b[5], b[4]
+	guid[6], guid[7] = b[7], b[6]
+
+	return guid, nil
+}
+
+/*
+Parse a GUID, panicking if it's invalid. Meant for GUIDs known in advance.
+*/
+func MustParseGUID(s string) GUID {
+	guid, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return guid
+}
+
+/*
+Generate a random GUID, as used for a new disk or partition.
+*/
+func NewGUID() (GUID, error) {
+	var guid GUID
+	if _, err := rand.Read(guid[:]); err != nil {
+		return guid, err
+	}
+
+	// Mark the GUID as a version 4, variant 1 GUID.
+	guid[7] = guid[7]&0x0F | 0x40
+	guid[8] = guid[8]&0x3F | 0x80
+
+	return guid, nil
+}
+
+func (guid GUID) String() string {
+	return fmt.Sprintf("%02X%02X%02X%02X-%02X%02X-%02X%02X-%02X%02X-%X",
+		guid[3], guid[2], guid[1], guid[0],
+		guid[5], guid[4],
+		guid[7], guid[6],
+		guid[8], guid[9],
+		guid[10:])
+}
+
+/*
+Partition is an entry of a GPT partition table. Partitions are numbered from 1
+by their slot in the partition entry array.
+*/
+type Partition struct {
+	Index      int
+	Type       GUID
+	GUID       GUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       string
+}
+
+/*
+Does the partition type say the partition may hold a FAT volume?
+*/
+func (p *Partition) IsFAT() bool {
+	return p.Type == TYPE_EFI_SYSTEM || p.Type == TYPE_BASIC_DATA
+}
+
+/*
+The location of the partition in bytes from the start of the disk.
+*/
+func (p *Partition) Offset(sector_size int) int64 {
+	return int64(p.FirstLBA) * int64(sector_size)
+}
+
+/*
+The size of the partition in bytes.
+*/
+func (p *Partition) Size(sector_size int) int64 {
+	return int64(p.LastLBA-p.FirstLBA+1) * int64(sector_size)
+}
+
+func (p *Partition) String() string {
+	return fmt.Sprintf("partition %d %q: type %s, sectors %d-%d", p.Index, p.Name, p.Type, p.FirstLBA, p.LastLBA)
+}
+
+/*
+Header is a GPT header, of which a disk has a primary copy in its second sector
+and a backup copy in its last sector.
+*/
+type Header struct {
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	MyLBA          uint64
+	AlternateLBA   uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       GUID
+	EntriesLBA     uint64
+	EntryCount     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+/*
+Table is a GPT partition table. Either of its headers may be damaged, as long
+as the other is intact.
+*/
+type Table struct {
+	Primary    *Header
+	Backup     *Header
+	Partitions []*Partition
+
+	// Problems found with the headers, which were worked around by using the
+	// other copy.
+	Problems []string
+}
+
+/*
+Get the partition in the given slot of the partition entry array.
+*/
+func (table *Table) Partition(index int) (*Partition, error) {
+	for _, p := range table.Partitions {
+		if p.Index == index {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no partition %d", index)
+}
+
+/*
+Selector picks a partition by its index, name or type GUID. A partition has to
+match every field that's set, and the first that does is picked.
+*/
+type Selector struct {
+	Index int
+	Name  string
+	Type  GUID
+}
+
+func (sel Selector) String() string {
+	var fields []string
+	if sel.Index != 0 {
+		fields = append(fields, fmt.Sprintf("index %d", sel.Index))
+	}
+	if sel.Name != "" {
+		fields = append(fields, fmt.Sprintf("name %q", sel.Name))
+	}
+	if sel.Type != TYPE_UNUSED {
+		fields = append(fields, fmt.Sprintf("type %s", sel.Type))
+	}
+
+	return strings.Join(fields, ", ")
+}
+
+/*
+Find the first partition matched by the selector.
+*/
+func (table *Table) Find(sel Selector) (*Partition, error) {
+	if sel == (Selector{}) {
+		return nil, errors.New("empty partition selector")
+	}
+
+	for _, p := range table.Partitions {
+		if (sel.Index == 0 || p.Index == sel.Index) &&
+			(sel.Name == "" || p.Name == sel.Name) &&
+			(sel.Type == TYPE_UNUSED || p.Type == sel.Type) {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no partition with %s", sel)
+}
+
+/*
+Read the GPT partition table of a disk of the given size. The protective MBR is
+checked first, then both GPT headers and their partition entry arrays are
+checked against their CRC32s. The table is read from the primary header if it's
+intact, and from the backup header otherwise. Returns ErrNoGPT when the disk
+doesn't have a protective MBR or has no intact GPT header.
+*/
+func Read(r io.ReaderAt, sector_size int, size int64) (*Table, error) {
+	if sector_size < 512 || size < 3*int64(sector_size) {
+		return nil, ErrNoGPT
+	}
+
+	protective, err := mbr.Read(r, sector_size)
+	if err != nil || !protective.IsProtective() {
+		return nil, ErrNoGPT
+	}
+	if err := checkProtectiveMBR(protective); err != nil {
+		return nil, err
+	}
+
+	last_lba := uint64(size/int64(sector_size)) - 1
+	table := &Table{}
+
+	primary, primary_entries, primary_err := readHeader(r, sector_size, 1)
+	if primary_err == nil && primary.AlternateLBA != last_lba {
+		table.Problems = append(table.Problems, fmt.Sprintf("primary header puts the backup header at sector %d rather than the last sector %d", primary.AlternateLBA, last_lba))
+	}
+
+	backup_lba := last_lba
+	if primary_err == nil && primary.AlternateLBA <= last_lba {
+		backup_lba = primary.AlternateLBA
+	}
+	backup, backup_entries, backup_err := readHeader(r, sector_size, backup_lba)
+
+	if primary_err != nil {
+		table.Problems = append(table.Problems, fmt.Sprintf("primary header: %v", primary_err))
+	}
+	if backup_err != nil {
+		table.Problems = append(table.Problems, fmt.Sprintf("backup header: %v", backup_err))
+	}
+
+	entries := primary_entries
+	header := primary
+	switch {
+	case primary_err != nil && backup_err != nil:
+		return nil, fmt.Errorf("%w: %s", ErrNoGPT, strings.Join(table.Problems, "; "))
+	case primary_err != nil:
+		entries, header = backup_entries, backup
+	case backup_err == nil:
+		if primary.DiskGUID != backup.DiskGUID || primary.EntriesCRC != backup.EntriesCRC {
+			table.Problems = append(table.Problems, "primary and backup headers disagree")
+		}
+	}
+	if primary_err == nil {
+		table.Primary = primary
+	}
+	if backup_err == nil {
+		table.Backup = backup
+	}
+
+	table.Partitions, err = decodeEntries(header, entries, last_lba)
+	if err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+/*
+Check the protective MBR covers the disk from its second sector, as it has to
+for the disk to be read as a GPT disk.
+*/
+func checkProtectiveMBR(protective *mbr.Table) error {
+	for _, p := range protective.Partitions {
+		if p.Type == mbr.TYPE_GPT_PROTECTIVE && p.FirstLBA == 1 {
+			return nil
+		}
+	}
+
+	return errors.New("protective MBR partition doesn't start at sector 1")
+}
+
+/*
+Read the GPT header at the given sector along with its partition entry array,
+checking both against their CRC32s.
+*/
+func readHeader(r io.ReaderAt, sector_size int, lba uint64) (*Header, []byte, error) {
+	sector := make([]byte, sector_size)
+	if _, err := r.ReadAt(sector, int64(lba)*int64(sector_size)); err != nil {
+		return nil, nil, fmt.Errorf("failed to read sector %d: %w", lba, err)
+	}
+
+	if string(sector[0:8]) != header_signature {
+		return nil, nil, fmt.Errorf("no signature at sector %d", lba)
+	}
+
+	header := &Header{
+		Revision:       utilities.BytesToInt(sector[8:12]),
+		HeaderSize:     utilities.BytesToInt(sector[12:16]),
+		HeaderCRC:      utilities.BytesToInt(sector[16:20]),
+		MyLBA:          bytesToLong(sector[24:32]),
+		AlternateLBA:   bytesToLong(sector[32:40]),
+		FirstUsableLBA: bytesToLong(sector[40:48]),
+		LastUsableLBA:  bytesToLong(sector[48:56]),
+		EntriesLBA:     bytesToLong(sector[72:80]),
+		EntryCount:     utilities.BytesToInt(sector[80:84]),
+		EntrySize:      utilities.BytesToInt(sector[84:88]),
+		EntriesCRC:     utilities.BytesToInt(sector[88:92]),
+	}
+	copy(header.DiskGUID[:], sector[56:72])
+
+	if header.HeaderSize < min_header_size || header.HeaderSize > uint32(sector_size) {
+		return nil, nil, fmt.Errorf("invalid header size %d", header.HeaderSize)
+	}
+	if crc := headerCRC(sector[:header.HeaderSize]); crc != header.HeaderCRC {
+		return nil, nil, fmt.Errorf("header CRC32 is %08x but should be %08x", header.HeaderCRC, crc)
+	}
+	if header.MyLBA != lba {
+		return nil, nil, fmt.Errorf("header at sector %d says it's at sector %d", lba, header.MyLBA)
+	}
+	// Entries are 128 bytes, or 128 times some power of two.
+	entry_size := header.EntrySize
+	if entry_size < min_entry_size || entry_size > max_entry_size || entry_size&(entry_size-1) != 0 || header.EntryCount > max_entries {
+		return nil, nil, fmt.Errorf("invalid partition entry array of %d entries of %d bytes", header.EntryCount, header.EntrySize)
+	}
+
+	// Worked out in 64 bits, so a large count of large entries can't wrap.
+	entries := make([]byte, int64(header.EntryCount)*int64(header.EntrySize))
+	if _, err := r.ReadAt(entries, int64(header.EntriesLBA)*int64(sector_size)); err != nil {
+		return nil, nil, fmt.Errorf("failed to read partition entries: %w", err)
+	}
+	if crc := crc32.ChecksumIEEE(entries); crc != header.EntriesCRC {
+		return nil, nil, fmt.Errorf("partition entries CRC32 is %08x but should be %08x", header.EntriesCRC, crc)
+	}
+
+	return header, entries, nil
+}
+
+/*
+Work out the CRC32 of a header, which is taken with its own CRC32 field zeroed.
+*/
+func headerCRC(header []byte) uint32 {
+	zeroed := bytes.Clone(header)
+	clear(zeroed[16:20])
+
+	return crc32.ChecksumIEEE(zeroed)
+}
+
+/*
+Decode the used entries of a partition entry array.
+*/
+func decodeEntries(header *Header, entries []byte, last_lba uint64) ([]*Partition, error) {
+	var partitions []*Partition
+	for i := 0; i < int(header.EntryCount); i++ {
+		entry := entries[i*int(header.EntrySize) : (i+1)*int(header.EntrySize)]
+
+		var p Partition
+		copy(p.Type[:], entry[0:16])
+		if p.Type == TYPE_UNUSED {
+			continue
+		}
+		copy(p.GUID[:], entry[16:32])
+		p.Index = i + 1
+		p.FirstLBA = bytesToLong(entry[32:40])
+		p.LastLBA = bytesToLong(entry[40:48])
+		p.Attributes = bytesToLong(entry[48:56])
+		p.Name = decodeName(entry[56 : 56+2*name_length])
+
+		if p.FirstLBA > p.LastLBA || p.FirstLBA < header.FirstUsableLBA || p.LastLBA > header.LastUsableLBA || p.LastLBA > last_lba {
+			return nil, fmt.Errorf("%s lies outside the usable sectors", &p)
+		}
+		partitions = append(partitions, &p)
+	}
+
+	for i, a := range partitions {
+		for _, b := range partitions[i+1:] {
+			if a.FirstLBA <= b.LastLBA && b.FirstLBA <= a.LastLBA {
+				return nil, fmt.Errorf("%s overlaps %s", a, b)
+			}
+		}
+	}
+
+	return partitions, nil
+}
+
+/*
+Decode a partition name, which is stored as UTF-16 padded out with zeros.
+*/
+func decodeName(b []byte) string {
+	var units []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := utilities.BytesToShort(b[i : i+2])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units))
+}
+
+/*
+Get the range of sectors partitions may use on a new table written by Write for
+a disk of the given size, leaving room for the headers and partition entry
+arrays at each end of the disk. The range is empty, with first past last, when
+the disk is too small to hold a GPT at all.
+*/
+func UsableLBAs(sector_size int, size int64) (first uint64, last uint64) {
+	entry_sectors := entrySectors(sector_size)
+	first = 2 + entry_sectors
+
+	sectors := uint64(max(size/int64(sector_size), 0))
+	if sectors < first+1+entry_sectors+1 {
+		return first, first - 1
+	}
+
+	return first, sectors - 2 - entry_sectors
+}
+
+/*
+Write a new GPT partition table to a disk of the given size: a protective MBR,
+the primary header and partition entry array at the start of the disk, and the
+backup partition entry array and header at the end. Partitions go in the slot
+of the entry array given by their index.
+*/
+func Write(w io.WriterAt, sector_size int, size int64, disk_guid GUID, partitions []*Partition) error {
+	if sector_size < 512 || sector_size%512 != 0 {
+		return fmt.Errorf("invalid sector size %d", sector_size)
+	}
+
+	entry_sectors := entrySectors(sector_size)
+	first_usable, last_usable := UsableLBAs(sector_size, size)
+	if first_usable > last_usable {
+		return errors.New("disk too small for a GPT")
+	}
+	last_lba := uint64(size/int64(sector_size)) - 1
+
+	header := &Header{
+		Revision:       header_revision,
+		HeaderSize:     min_header_size,
+		FirstUsableLBA: first_usable,
+		LastUsableLBA:  last_usable,
+		DiskGUID:       disk_guid,
+		EntryCount:     default_entries,
+		EntrySize:      min_entry_size,
+	}
+
+	entries := make([]byte, default_entries*min_entry_size)
+	for _, p := range partitions {
+		if p.Index < 1 || p.Index > int(default_entries) {
+			return fmt.Errorf("can't write %s, only partitions 1 to %d", p, default_entries)
+		}
+		if p.Type == TYPE_UNUSED {
+			return fmt.Errorf("can't write %s without a type", p)
+		}
+		entry := entries[(p.Index-1)*int(min_entry_size):][:min_entry_size]
+		if GUID(entry[0:16]) != TYPE_UNUSED {
+			return fmt.Errorf("more than one partition %d", p.Index)
+		}
+		if err := encodeEntry(p, entry); err != nil {
+			return err
+		}
+	}
+	if _, err := decodeEntries(header, entries, last_lba); err != nil {
+		return err
+	}
+	header.EntriesCRC = crc32.ChecksumIEEE(entries)
+
+	protective_sectors := min(last_lba, 0xFFFFFFFF)
+	protective := &mbr.Table{Partitions: []*mbr.Partition{
+		{Number: 1, Type: mbr.TYPE_GPT_PROTECTIVE, FirstLBA: 1, Sectors: uint32(protective_sectors)},
+	}}
+	if err := mbr.Write(w, protective); err != nil {
+		return err
+	}
+
+	// The backup goes first, so a table interrupted part way through has no
+	// primary header pointing at it.
+	backup := *header
+	backup.MyLBA, backup.AlternateLBA, backup.EntriesLBA = last_lba, 1, last_lba-entry_sectors
+	primary := *header
+	primary.MyLBA, primary.AlternateLBA, primary.EntriesLBA = 1, last_lba, 2
+	for _, h := range []*Header{&backup, &primary} {
+		if _, err := w.WriteAt(entries, int64(h.EntriesLBA)*int64(sector_size)); err != nil {
+			return fmt.Errorf("failed to write partition entries: %w", err)
+		}
+
+		sector := make([]byte, sector_size)
+		h.encode(sector)
+		if _, err := w.WriteAt(sector, int64(h.MyLBA)*int64(sector_size)); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Encode a header into a sector, filling in its CRC32.
+*/
+func (header *Header) encode(sector []byte) {
+	copy(sector[0:8], header_signature)
+	copy(sector[8:12], utilities.IntToBytes(header.Revision))
+	copy(sector[12:16], utilities.IntToBytes(header.HeaderSize))
+	copy(sector[24:32], longToBytes(header.MyLBA))
+	copy(sector[32:40], longToBytes(header.AlternateLBA))
+	copy(sector[40:48], longToBytes(header.FirstUsableLBA))
+	copy(sector[48:56], longToBytes(header.LastUsableLBA))
+	copy(sector[56:72], header.DiskGUID[:])
+	copy(sector[72:80], longToBytes(header.EntriesLBA))
+	copy(sector[80:84], utilities.IntToBytes(header.EntryCount))
+	copy(sector[84:88], utilities.IntToBytes(header.EntrySize))
+	copy(sector[88:92], utilities.IntToBytes(header.EntriesCRC))
+
+	header.HeaderCRC = headerCRC(sector[:header.HeaderSize])
+	copy(sector[16:20], utilities.IntToBytes(header.HeaderCRC))
+}
+
+/*
+Encode a partition into its entry of a partition entry array.
+*/
+func encodeEntry(p *Partition, entry []byte) error {
+	name := utf16.Encode([]rune(p.Name))
+	if len(name) > name_length {
+		return fmt.Errorf("name of %s longer than %d UTF-16 code units", p, name_length)
+	}
+
+	copy(entry[0:16], p.Type[:])
+	copy(entry[16:32], p.GUID[:])
+	copy(entry[32:40], longToBytes(p.FirstLBA))
+	copy(entry[40:48], longToBytes(p.LastLBA))
+	copy(entry[48:56], longToBytes(p.Attributes))
+	for i, unit := range name {
+		copy(entry[56+2*i:58+2*i], utilities.ShortToBytes(unit))
+	}
+
+	return nil
+}
+
+/*
+The number of sectors taken up by the partition entry array of a new table.
+*/
+func entrySectors(sector_size int) uint64 {
+	return uint64((int(default_entries*min_entry_size) + sector_size - 1) / sector_size)
+}
+
+func longToBytes(l uint64) []byte {
+	return append(utilities.IntToBytes(uint32(l)), utilities.IntToBytes(uint32(l>>32))...)
+}
+
+func bytesToLong(b []byte) uint64 {
+	return uint64(utilities.BytesToInt(b[0:4])) | uint64(utilities.BytesToInt(b[4:8]))<<32
+}
@@ -0,0 +1,146 @@
+package gpt
+
+import (
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+const test_disk_size int64 = 4 * 1024 * 1024
+
+/*
+A disk held in memory.
+*/
+type memDisk []byte
+
+func (disk memDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(disk)) {
+		return 0, io.EOF
+	}
+	n := copy(p, disk[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (disk memDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(disk)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(disk[off:], p), nil
+}
+
+/*
+Write a GPT holding an EFI system partition and a data partition to a new disk.
+*/
+func newTestDisk(t *testing.T) (memDisk, []*Partition) {
+	t.Helper()
+
+	disk := make(memDisk, test_disk_size)
+	partitions := []*Partition{
+		{Index: 1, Type: TYPE_EFI_SYSTEM, GUID: MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4"), FirstLBA: 2048, LastLBA: 4095, Name: "ESP"},
+		{Index: 3, Type: TYPE_BASIC_DATA, GUID: MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"), FirstLBA: 4096, LastLBA: 8000, Name: "data"},
+	}
+	if err := Write(disk, 512, test_disk_size, MustParseGUID("12345678-9ABC-DEF0-1234-56789ABCDEF0"), partitions); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	return disk, partitions
+}
+
+/*
+Check a table read back holds the partitions that were written.
+*/
+func assertPartitions(t *testing.T, table *Table, partitions []*Partition) {
+	t.Helper()
+
+	if len(table.Partitions) != len(partitions) {
+		t.Fatalf("read %d partitions, not %d", len(table.Partitions), len(partitions))
+	}
+	for i, p := range table.Partitions {
+		if *p != *partitions[i] {
+			t.Errorf("read %+v, not %+v", *p, *partitions[i])
+		}
+	}
+}
+
+func TestWriteThenRead(t *testing.T) {
+	disk, partitions := newTestDisk(t)
+
+	table, err := Read(disk, 512, test_disk_size)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(table.Problems) != 0 {
+		t.Errorf("problems with an intact table: %v", table.Problems)
+	}
+	assertPartitions(t, table, partitions)
+
+	p, err := table.Find(Selector{Name: "data"})
+	if err != nil || p.Index != 3 {
+		t.Errorf("Find by name gave %v, %v", p, err)
+	}
+}
+
+func TestReadFallsBackToBackup(t *testing.T) {
+	disk, partitions := newTestDisk(t)
+	disk[512+20] ^= 0xFF
+
+	table, err := Read(disk, 512, test_disk_size)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if table.Primary != nil || table.Backup == nil || len(table.Problems) == 0 {
+		t.Errorf("damaged primary header wasn't reported: %v", table.Problems)
+	}
+	assertPartitions(t, table, partitions)
+}
+
+func TestReadRejectsHugeEntries(t *testing.T) {
+	disk, partitions := newTestDisk(t)
+
+	// 1024 entries of 4MiB each come to 4GiB, which is 0 in 32 bits, and
+	// the CRC32 of no bytes at all is 0.
+	header, _, err := readHeader(disk, 512, 1)
+	if err != nil {
+		t.Fatalf("readHeader: %v", err)
+	}
+	header.EntryCount, header.EntrySize, header.EntriesCRC = 1024, 4*1024*1024, 0
+	header.encode(disk[512:1024])
+
+	table, err := Read(disk, 512, test_disk_size)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if table.Primary != nil {
+		t.Errorf("primary header with %d byte entries was accepted", header.EntrySize)
+	}
+	assertPartitions(t, table, partitions)
+}
+
+func TestReadRejectsOddEntrySizes(t *testing.T) {
+	for _, entry_size := range []uint32{136, 192, 384} {
+		disk, partitions := newTestDisk(t)
+
+		header, entries, err := readHeader(disk, 512, 1)
+		if err != nil {
+			t.Fatalf("readHeader: %v", err)
+		}
+		// Give the header a CRC32 that matches, so only the size can give
+		// it away.
+		header.EntryCount, header.EntrySize = uint32(len(entries))/entry_size, entry_size
+		array := disk[header.EntriesLBA*512:][:header.EntryCount*entry_size]
+		header.EntriesCRC = crc32.ChecksumIEEE(array)
+		header.encode(disk[512:1024])
+
+		table, err := Read(disk, 512, test_disk_size)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if table.Primary != nil {
+			t.Errorf("primary header with %d byte entries was accepted", entry_size)
+		}
+		assertPartitions(t, table, partitions)
+	}
+}
@@ -0,0 +1,360 @@
+package mbr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zni/fslib/internal/utilities"
+)
+
+const disk_signature_offset int = 440
+const table_offset int = 446
+const entry_size int = 16
+const primary_entries int = 4
+const boot_signature uint16 = 0xAA55
+
+// Guards against EBR chains that loop back on themselves.
+const max_logical_partitions int = 128
+
+// Partition types.
+const (
+	TYPE_EMPTY          uint8 = 0x00
+	TYPE_FAT12          uint8 = 0x01
+	TYPE_FAT16_SMALL    uint8 = 0x04
+	TYPE_EXTENDED       uint8 = 0x05
+	TYPE_FAT16          uint8 = 0x06
+	TYPE_FAT32_CHS      uint8 = 0x0B
+	TYPE_FAT32_LBA      uint8 = 0x0C
+	TYPE_FAT16_LBA      uint8 = 0x0E
+	TYPE_EXTENDED_LBA   uint8 = 0x0F
+	TYPE_LINUX          uint8 = 0x83
+	TYPE_LINUX_EXTENDED uint8 = 0x85
+	TYPE_GPT_PROTECTIVE uint8 = 0xEE
+	TYPE_EFI_SYSTEM     uint8 = 0xEF
+)
+
+var ErrNoMBR = errors.New("no MBR partition table")
+
+/*
+Partition is an entry of an MBR partition table. Primary partitions are
+numbered 1 to 4 by their slot in the MBR, and logical partitions inside an
+extended partition are numbered from 5 in the order of their EBR chain.
+*/
+type Partition struct {
+	Number   int
+	Bootable bool
+	Type     uint8
+
+	// The first sector of the partition, counted from the start of the disk.
+	FirstLBA uint32
+	Sectors  uint32
+
+	// The sector holding the EBR that describes a logical partition, or 0 for
+	// a primary partition.
+	EBRLBA uint32
+}
+
+/*
+Is the partition an extended partition holding logical partitions?
+*/
+func (p *Partition) IsExtended() bool {
+	return isExtendedType(p.Type)
+}
+
+/*
+Is the partition a logical partition inside an extended partition?
+*/
+func (p *Partition) IsLogical() bool {
+	return p.EBRLBA != 0
+}
+
+/*
+Does the partition type say the partition holds a FAT volume?
+*/
+func (p *Partition) IsFAT() bool {
+	switch p.Type {
+	case TYPE_FAT12, TYPE_FAT16_SMALL, TYPE_FAT16, TYPE_FAT32_CHS, TYPE_FAT32_LBA, TYPE_FAT16_LBA, TYPE_EFI_SYSTEM:
+		return true
+	}
+
+	return false
+}
+
+/*
+The location of the partition in bytes from the start of the disk.
+*/
+func (p *Partition) Offset(sector_size int) int64 {
+	return int64(p.FirstLBA) * int64(sector_size)
+}
+
+/*
+The size of the partition in bytes.
+*/
+func (p *Partition) Size(sector_size int) int64 {
+	return int64(p.Sectors) * int64(sector_size)
+}
+
+func (p *Partition) String() string {
+	return fmt.Sprintf("partition %d: type %02x, sectors %d-%d", p.Number, p.Type, p.FirstLBA, uint64(p.FirstLBA)+uint64(p.Sectors)-1)
+}
+
+/*
+Table is an MBR partition table, along with the logical partitions found by
+following the EBR chain of its extended partition.
+*/
+type Table struct {
+	DiskSignature uint32
+	Partitions    []*Partition
+}
+
+/*
+Get the partition with the given number.
+*/
+func (table *Table) Partition(number int) (*Partition, error) {
+	for _, p := range table.Partitions {
+		if p.Number == number {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no partition %d", number)
+}
+
+/*
+Is the table a protective MBR, which marks the disk as using a GPT instead?
+*/
+func (table *Table) IsProtective() bool {
+	for _, p := range table.Partitions {
+		if p.Type == TYPE_GPT_PROTECTIVE {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Read the MBR partition table from the first sector of a disk, then read the
+logical partitions from the EBR chain of its extended partition, if it has one.
+Returns ErrNoMBR when the first sector doesn't hold a partition table, as is the
+case for a FAT volume that takes up the whole disk.
+*/
+func Read(r io.ReaderAt, sector_size int) (*Table, error) {
+	sector := make([]byte, 512)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return nil, fmt.Errorf("failed to read MBR: %w", err)
+	}
+
+	entries, err := decodeEntries(sector)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{DiskSignature: utilities.BytesToInt(sector[disk_signature_offset : disk_signature_offset+4])}
+	var extended *Partition
+	for i, entry := range entries {
+		if entry.Type == TYPE_EMPTY {
+			continue
+		}
+
+		entry.Number = i + 1
+		table.Partitions = append(table.Partitions, entry)
+		if entry.IsExtended() {
+			if extended != nil {
+				return nil, errors.New("MBR has more than one extended partition")
+			}
+			extended = entry
+		}
+	}
+
+	// A FAT volume that takes up the whole disk usually has nothing but zeros
+	// where the partition entries would be.
+	if len(table.Partitions) == 0 {
+		return nil, ErrNoMBR
+	}
+
+	if err := checkOverlaps(table.Partitions); err != nil {
+		return nil, err
+	}
+
+	if extended != nil {
+		logical, err := readLogicalPartitions(r, sector_size, extended)
+		if err != nil {
+			return nil, err
+		}
+		table.Partitions = append(table.Partitions, logical...)
+	}
+
+	return table, nil
+}
+
+/*
+Follow the EBR chain of an extended partition. Each EBR holds a logical
+partition, located relative to the EBR, and a link to the next EBR, located
+relative to the start of the extended partition.
+*/
+func readLogicalPartitions(r io.ReaderAt, sector_size int, extended *Partition) ([]*Partition, error) {
+	var logical []*Partition
+	sector := make([]byte, 512)
+	visited := make(map[uint32]bool)
+	ebr_lba := extended.FirstLBA
+	for {
+		if len(logical) >= max_logical_partitions || visited[ebr_lba] {
+			return nil, errors.New("EBR chain loops")
+		}
+		visited[ebr_lba] = true
+
+		if _, err := r.ReadAt(sector, int64(ebr_lba)*int64(sector_size)); err != nil {
+			return nil, fmt.Errorf("failed to read EBR at sector %d: %w", ebr_lba, err)
+		}
+
+		entries, err := decodeEntries(sector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EBR at sector %d: %w", ebr_lba, err)
+		}
+
+		if entry := entries[0]; entry.Type != TYPE_EMPTY {
+			entry.Number = primary_entries + len(logical) + 1
+			entry.FirstLBA += ebr_lba
+			entry.EBRLBA = ebr_lba
+			if !within(entry, extended) {
+				return nil, fmt.Errorf("logical %s lies outside the extended partition", entry)
+			}
+			logical = append(logical, entry)
+		}
+
+		next := entries[1]
+		if next.Type == TYPE_EMPTY {
+			return logical, nil
+		}
+		if !next.IsExtended() {
+			return nil, fmt.Errorf("EBR at sector %d links to a partition of type %02x", ebr_lba, next.Type)
+		}
+
+		ebr_lba = extended.FirstLBA + next.FirstLBA
+		if ebr_lba < extended.FirstLBA || ebr_lba >= extended.FirstLBA+extended.Sectors {
+			return nil, fmt.Errorf("EBR at sector %d lies outside the extended partition", ebr_lba)
+		}
+	}
+}
+
+/*
+Decode the four partition entries of an MBR or EBR sector, checking the sector
+really holds a partition table.
+*/
+func decodeEntries(sector []byte) ([]*Partition, error) {
+	if utilities.BytesToShort(sector[510:512]) != boot_signature {
+		return nil, ErrNoMBR
+	}
+
+	entries := make([]*Partition, primary_entries)
+	for i := range entries {
+		entry := sector[table_offset+i*entry_size : table_offset+(i+1)*entry_size]
+
+		// The boot indicator is the only field that's easy to tell apart
+		// from a FAT boot sector's code.
+		status := entry[0]
+		if status != 0x00 && status != 0x80 {
+			return nil, ErrNoMBR
+		}
+
+		entries[i] = &Partition{
+			Bootable: status == 0x80,
+			Type:     entry[4],
+			FirstLBA: utilities.BytesToInt(entry[8:12]),
+			Sectors:  utilities.BytesToInt(entry[12:16]),
+		}
+		if entries[i].Type != TYPE_EMPTY && (entries[i].FirstLBA == 0 || entries[i].Sectors == 0) {
+			return nil, ErrNoMBR
+		}
+	}
+
+	return entries, nil
+}
+
+/*
+Write the primary partitions of a table, along with its disk signature, to the
+first sector of a disk. The boot code in front of the partition table is left
+as it is. Logical partitions can't be written, as that would need an EBR chain.
+*/
+func Write(w io.WriterAt, table *Table) error {
+	sector := make([]byte, 512-disk_signature_offset)
+	copy(sector[0:4], utilities.IntToBytes(table.DiskSignature))
+
+	var numbered [primary_entries + 1]bool
+	for _, p := range table.Partitions {
+		if p.Number < 1 || p.Number > primary_entries || p.IsLogical() {
+			return fmt.Errorf("can't write %s, only primary partitions 1 to %d", p, primary_entries)
+		}
+		if p.Type == TYPE_EMPTY || p.FirstLBA == 0 || p.Sectors == 0 {
+			return fmt.Errorf("can't write empty %s", p)
+		}
+		if numbered[p.Number] {
+			return fmt.Errorf("more than one partition %d", p.Number)
+		}
+		numbered[p.Number] = true
+	}
+	if err := checkOverlaps(table.Partitions); err != nil {
+		return err
+	}
+
+	for _, p := range table.Partitions {
+		entry := sector[table_offset-disk_signature_offset+(p.Number-1)*entry_size:][:entry_size]
+		if p.Bootable {
+			entry[0] = 0x80
+		}
+		copy(entry[1:4], lbaToCHS(p.FirstLBA))
+		entry[4] = p.Type
+		copy(entry[5:8], lbaToCHS(p.FirstLBA+p.Sectors-1))
+		copy(entry[8:12], utilities.IntToBytes(p.FirstLBA))
+		copy(entry[12:16], utilities.IntToBytes(p.Sectors))
+	}
+	copy(sector[len(sector)-2:], utilities.ShortToBytes(boot_signature))
+
+	if _, err := w.WriteAt(sector, int64(disk_signature_offset)); err != nil {
+		return fmt.Errorf("failed to write MBR: %w", err)
+	}
+
+	return nil
+}
+
+/*
+Encode a sector as a cylinder, head and sector address for a disk with 255 heads
+and 63 sectors per track. Sectors beyond what CHS can reach get the largest
+address, as tools that use LBA expect.
+*/
+func lbaToCHS(lba uint32) []byte {
+	const heads, sectors = 255, 63
+
+	cylinder := lba / (heads * sectors)
+	if cylinder > 1023 {
+		return []byte{0xFE, 0xFF, 0xFF}
+	}
+	head := (lba / sectors) % heads
+	sector := lba%sectors + 1
+
+	return []byte{byte(head), byte(sector) | byte(cylinder>>8)<<6, byte(cylinder)}
+}
+
+func checkOverlaps(partitions []*Partition) error {
+	for i, a := range partitions {
+		for _, b := range partitions[i+1:] {
+			if uint64(a.FirstLBA) < uint64(b.FirstLBA)+uint64(b.Sectors) &&
+				uint64(b.FirstLBA) < uint64(a.FirstLBA)+uint64(a.Sectors) {
+				return fmt.Errorf("%s overlaps %s", a, b)
+			}
+		}
+	}
+
+	return nil
+}
+
+func within(p *Partition, extended *Partition) bool {
+	return p.FirstLBA >= extended.FirstLBA &&
+		uint64(p.FirstLBA)+uint64(p.Sectors) <= uint64(extended.FirstLBA)+uint64(extended.Sectors)
+}
+
+func isExtendedType(partition_type uint8) bool {
+	return partition_type == TYPE_EXTENDED || partition_type == TYPE_EXTENDED_LBA || partition_type == TYPE_LINUX_EXTENDED
+}
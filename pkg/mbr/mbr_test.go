@@ -0,0 +1,137 @@
+package mbr
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/zni/fslib/internal/utilities"
+)
+
+/*
+A disk held in memory.
+*/
+type memDisk []byte
+
+func (disk memDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(disk)) {
+		return 0, io.EOF
+	}
+	n := copy(p, disk[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (disk memDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(disk)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(disk[off:], p), nil
+}
+
+/*
+Fill in an entry of the partition table in an MBR or EBR sector.
+*/
+func putEntry(sector []byte, i int, partition_type uint8, first_lba uint32, sectors uint32) {
+	entry := sector[table_offset+i*entry_size:][:entry_size]
+	entry[4] = partition_type
+	copy(entry[8:12], utilities.IntToBytes(first_lba))
+	copy(entry[12:16], utilities.IntToBytes(sectors))
+	copy(sector[510:512], utilities.ShortToBytes(boot_signature))
+}
+
+func TestWriteThenRead(t *testing.T) {
+	disk := make(memDisk, 8192*512)
+	disk[0] = 0xEB
+
+	written := &Table{
+		DiskSignature: 0x12345678,
+		Partitions: []*Partition{
+			{Number: 1, Bootable: true, Type: TYPE_FAT32_LBA, FirstLBA: 2048, Sectors: 2048},
+			{Number: 3, Type: TYPE_LINUX, FirstLBA: 4096, Sectors: 4096},
+		},
+	}
+	if err := Write(disk, written); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if disk[0] != 0xEB {
+		t.Errorf("Write overwrote the boot code")
+	}
+
+	table, err := Read(disk, 512)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if table.DiskSignature != written.DiskSignature {
+		t.Errorf("disk signature is %08x, not %08x", table.DiskSignature, written.DiskSignature)
+	}
+	if len(table.Partitions) != len(written.Partitions) {
+		t.Fatalf("read %d partitions, not %d", len(table.Partitions), len(written.Partitions))
+	}
+	for i, p := range table.Partitions {
+		if *p != *written.Partitions[i] {
+			t.Errorf("read %+v, not %+v", *p, *written.Partitions[i])
+		}
+	}
+}
+
+func TestReadLogicalPartitions(t *testing.T) {
+	disk := make(memDisk, 8192*512)
+	putEntry(disk[0:512], 0, TYPE_FAT16_LBA, 2048, 2048)
+	putEntry(disk[0:512], 1, TYPE_EXTENDED_LBA, 4096, 4096)
+
+	// Logical partitions are placed relative to their own EBR, and the link to
+	// the next EBR relative to the extended partition.
+	putEntry(disk[4096*512:][:512], 0, TYPE_LINUX, 63, 100)
+	putEntry(disk[4096*512:][:512], 1, TYPE_EXTENDED, 1024, 200)
+	putEntry(disk[5120*512:][:512], 0, TYPE_FAT32_LBA, 63, 100)
+
+	table, err := Read(disk, 512)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	want := map[int]uint32{5: 4096 + 63, 6: 5120 + 63}
+	for number, first_lba := range want {
+		p, err := table.Partition(number)
+		if err != nil {
+			t.Fatalf("Partition(%d): %v", number, err)
+		}
+		if !p.IsLogical() || p.FirstLBA != first_lba {
+			t.Errorf("partition %d is %+v, wanted a logical partition at sector %d", number, *p, first_lba)
+		}
+	}
+	if len(table.Partitions) != 4 {
+		t.Errorf("read %d partitions, not 4", len(table.Partitions))
+	}
+}
+
+func TestReadWithoutMBR(t *testing.T) {
+	disk := make(memDisk, 8192*512)
+	if _, err := Read(disk, 512); !errors.Is(err, ErrNoMBR) {
+		t.Errorf("Read of a blank disk gave %v, not ErrNoMBR", err)
+	}
+
+	// A looping EBR chain must be caught rather than followed forever.
+	putEntry(disk[0:512], 0, TYPE_EXTENDED, 2048, 2048)
+	putEntry(disk[2048*512:][:512], 1, TYPE_EXTENDED, 0, 2048)
+	if _, err := Read(disk, 512); err == nil {
+		t.Errorf("Read of a looping EBR chain succeeded")
+	}
+}
+
+func TestWriteRejectsDuplicateNumbers(t *testing.T) {
+	disk := make(memDisk, 8192*512)
+	table := &Table{Partitions: []*Partition{
+		{Number: 1, Type: TYPE_FAT32_LBA, FirstLBA: 2048, Sectors: 2048},
+		{Number: 1, Type: TYPE_LINUX, FirstLBA: 4096, Sectors: 2048},
+	}}
+	if err := Write(disk, table); err == nil {
+		t.Errorf("Write of two partitions numbered 1 succeeded")
+	}
+	if _, err := Read(disk, 512); !errors.Is(err, ErrNoMBR) {
+		t.Errorf("failed Write left a partition table behind")
+	}
+}